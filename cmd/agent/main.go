@@ -3,6 +3,9 @@ package main
 import (
 	"context"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/sersus/go-yandex-metrics/internal/config"
@@ -12,25 +15,30 @@ import (
 )
 
 func main() {
-	params := config.Init(config.WithPollInterval(), config.WithReportInterval(), config.WithAddr())
-	ctx := context.Background()
+	params := config.Init(
+		config.WithPollInterval(),
+		config.WithReportInterval(),
+		config.WithAddr(),
+		config.WithShutdownTimeout(),
+		config.WithBatchSize(),
+	)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	store := storage.NewMetricCollection()
 
-	errs, _ := errgroup.WithContext(ctx)
+	errs, ctx := errgroup.WithContext(ctx)
 	errs.Go(func() error {
-		h := harvester.New(&storage.MetricStorage)
-		for {
-			h.Harvest()
-			time.Sleep(time.Duration(params.PollInterval) * time.Second)
-		}
+		h := harvester.New(store)
+		h.Run(ctx, time.Duration(params.PollInterval)*time.Second)
+		return nil
 	})
 
-	sender := harvester.InitSender(params)
+	sender := harvester.InitSender(params, store)
 	errs.Go(func() error {
-		if err := sender.SendMetricsToServer(); err != nil {
-			log.Fatalln(err)
-		}
-		return nil
+		return sender.Run(ctx)
 	})
 
-	_ = errs.Wait()
+	if err := errs.Wait(); err != nil {
+		log.Fatalln(err)
+	}
 }
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/sersus/go-yandex-metrics/internal/config"
 	"github.com/sersus/go-yandex-metrics/internal/middleware"
@@ -23,25 +29,103 @@ func main() {
 		config.WithAddr(),
 		config.WithStoreInterval(),
 		config.WithFileStoragePath(),
+		config.WithFileBackups(),
 		config.WithRestore(),
 		config.WithDatabase(),
+		config.WithShutdownTimeout(),
+		config.WithGaugeNonFinite(),
+		config.WithNegativeDelta(),
+		config.WithHistogramBuckets(),
+		config.WithSummaryAccuracy(),
+		config.WithOutOfOrder(),
+		config.WithHistoryLength(),
+		config.WithRetention(),
+		config.WithRollups(),
 	)
 
-	r := router.New(*params)
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(context.Background(), params, flag.Arg(1), os.Stdout); err != nil {
+			middleware.SugarLogger.Fatalw(err.Error(), "event", "migrate")
+		}
+		return
+	}
+
+	store, err := storager.InitStorage(params, context.Background())
+	if err != nil {
+		middleware.SugarLogger.Fatalw(err.Error(), "event", "init storage")
+	}
+
+	r := router.New(*params, store)
 
 	middleware.SugarLogger.Infow(
 		"Starting server",
 		"addr", params.FlagRunAddr,
 	)
 
-	// regularly save metrics if needed
-	if params.DatabaseAddress != "" || params.FileStoragePath != "" {
-		sh := storager.InitSaverHelper(params)
-		go sh.SaveMetrics()
-	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// regularly save metrics to file if needed; postgres is written on every update
+	saverCtx, cancelSaver := context.WithCancel(context.Background())
+	saverDone := make(chan struct{})
+	go func() {
+		defer close(saverDone)
+		if params.DatabaseAddress == "" && params.FileStoragePath != "" {
+			storager.InitSaverHelper(params, saverCtx, store).SaveMetrics()
+		}
+	}()
+
+	// expire stale series and trim history in the background
+	janitorDone := make(chan struct{})
+	go func() {
+		defer close(janitorDone)
+		storager.InitJanitor(params, store).Run(saverCtx)
+	}()
+
+	// aggregate history into 1m and 1h buckets in the background
+	rollerDone := make(chan struct{})
+	go func() {
+		defer close(rollerDone)
+		storager.InitRoller(params, store).Run(saverCtx)
+	}()
 
 	// run server
-	if err := http.ListenAndServe(params.FlagRunAddr, r); err != nil {
+	srv := &http.Server{
+		Addr:    params.FlagRunAddr,
+		Handler: r,
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
 		middleware.SugarLogger.Fatalw(err.Error(), "event", "start server")
+	case <-ctx.Done():
+		middleware.SugarLogger.Infow("Shutting down server", "event", "shutdown")
+	}
+
+	shutdownTimeout := time.Duration(params.ShutdownTimeout) * time.Second
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// stop accepting connections and wait for in-flight requests
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		middleware.SugarLogger.Errorw(err.Error(), "event", "shutdown server")
+	}
+
+	cancelSaver()
+	<-saverDone
+	<-janitorDone
+	<-rollerDone
+
+	// final save of everything accepted before shutdown; draining connections
+	// may have used up shutdownCtx, so the flush gets its own timeout
+	closeCtx, cancelClose := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelClose()
+	if err := storager.Close(closeCtx, store); err != nil {
+		middleware.SugarLogger.Errorw(err.Error(), "event", "close storage")
 	}
+	middleware.SugarLogger.Infow("Server stopped", "event", "shutdown")
 }
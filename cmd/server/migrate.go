@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sersus/go-yandex-metrics/internal/config"
+	"github.com/sersus/go-yandex-metrics/internal/storager"
+)
+
+// runMigrate выполняет подкоманду `server migrate up|down|status`.
+func runMigrate(ctx context.Context, params *config.Options, command string, out io.Writer) error {
+	if params.DatabaseAddress == "" {
+		return errors.New("database address is required: use -d flag or DATABASE_DSN")
+	}
+	migrator, err := storager.NewMigrator(params)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	switch command {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "applied %d migration(s)\n", applied)
+	case "down":
+		reverted, err := migrator.Down(ctx)
+		if err != nil {
+			return err
+		}
+		if !reverted {
+			fmt.Fprintln(out, "nothing to revert")
+			return nil
+		}
+		fmt.Fprintln(out, "reverted 1 migration")
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied at " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(out, "%04d %-40s %s\n", s.Version, s.Name, state)
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", command)
+	}
+	return nil
+}
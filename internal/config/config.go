@@ -7,12 +7,23 @@ import (
 )
 
 const (
-	defaultAddr            string = "localhost:8080"
-	defaultReportInterval  int    = 10
-	defaultPollInterval    int    = 2
-	defaultStoreInterval   int    = 30
-	defaultFileStoragePath string = "/tmp/short-url-db.json"
-	defaultRestore         bool   = true
+	defaultAddr            string  = "localhost:8080"
+	defaultReportInterval  int     = 10
+	defaultPollInterval    int     = 2
+	defaultStoreInterval   int     = 30
+	defaultFileStoragePath string  = "/tmp/short-url-db.json"
+	defaultRestore         bool    = true
+	defaultFileBackups     int     = 3
+	defaultShutdownTimeout int     = 10
+	defaultBatchSize       int     = 100
+	defaultGaugeNonFinite  string  = "reject"
+	defaultSummaryAccuracy float64 = 0.01
+	defaultOutOfOrder      string  = "accept"
+	defaultHistoryLength   int     = 0
+	defaultJanitorInterval int     = 600
+	defaultRollupInterval  int     = 60
+	defaultMinuteRetention int     = 48
+	defaultHourRetention   int     = 2160
 )
 
 type Option func(params *Options)
@@ -24,7 +35,31 @@ type Options struct {
 	PollInterval    int
 	StoreInterval   int
 	FileStoragePath string
+	FileBackups     int
 	Restore         bool
+	ShutdownTimeout int
+	BatchSize       int
+	// GaugeNonFinite — политика для NaN и ±Inf у gauge: reject или allow
+	GaugeNonFinite     string
+	AllowNegativeDelta bool
+	// HistogramBuckets — границы корзин новых гистограмм через запятую
+	HistogramBuckets string
+	// SummaryAccuracy — относительная погрешность квантилей summary
+	SummaryAccuracy float64
+	// OutOfOrder — политика для сэмплов старше сохранённых: accept, newer или reject
+	OutOfOrder string
+	// HistoryLength — сколько последних сэмплов хранить для каждого ряда
+	HistoryLength int
+	// RetentionHours — через сколько часов без обновлений ряд удаляется; 0 — хранить всегда
+	RetentionHours int
+	// JanitorInterval — интервал чистки устаревших рядов и истории в секундах
+	JanitorInterval int
+	// RollupInterval — интервал агрегации истории в корзины в секундах
+	RollupInterval int
+	// RollupMinuteRetention и RollupHourRetention — сколько часов хранить
+	// минутные и часовые корзины; 0 — хранить всегда
+	RollupMinuteRetention int
+	RollupHourRetention   int
 }
 
 func WithDatabase() Option {
@@ -84,10 +119,19 @@ func WithStoreInterval() Option {
 func WithFileStoragePath() Option {
 	return func(p *Options) {
 		flag.StringVar(&p.FileStoragePath, "f", defaultFileStoragePath, "file name for metrics collection")
-		if envFileStoragePath := os.Getenv("FILE_STORAGE_PATH"); envFileStoragePath != "" {
-			fileStoragePath, err := strconv.Atoi(envFileStoragePath)
+		if envFileStoragePath, ok := os.LookupEnv("FILE_STORAGE_PATH"); ok {
+			p.FileStoragePath = envFileStoragePath
+		}
+	}
+}
+
+func WithFileBackups() Option {
+	return func(p *Options) {
+		flag.IntVar(&p.FileBackups, "file-backups", defaultFileBackups, "number of previous metric snapshots to keep")
+		if envFileBackups := os.Getenv("FILE_STORAGE_BACKUPS"); envFileBackups != "" {
+			fileBackups, err := strconv.Atoi(envFileBackups)
 			if err == nil {
-				p.StoreInterval = fileStoragePath
+				p.FileBackups = fileBackups
 			}
 		}
 	}
@@ -97,9 +141,141 @@ func WithRestore() Option {
 	return func(p *Options) {
 		flag.BoolVar(&p.Restore, "r", defaultRestore, "restore data from file")
 		if envRestore := os.Getenv("RESTORE"); envRestore != "" {
-			restore, err := strconv.Atoi(envRestore)
+			restore, err := strconv.ParseBool(envRestore)
+			if err == nil {
+				p.Restore = restore
+			}
+		}
+	}
+}
+
+func WithShutdownTimeout() Option {
+	return func(p *Options) {
+		flag.IntVar(&p.ShutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "graceful shutdown timeout in seconds")
+		if envShutdownTimeout := os.Getenv("SHUTDOWN_TIMEOUT"); envShutdownTimeout != "" {
+			shutdownTimeout, err := strconv.Atoi(envShutdownTimeout)
+			if err == nil {
+				p.ShutdownTimeout = shutdownTimeout
+			}
+		}
+	}
+}
+
+func WithBatchSize() Option {
+	return func(p *Options) {
+		flag.IntVar(&p.BatchSize, "b", defaultBatchSize, "max number of metrics in one report request")
+		if envBatchSize := os.Getenv("BATCH_SIZE"); envBatchSize != "" {
+			batchSize, err := strconv.Atoi(envBatchSize)
+			if err == nil {
+				p.BatchSize = batchSize
+			}
+		}
+	}
+}
+
+func WithGaugeNonFinite() Option {
+	return func(p *Options) {
+		flag.StringVar(&p.GaugeNonFinite, "gauge-nonfinite", defaultGaugeNonFinite, "policy for NaN and Inf gauge values: reject or allow")
+		if envGaugeNonFinite := os.Getenv("GAUGE_NONFINITE"); envGaugeNonFinite != "" {
+			p.GaugeNonFinite = envGaugeNonFinite
+		}
+	}
+}
+
+func WithNegativeDelta() Option {
+	return func(p *Options) {
+		flag.BoolVar(&p.AllowNegativeDelta, "counter-negative", false, "accept negative counter deltas (up/down counters)")
+		if envNegativeDelta := os.Getenv("COUNTER_NEGATIVE"); envNegativeDelta != "" {
+			allow, err := strconv.ParseBool(envNegativeDelta)
+			if err == nil {
+				p.AllowNegativeDelta = allow
+			}
+		}
+	}
+}
+
+func WithHistogramBuckets() Option {
+	return func(p *Options) {
+		flag.StringVar(&p.HistogramBuckets, "histogram-buckets", "", "comma-separated upper bounds of buckets for new histograms")
+		if envHistogramBuckets := os.Getenv("HISTOGRAM_BUCKETS"); envHistogramBuckets != "" {
+			p.HistogramBuckets = envHistogramBuckets
+		}
+	}
+}
+
+func WithSummaryAccuracy() Option {
+	return func(p *Options) {
+		flag.Float64Var(&p.SummaryAccuracy, "summary-accuracy", defaultSummaryAccuracy, "relative accuracy of summary quantiles")
+		if envSummaryAccuracy := os.Getenv("SUMMARY_ACCURACY"); envSummaryAccuracy != "" {
+			accuracy, err := strconv.ParseFloat(envSummaryAccuracy, 64)
+			if err == nil {
+				p.SummaryAccuracy = accuracy
+			}
+		}
+	}
+}
+
+func WithOutOfOrder() Option {
+	return func(p *Options) {
+		flag.StringVar(&p.OutOfOrder, "out-of-order", defaultOutOfOrder, "policy for samples older than the stored ones: accept, newer or reject")
+		if envOutOfOrder := os.Getenv("OUT_OF_ORDER"); envOutOfOrder != "" {
+			p.OutOfOrder = envOutOfOrder
+		}
+	}
+}
+
+func WithHistoryLength() Option {
+	return func(p *Options) {
+		flag.IntVar(&p.HistoryLength, "history-length", defaultHistoryLength, "number of recent samples kept per series, 0 disables history")
+		if envHistoryLength := os.Getenv("HISTORY_LENGTH"); envHistoryLength != "" {
+			historyLength, err := strconv.Atoi(envHistoryLength)
+			if err == nil {
+				p.HistoryLength = historyLength
+			}
+		}
+	}
+}
+
+func WithRetention() Option {
+	return func(p *Options) {
+		flag.IntVar(&p.RetentionHours, "retention-hours", 0, "remove series not updated for this many hours, 0 keeps them forever")
+		if envRetention := os.Getenv("RETENTION_HOURS"); envRetention != "" {
+			retention, err := strconv.Atoi(envRetention)
+			if err == nil {
+				p.RetentionHours = retention
+			}
+		}
+		flag.IntVar(&p.JanitorInterval, "janitor-interval", defaultJanitorInterval, "interval between pruning runs in seconds")
+		if envJanitorInterval := os.Getenv("JANITOR_INTERVAL"); envJanitorInterval != "" {
+			janitorInterval, err := strconv.Atoi(envJanitorInterval)
+			if err == nil {
+				p.JanitorInterval = janitorInterval
+			}
+		}
+	}
+}
+
+func WithRollups() Option {
+	return func(p *Options) {
+		flag.IntVar(&p.RollupInterval, "rollup-interval", defaultRollupInterval, "interval between history rollups in seconds, 0 disables rollups")
+		if envRollupInterval := os.Getenv("ROLLUP_INTERVAL"); envRollupInterval != "" {
+			rollupInterval, err := strconv.Atoi(envRollupInterval)
+			if err == nil {
+				p.RollupInterval = rollupInterval
+			}
+		}
+		flag.IntVar(&p.RollupMinuteRetention, "rollup-1m-retention", defaultMinuteRetention, "hours to keep 1m rollups, 0 keeps them forever")
+		if envMinuteRetention := os.Getenv("ROLLUP_1M_RETENTION"); envMinuteRetention != "" {
+			retention, err := strconv.Atoi(envMinuteRetention)
+			if err == nil {
+				p.RollupMinuteRetention = retention
+			}
+		}
+		flag.IntVar(&p.RollupHourRetention, "rollup-1h-retention", defaultHourRetention, "hours to keep 1h rollups, 0 keeps them forever")
+		if envHourRetention := os.Getenv("ROLLUP_1H_RETENTION"); envHourRetention != "" {
+			retention, err := strconv.Atoi(envHourRetention)
 			if err == nil {
-				p.StoreInterval = restore
+				p.RollupHourRetention = retention
 			}
 		}
 	}
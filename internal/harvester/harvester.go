@@ -3,10 +3,12 @@ package harvester
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
+	"net/http"
 	"runtime"
 	"time"
 
@@ -58,12 +60,22 @@ func (a *Harvest) Harvest() {
 	a.h.Collect(storage.Metric{ID: "RandomValue", MType: storage.Gauge, Value: PtrFloat64(float64(rand.Int()))})
 	a.h.Collect(storage.Metric{ID: "LastGC", MType: storage.Gauge, Value: PtrFloat64(float64(metrics.LastGC))})
 
-	cnt, _ := storage.MetricStorage.GetMetric("PollCount")
-	counter := int64(0)
-	if cnt.Delta != nil {
-		counter = *cnt.Delta + 1
+	a.h.Collect(storage.Metric{ID: "PollCount", MType: storage.Counter, Delta: PtrInt64(1)})
+}
+
+// Run собирает метрики раз в interval до отмены ctx.
+func (a *Harvest) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	a.Harvest()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.Harvest()
+		}
 	}
-	storage.MetricStorage.Collect(storage.Metric{ID: "PollCount", MType: storage.Counter, Delta: PtrInt64(counter)})
 }
 
 func New(harvester Harvester) *Harvest {
@@ -81,56 +93,130 @@ func PtrInt64(i int64) *int64 {
 }
 
 type Sender struct {
-	client        *resty.Client
-	reportTimeout time.Duration
-	addr          string
+	client          *resty.Client
+	storage         storage.Storage
+	reportTimeout   time.Duration
+	shutdownTimeout time.Duration
+	batchSize       int
+	addr            string
+
+	// значения счётчиков на момент последней успешной отправки; меняется только в Run
+	sent map[string]int64
 }
 
-func InitSender(opts *config.Options) *Sender {
+func InitSender(opts *config.Options, store storage.Storage) *Sender {
 	s := &Sender{
-		client:        resty.New(),
-		reportTimeout: time.Duration(opts.PollInterval),
-		addr:          opts.FlagRunAddr,
+		client:          resty.New(),
+		storage:         store,
+		reportTimeout:   time.Duration(opts.ReportInterval) * time.Second,
+		shutdownTimeout: time.Duration(opts.ShutdownTimeout) * time.Second,
+		batchSize:       opts.BatchSize,
+		addr:            opts.FlagRunAddr,
+		sent:            make(map[string]int64),
 	}
 	return s
 }
 
-func (s *Sender) SendMetricsToServer() error {
-	req := s.client.R().
-		SetHeader("Content-Type", "application/json").
-		SetHeader("Accept-Encoding", "gzip").
-		SetHeader("Content-Encoding", "gzip")
-
+// Run отправляет метрики раз в интервал отчёта и ещё раз после отмены ctx.
+func (s *Sender) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.reportTimeout)
+	defer ticker.Stop()
 	for {
-		for _, v := range storage.MetricStorage.Metrics {
-			jsonInput, _ := json.Marshal(v)
-			if err := s.sendRequest(req, string(jsonInput)); err != nil {
-				return fmt.Errorf("error while sending agent request for counter metric: %w", err)
+		select {
+		case <-ctx.Done():
+			finalCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+			defer cancel()
+			if err := s.SendMetricsToServer(finalCtx); err != nil {
+				return fmt.Errorf("error while sending final report: %w", err)
+			}
+			return nil
+		case <-ticker.C:
+			if err := s.SendMetricsToServer(ctx); err != nil {
+				log.Printf("Failed to send metrics: %v", err)
+			}
+		}
+	}
+}
+
+// SendMetricsToServer отправляет метрики пакетами не больше batchSize.
+func (s *Sender) SendMetricsToServer(ctx context.Context) error {
+	metrics, err := s.storage.List(ctx)
+	if err != nil {
+		return fmt.Errorf("error while reading metrics to send: %w", err)
+	}
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	reports := make([]storage.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		if m.MType == storage.Counter && m.Delta != nil {
+			m.Delta = PtrInt64(*m.Delta - s.sent[m.ID+m.Labels.Key()])
+		}
+		reports = append(reports, m)
+	}
+
+	batchSize := s.batchSize
+	if batchSize <= 0 {
+		batchSize = len(reports)
+	}
+	for start := 0; start < len(reports); start += batchSize {
+		end := start + batchSize
+		if end > len(reports) {
+			end = len(reports)
+		}
+		batch := reports[start:end]
+		if err := s.sendBatch(ctx, batch); err != nil {
+			return fmt.Errorf("error while sending agent request with %d metrics: %w", len(batch), err)
+		}
+		for _, m := range batch {
+			if m.MType == storage.Counter && m.Delta != nil {
+				s.sent[m.ID+m.Labels.Key()] += *m.Delta
 			}
 		}
-		time.Sleep(s.reportTimeout * time.Second)
 	}
+	return nil
 }
 
-func (s *Sender) sendRequest(req *resty.Request, jsonInput string) error {
+func (s *Sender) sendBatch(ctx context.Context, metrics []storage.Metric) error {
+	jsonInput, err := json.Marshal(metrics)
+	if err != nil {
+		return fmt.Errorf("error while marshal metrics: %w", err)
+	}
 	buf := bytes.NewBuffer(nil)
 	zb := gzip.NewWriter(buf)
-	if _, err := zb.Write([]byte(jsonInput)); err != nil {
+	if _, err := zb.Write(jsonInput); err != nil {
 		return fmt.Errorf("error while write json input: %w", err)
 	}
 	if err := zb.Close(); err != nil {
 		return fmt.Errorf("error while trying to close writer: %w", err)
 	}
 
-	err := retry.Do(
+	err = retry.Do(
 		func() error {
-			var err error
-			if _, err = req.SetBody(buf).Post(fmt.Sprintf("http://%s/update/", s.addr)); err != nil {
+			resp, err := s.client.R().
+				SetContext(ctx).
+				SetHeader("Content-Type", "application/json").
+				SetHeader("Accept-Encoding", "gzip").
+				SetHeader("Content-Encoding", "gzip").
+				SetBody(buf.Bytes()).
+				Post(fmt.Sprintf("http://%s/updates/", s.addr))
+			if err != nil {
 				return fmt.Errorf("error while trying to create post request: %w", err)
 			}
+			if resp.IsError() {
+				err := fmt.Errorf("server responded with status %d", resp.StatusCode())
+				if resp.StatusCode() < http.StatusInternalServerError {
+					// повтор не поможет: сервер отверг сам пакет
+					return retry.Unrecoverable(err)
+				}
+				return err
+			}
 			return nil
 		},
+		retry.Context(ctx),
 		retry.Attempts(10),
+		retry.LastErrorOnly(true),
 		retry.OnRetry(func(n uint, err error) {
 			log.Printf("Retrying request after error: %v", err)
 		}),
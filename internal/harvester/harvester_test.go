@@ -0,0 +1,182 @@
+package harvester
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sersus/go-yandex-metrics/internal/storage"
+)
+
+type receivedMetrics struct {
+	mu      sync.Mutex
+	batches [][]storage.Metric
+	metrics []storage.Metric
+}
+
+func (rm *receivedMetrics) handler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/updates/" || r.Header.Get("Content-Encoding") != "gzip" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var batch []storage.Metric
+	if err := json.NewDecoder(zr).Decode(&batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rm.mu.Lock()
+	rm.batches = append(rm.batches, batch)
+	rm.metrics = append(rm.metrics, batch...)
+	rm.mu.Unlock()
+}
+
+func newTestSender(store storage.Storage, url string, batchSize int) *Sender {
+	return &Sender{
+		client:          resty.New(),
+		storage:         store,
+		reportTimeout:   time.Hour,
+		shutdownTimeout: 5 * time.Second,
+		batchSize:       batchSize,
+		addr:            strings.TrimPrefix(url, "http://"),
+		sent:            make(map[string]int64),
+	}
+}
+
+func TestSender_SendMetricsInBatches(t *testing.T) {
+	received := &receivedMetrics{}
+	srv := httptest.NewServer(http.HandlerFunc(received.handler))
+	defer srv.Close()
+
+	store := storage.NewMetricCollection()
+	for i := 0; i < 5; i++ {
+		require.NoError(t, store.Collect(storage.Metric{ID: fmt.Sprintf("Gauge%d", i), MType: storage.Gauge, Value: PtrFloat64(float64(i))}))
+	}
+	s := newTestSender(store, srv.URL, 2)
+
+	require.NoError(t, s.SendMetricsToServer(context.Background()))
+
+	received.mu.Lock()
+	defer received.mu.Unlock()
+	require.Len(t, received.batches, 3)
+	assert.Len(t, received.batches[0], 2)
+	assert.Len(t, received.batches[1], 2)
+	assert.Len(t, received.batches[2], 1)
+	assert.Len(t, received.metrics, 5)
+}
+
+func TestSender_SendsCounterIncrements(t *testing.T) {
+	received := &receivedMetrics{}
+	srv := httptest.NewServer(http.HandlerFunc(received.handler))
+	defer srv.Close()
+
+	store := storage.NewMetricCollection()
+	s := newTestSender(store, srv.URL, 10)
+	ctx := context.Background()
+
+	require.NoError(t, store.Collect(storage.Metric{ID: "PollCount", MType: storage.Counter, Delta: PtrInt64(3)}))
+	require.NoError(t, s.SendMetricsToServer(ctx))
+	require.NoError(t, store.Collect(storage.Metric{ID: "PollCount", MType: storage.Counter, Delta: PtrInt64(2)}))
+	require.NoError(t, s.SendMetricsToServer(ctx))
+
+	received.mu.Lock()
+	defer received.mu.Unlock()
+	require.Len(t, received.metrics, 2)
+	assert.Equal(t, int64(3), *received.metrics[0].Delta)
+	assert.Equal(t, int64(2), *received.metrics[1].Delta)
+}
+
+func TestSender_KeepsIncrementsOnFailure(t *testing.T) {
+	received := &receivedMetrics{}
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received.handler(w, r)
+	}))
+	defer srv.Close()
+
+	store := storage.NewMetricCollection()
+	s := newTestSender(store, srv.URL, 10)
+	ctx := context.Background()
+
+	require.NoError(t, store.Collect(storage.Metric{ID: "PollCount", MType: storage.Counter, Delta: PtrInt64(3)}))
+	assert.Error(t, s.SendMetricsToServer(ctx))
+
+	fail = false
+	require.NoError(t, s.SendMetricsToServer(ctx))
+
+	received.mu.Lock()
+	defer received.mu.Unlock()
+	require.Len(t, received.metrics, 1)
+	assert.Equal(t, int64(3), *received.metrics[0].Delta)
+}
+
+func TestSender_FinalReportOnShutdown(t *testing.T) {
+	received := &receivedMetrics{}
+	srv := httptest.NewServer(http.HandlerFunc(received.handler))
+	defer srv.Close()
+
+	store := storage.NewMetricCollection()
+	require.NoError(t, store.Collect(storage.Metric{ID: "PollCount", MType: storage.Counter, Delta: PtrInt64(3)}))
+
+	s := newTestSender(store, srv.URL, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("sender did not stop after cancellation")
+	}
+
+	received.mu.Lock()
+	defer received.mu.Unlock()
+	require.Len(t, received.metrics, 1)
+	assert.Equal(t, "PollCount", received.metrics[0].ID)
+	assert.Equal(t, int64(3), *received.metrics[0].Delta)
+}
+
+func TestHarvest_RunStopsOnCancel(t *testing.T) {
+	store := storage.NewMetricCollection()
+	h := New(store)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.Run(ctx, time.Hour)
+		close(done)
+	}()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("harvester did not stop after cancellation")
+	}
+	_, err := store.GetMetric(storage.Counter, "PollCount")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,303 @@
+// Package prometheus отдаёт метрики хранилища в текстовом формате Prometheus.
+package prometheus
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sersus/go-yandex-metrics/internal/storage"
+)
+
+// ContentType — тип содержимого текстового формата версии 0.0.4.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// typeOrder задаёт порядок типов, когда одно имя есть у метрик разных типов.
+var typeOrder = map[string]int{
+	storage.Counter:   0,
+	storage.Gauge:     1,
+	storage.Histogram: 2,
+	storage.Summary:   3,
+	storage.Set:       4,
+}
+
+// family — метрики одного имени и типа; в выводе у них общая строка TYPE.
+type family struct {
+	name    string
+	mType   string
+	metrics []storage.Metric
+}
+
+// Options настраивает вывод WriteText.
+type Options struct {
+	// UpDownCounters — счётчики могут уменьшаться. Counter в Prometheus только
+	// растёт, поэтому такие счётчики отдаются как gauge.
+	UpDownCounters bool
+}
+
+// WriteText пишет метрики в текстовом формате Prometheus; set отдаётся как gauge.
+// Ряды, имена которых после приведения совпали с уже выведенными, пропускаются.
+func WriteText(w io.Writer, metrics []storage.Metric, opts Options) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range families(metrics) {
+		writeFamily(bw, f, opts)
+	}
+	return bw.Flush()
+}
+
+func families(metrics []storage.Metric) []*family {
+	// при совпадениях остаётся первый ряд, поэтому порядок не зависит от хранилища
+	sorted := append([]storage.Metric(nil), metrics...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].ID != sorted[j].ID {
+			return sorted[i].ID < sorted[j].ID
+		}
+		return sorted[i].Labels.Key() < sorted[j].Labels.Key()
+	})
+
+	byName := make(map[string]map[string]*family)
+	for _, m := range sorted {
+		if _, ok := typeOrder[m.MType]; !ok {
+			continue
+		}
+		labels, ok := sanitizeLabels(m.Labels)
+		if !ok {
+			continue
+		}
+		m.Labels = labels
+		name := SanitizeName(m.ID)
+		if byName[name] == nil {
+			byName[name] = make(map[string]*family)
+		}
+		f, ok := byName[name][m.MType]
+		if !ok {
+			f = &family{name: name, mType: m.MType}
+			byName[name][m.MType] = f
+		}
+		f.metrics = append(f.metrics, m)
+	}
+
+	// имена метрик занимаются раньше имён с суффиксом типа
+	var own, suffixed []*family
+	for _, types := range byName {
+		group := make([]*family, 0, len(types))
+		for _, f := range types {
+			group = append(group, f)
+		}
+		sort.Slice(group, func(i, j int) bool { return typeOrder[group[i].mType] < typeOrder[group[j].mType] })
+		own = append(own, group[0])
+		for _, f := range group[1:] {
+			f.name += "_" + f.mType
+			suffixed = append(suffixed, f)
+		}
+	}
+	sortByName(own)
+	sortByName(suffixed)
+
+	taken := make(map[string]bool)
+	result := make([]*family, 0, len(own)+len(suffixed))
+	for _, f := range append(own, suffixed...) {
+		if !reserve(taken, f.seriesNames()) {
+			continue
+		}
+		f.metrics = uniqueSeries(f)
+		result = append(result, f)
+	}
+	sortByName(result)
+	return result
+}
+
+func sortByName(families []*family) {
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+}
+
+// seriesNames возвращает имена, под которыми пишутся ряды семейства.
+func (f *family) seriesNames() []string {
+	switch f.mType {
+	case storage.Histogram:
+		return []string{f.name, f.name + "_bucket", f.name + "_sum", f.name + "_count"}
+	case storage.Summary:
+		return []string{f.name, f.name + "_sum", f.name + "_count"}
+	}
+	return []string{f.name}
+}
+
+// reserve занимает имена, если ни одно из них ещё не занято.
+func reserve(taken map[string]bool, names []string) bool {
+	for _, name := range names {
+		if taken[name] {
+			return false
+		}
+	}
+	for _, name := range names {
+		taken[name] = true
+	}
+	return true
+}
+
+// uniqueSeries оставляет по одному ряду на набор меток вывода.
+func uniqueSeries(f *family) []storage.Metric {
+	extraName := extraLabel(f.mType)
+	seen := make(map[string]bool, len(f.metrics))
+	unique := f.metrics[:0]
+	for _, m := range f.metrics {
+		labels := make(storage.Labels, len(m.Labels))
+		for name, value := range m.Labels {
+			if name != extraName {
+				labels[name] = value
+			}
+		}
+		if seen[labels.Key()] {
+			continue
+		}
+		seen[labels.Key()] = true
+		unique = append(unique, m)
+	}
+	sort.Slice(unique, func(i, j int) bool { return unique[i].Labels.Key() < unique[j].Labels.Key() })
+	return unique
+}
+
+// sanitizeLabels приводит имена меток к допустимым; false — если имена совпали.
+func sanitizeLabels(labels storage.Labels) (storage.Labels, bool) {
+	if len(labels) == 0 {
+		return labels, true
+	}
+	sanitized := make(storage.Labels, len(labels))
+	for name, value := range labels {
+		name = SanitizeLabelName(name)
+		if _, ok := sanitized[name]; ok {
+			return nil, false
+		}
+		sanitized[name] = value
+	}
+	return sanitized, true
+}
+
+// extraLabel возвращает служебную метку, которую добавляет тип.
+func extraLabel(metricType string) string {
+	switch metricType {
+	case storage.Histogram:
+		return "le"
+	case storage.Summary:
+		return "quantile"
+	}
+	return ""
+}
+
+func writeFamily(w *bufio.Writer, f *family, opts Options) {
+	promType := f.mType
+	if f.mType == storage.Set || f.mType == storage.Counter && opts.UpDownCounters {
+		promType = storage.Gauge
+	}
+	w.WriteString("# TYPE " + f.name + " " + promType + "\n")
+
+	for _, m := range f.metrics {
+		switch m.MType {
+		case storage.Counter:
+			if m.Delta != nil {
+				writeSample(w, f.name, m.Labels, "", "", strconv.FormatInt(*m.Delta, 10))
+			}
+		case storage.Gauge:
+			if m.Value != nil {
+				writeSample(w, f.name, m.Labels, "", "", formatFloat(*m.Value))
+			}
+		case storage.Set:
+			if m.Set != nil {
+				writeSample(w, f.name, m.Labels, "", "", strconv.FormatUint(m.Set.Count, 10))
+			}
+		case storage.Histogram:
+			if h := m.Histogram; h != nil {
+				// в Prometheus корзины накопительные, последняя — le="+Inf"
+				var cumulative uint64
+				for i, bound := range h.Bounds {
+					cumulative += h.Counts[i]
+					writeSample(w, f.name+"_bucket", m.Labels, "le", formatFloat(bound), strconv.FormatUint(cumulative, 10))
+				}
+				writeSample(w, f.name+"_bucket", m.Labels, "le", "+Inf", strconv.FormatUint(h.Count, 10))
+				writeSample(w, f.name+"_sum", m.Labels, "", "", formatFloat(h.Sum))
+				writeSample(w, f.name+"_count", m.Labels, "", "", strconv.FormatUint(h.Count, 10))
+			}
+		case storage.Summary:
+			if s := m.Summary; s != nil {
+				for _, q := range s.Quantiles(storage.DefaultQuantiles) {
+					writeSample(w, f.name, m.Labels, "quantile", formatFloat(q.Quantile), formatFloat(q.Value))
+				}
+				writeSample(w, f.name+"_sum", m.Labels, "", "", formatFloat(s.Sum))
+				writeSample(w, f.name+"_count", m.Labels, "", "", strconv.FormatUint(s.Count, 10))
+			}
+		}
+	}
+}
+
+// writeSample пишет строку сэмпла; extraName (le или quantile) заменяет одноимённую метку.
+func writeSample(w *bufio.Writer, name string, labels storage.Labels, extraName, extraValue, value string) {
+	w.WriteString(name)
+
+	names := make([]string, 0, len(labels))
+	for labelName := range labels {
+		if labelName != extraName {
+			names = append(names, labelName)
+		}
+	}
+	sort.Strings(names)
+	if len(names) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, labelName := range names {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			writeLabel(w, labelName, labels[labelName])
+		}
+		if extraName != "" {
+			if len(names) > 0 {
+				w.WriteByte(',')
+			}
+			writeLabel(w, extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteString(" " + value + "\n")
+}
+
+func writeLabel(w *bufio.Writer, name, value string) {
+	w.WriteString(name + `="` + labelValueEscaper.Replace(value) + `"`)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatFloat записывает число так, как его разбирает Prometheus: NaN, +Inf, -Inf.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// SanitizeName приводит имя метрики к виду [a-zA-Z_:][a-zA-Z0-9_:]*.
+func SanitizeName(name string) string {
+	return sanitize(name, true)
+}
+
+// SanitizeLabelName приводит имя метки к виду [a-zA-Z_][a-zA-Z0-9_]*.
+func SanitizeLabelName(name string) string {
+	return sanitize(name, false)
+}
+
+func sanitize(name string, colons bool) string {
+	if name == "" {
+		return "_"
+	}
+	var b strings.Builder
+	for i, r := range name {
+		valid := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_' || colons && r == ':' || i > 0 && r >= '0' && r <= '9'
+		switch {
+		case valid:
+			b.WriteRune(r)
+		case i == 0 && r >= '0' && r <= '9':
+			b.WriteByte('_')
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
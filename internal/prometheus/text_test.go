@@ -0,0 +1,165 @@
+package prometheus
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/sersus/go-yandex-metrics/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ptrFloat64(f float64) *float64 {
+	return &f
+}
+
+func ptrInt64(i int64) *int64 {
+	return &i
+}
+
+func TestWriteText(t *testing.T) {
+	histogram := storage.NewHistogram([]float64{0.5, 1})
+	for _, v := range []float64{0.2, 0.7, 0.8, 3} {
+		histogram.Observe(v)
+	}
+	set := &storage.SetValue{Count: 42}
+
+	metrics := []storage.Metric{
+		{ID: "Alloc", MType: storage.Gauge, Labels: storage.Labels{"host": "web-2"}, Value: ptrFloat64(2.5)},
+		{ID: "Alloc", MType: storage.Gauge, Labels: storage.Labels{"host": "web-1"}, Value: ptrFloat64(math.Inf(1))},
+		{ID: "PollCount", MType: storage.Counter, Delta: ptrInt64(7)},
+		{ID: "PollCount", MType: storage.Gauge, Value: ptrFloat64(1)},
+		{ID: "http.latency", MType: storage.Histogram, Labels: storage.Labels{"path": `/a"b\`}, Histogram: histogram},
+		{ID: "2xx-rate", MType: storage.Set, Set: set},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteText(&buf, metrics, Options{}))
+	assert.Equal(t, `# TYPE Alloc gauge
+Alloc{host="web-1"} +Inf
+Alloc{host="web-2"} 2.5
+# TYPE PollCount counter
+PollCount 7
+# TYPE PollCount_gauge gauge
+PollCount_gauge 1
+# TYPE _2xx_rate gauge
+_2xx_rate 42
+# TYPE http_latency histogram
+http_latency_bucket{path="/a\"b\\",le="0.5"} 1
+http_latency_bucket{path="/a\"b\\",le="1"} 3
+http_latency_bucket{path="/a\"b\\",le="+Inf"} 4
+http_latency_sum{path="/a\"b\\"} 4.7
+http_latency_count{path="/a\"b\\"} 4
+`, buf.String())
+}
+
+func TestWriteTextSummary(t *testing.T) {
+	summary := storage.NewSummary(0.01)
+	summary.Observe(10)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteText(&buf, []storage.Metric{
+		{ID: "rtt", MType: storage.Summary, Labels: storage.Labels{"quantile": "x"}, Summary: summary},
+	}, Options{}))
+	assert.Equal(t, `# TYPE rtt summary
+rtt{quantile="0.5"} 10
+rtt{quantile="0.9"} 10
+rtt{quantile="0.95"} 10
+rtt{quantile="0.99"} 10
+rtt_sum{quantile="x"} 10
+rtt_count{quantile="x"} 1
+`, buf.String())
+}
+
+func TestWriteTextUpDownCounters(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteText(&buf, []storage.Metric{
+		{ID: "Queue", MType: storage.Counter, Delta: ptrInt64(-2)},
+		{ID: "Users", MType: storage.Set, Set: &storage.SetValue{Count: 3}},
+	}, Options{UpDownCounters: true}))
+	assert.Equal(t, `# TYPE Queue gauge
+Queue -2
+# TYPE Users gauge
+Users 3
+`, buf.String())
+}
+
+func TestSanitizeName(t *testing.T) {
+	tests := map[string]string{
+		"Alloc":            "Alloc",
+		"http.requests":    "http_requests",
+		"cpu:usage":        "cpu:usage",
+		"9lives":           "_9lives",
+		"мем":              "___",
+		"":                 "_",
+		"GCCPUFraction_01": "GCCPUFraction_01",
+	}
+	for name, want := range tests {
+		assert.Equal(t, want, SanitizeName(name), name)
+	}
+	assert.Equal(t, "cpu_usage", SanitizeLabelName("cpu:usage"))
+}
+
+func TestWriteTextClashingLabels(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteText(&buf, []storage.Metric{
+		// a.b и a_b дают одну метку, такой ряд не записать
+		{ID: "Alloc", MType: storage.Gauge, Labels: storage.Labels{"a.b": "1", "a_b": "2"}, Value: ptrFloat64(1)},
+		// после приведения ряды совпадают, остаётся первый
+		{ID: "Alloc", MType: storage.Gauge, Labels: storage.Labels{"host.name": "web"}, Value: ptrFloat64(2)},
+		{ID: "Alloc", MType: storage.Gauge, Labels: storage.Labels{"host_name": "web"}, Value: ptrFloat64(3)},
+		{ID: "Alloc.x", MType: storage.Gauge, Value: ptrFloat64(4)},
+		{ID: "Alloc_x", MType: storage.Gauge, Value: ptrFloat64(5)},
+	}, Options{}))
+	assert.Equal(t, `# TYPE Alloc gauge
+Alloc{host_name="web"} 2
+# TYPE Alloc_x gauge
+Alloc_x 4
+`, buf.String())
+}
+
+func TestWriteTextClashingTypeSuffix(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteText(&buf, []storage.Metric{
+		{ID: "PollCount", MType: storage.Counter, Delta: ptrInt64(7)},
+		{ID: "PollCount", MType: storage.Gauge, Value: ptrFloat64(1)},
+		// настоящая метрика важнее имени с суффиксом типа
+		{ID: "PollCount_gauge", MType: storage.Gauge, Value: ptrFloat64(2)},
+	}, Options{}))
+	assert.Equal(t, `# TYPE PollCount counter
+PollCount 7
+# TYPE PollCount_gauge gauge
+PollCount_gauge 2
+`, buf.String())
+}
+
+func TestWriteTextClashingHistogramSeries(t *testing.T) {
+	histogram := storage.NewHistogram([]float64{1})
+	histogram.Observe(0.5)
+	summary := storage.NewSummary(0.01)
+	summary.Observe(10)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteText(&buf, []storage.Metric{
+		{ID: "x", MType: storage.Histogram, Histogram: histogram},
+		{ID: "x_bucket", MType: storage.Gauge, Value: ptrFloat64(1)},
+		{ID: "rtt", MType: storage.Summary, Summary: summary},
+		{ID: "rtt_count", MType: storage.Counter, Delta: ptrInt64(3)},
+		// le заменяется корзиной, поэтому ряды совпадают
+		{ID: "x", MType: storage.Histogram, Labels: storage.Labels{"le": "1"}, Histogram: histogram},
+	}, Options{}))
+	assert.Equal(t, `# TYPE rtt summary
+rtt{quantile="0.5"} 10
+rtt{quantile="0.9"} 10
+rtt{quantile="0.95"} 10
+rtt{quantile="0.99"} 10
+rtt_sum 10
+rtt_count 1
+# TYPE x histogram
+x_bucket{le="1"} 1
+x_bucket{le="+Inf"} 1
+x_sum 0.5
+x_count 1
+`, buf.String())
+}
@@ -0,0 +1,406 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sersus/go-yandex-metrics/internal/storage"
+)
+
+const (
+	// lookback — насколько старый сэмпл ещё годится как значение ряда.
+	lookback = 5 * time.Minute
+	// maxPoints ограничивает число шагов одного запроса по интервалу.
+	maxPoints = 11000
+	// maxSeries ограничивает число рядов одной выборки: история каждого
+	// читается отдельным запросом к хранилищу.
+	maxSeries = 1000
+)
+
+// Point — значение ряда результата в момент времени.
+type Point struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// MarshalJSON, как и у storage.Sample, кодирует NaN и ±Inf строками.
+func (p Point) MarshalJSON() ([]byte, error) {
+	type point Point
+	if !math.IsNaN(p.Value) && !math.IsInf(p.Value, 0) {
+		return json.Marshal(point(p))
+	}
+	return json.Marshal(struct {
+		point
+		Value string `json:"value"`
+	}{
+		point: point(p),
+		Value: strconv.FormatFloat(p.Value, 'g', -1, 64),
+	})
+}
+
+// Series — ряд результата. После агрегации у ряда остаются только метки из
+// by, а имя — если среди них есть __name__.
+type Series struct {
+	ID     string         `json:"id,omitempty"`
+	MType  string         `json:"type,omitempty"`
+	Labels storage.Labels `json:"labels,omitempty"`
+	Points []Point        `json:"points"`
+}
+
+type engine struct {
+	storage storage.Storage
+}
+
+// New создаёт движок запросов поверх хранилища.
+func New(store storage.Storage) *engine {
+	return &engine{storage: store}
+}
+
+// Instant вычисляет запрос в момент at; у каждого ряда результата одна точка.
+func (e *engine) Instant(ctx context.Context, query string, at time.Time) ([]Series, error) {
+	return e.exec(ctx, query, at, at, time.Second)
+}
+
+// Range вычисляет запрос в моменты start, start+step, ... до end включительно.
+func (e *engine) Range(ctx context.Context, query string, start, end time.Time, step time.Duration) ([]Series, error) {
+	if step <= 0 {
+		return nil, &storage.ValidationError{Field: "step", Reason: "step must be positive", Err: storage.ErrBadRequest}
+	}
+	if end.Before(start) {
+		return nil, &storage.ValidationError{Field: "end", Reason: "end must not be before start", Err: storage.ErrBadRequest}
+	}
+	if end.Sub(start)/step >= maxPoints {
+		return nil, &storage.ValidationError{Field: "step", Reason: fmt.Sprintf("query must not have more than %d points, increase step", maxPoints), Err: storage.ErrBadRequest}
+	}
+	return e.exec(ctx, query, start, end, step)
+}
+
+func (e *engine) exec(ctx context.Context, query string, start, end time.Time, step time.Duration) ([]Series, error) {
+	expr, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	ev := &evaluator{
+		ctx:     ctx,
+		storage: e.storage,
+		from:    start.Add(-maxRange(expr) - lookback),
+		to:      end,
+		loaded:  make(map[*Selector][]series),
+	}
+
+	index := make(map[string]int)
+	var result []Series
+	for t := start; !t.After(end); t = t.Add(step) {
+		vector, err := ev.eval(expr, t)
+		if err != nil {
+			return nil, err
+		}
+		for _, el := range vector {
+			i, ok := index[el.key()]
+			if !ok {
+				i = len(result)
+				index[el.key()] = i
+				result = append(result, Series{ID: el.id, MType: el.mType, Labels: el.labels})
+			}
+			result[i].Points = append(result[i].Points, Point{Timestamp: t, Value: el.value})
+		}
+	}
+	if result == nil {
+		result = []Series{}
+	}
+	// порядок topk значим, остальные ряды упорядочиваются для стабильного ответа
+	if agg, ok := expr.(*Aggregation); !ok || agg.Op != "topk" {
+		sort.Slice(result, func(i, j int) bool {
+			return seriesKey(result[i].ID, result[i].MType, result[i].Labels) < seriesKey(result[j].ID, result[j].MType, result[j].Labels)
+		})
+	}
+	return result, nil
+}
+
+// maxRange возвращает наибольшее окно выборок запроса.
+func maxRange(expr Expr) time.Duration {
+	switch e := expr.(type) {
+	case *Call:
+		return e.Arg.Range
+	case *Aggregation:
+		return maxRange(e.Expr)
+	}
+	return 0
+}
+
+// element — значение одного ряда в момент вычисления.
+type element struct {
+	id     string
+	mType  string
+	labels storage.Labels
+	value  float64
+}
+
+func (el element) key() string {
+	return seriesKey(el.id, el.mType, el.labels)
+}
+
+func seriesKey(id, mType string, labels storage.Labels) string {
+	return id + "\x00" + mType + "\x00" + labels.Key()
+}
+
+// series — ряд хранилища и его сэмплы по возрастанию времени.
+type series struct {
+	metric  storage.Metric
+	samples []storage.Sample
+}
+
+// evaluator вычисляет запрос; сэмплы каждой выборки читаются один раз.
+type evaluator struct {
+	ctx     context.Context
+	storage storage.Storage
+	from    time.Time
+	to      time.Time
+	loaded  map[*Selector][]series
+}
+
+func (ev *evaluator) load(sel *Selector) ([]series, error) {
+	if loaded, ok := ev.loaded[sel]; ok {
+		return loaded, nil
+	}
+	metrics, err := ev.storage.List(ev.ctx, sel.Matchers...)
+	if err != nil {
+		return nil, err
+	}
+	if len(metrics) > maxSeries {
+		return nil, &storage.ValidationError{Field: "query", Reason: fmt.Sprintf("selector must not match more than %d series, add matchers", maxSeries), Err: storage.ErrBadRequest}
+	}
+	loaded := make([]series, 0, len(metrics))
+	for _, m := range metrics {
+		samples, err := ev.storage.History(ev.ctx, m.MType, m.ID, m.Labels, ev.from, ev.to)
+		if errors.Is(err, storage.ErrNotFound) {
+			// ряд удалили после List
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// без истории или за её пределами остаётся текущее значение ряда
+		if current, ok := currentSample(m); ok && !current.Timestamp.After(ev.to) &&
+			(len(samples) == 0 || current.Timestamp.After(samples[len(samples)-1].Timestamp)) {
+			samples = append(samples, current)
+		}
+		loaded = append(loaded, series{metric: m, samples: samples})
+	}
+	ev.loaded[sel] = loaded
+	return loaded, nil
+}
+
+func (ev *evaluator) eval(expr Expr, t time.Time) ([]element, error) {
+	switch e := expr.(type) {
+	case *Selector:
+		return ev.evalSelector(e, t)
+	case *Call:
+		return ev.evalCall(e, t)
+	case *Aggregation:
+		inner, err := ev.eval(e.Expr, t)
+		if err != nil {
+			return nil, err
+		}
+		return aggregate(e, inner), nil
+	}
+	return nil, fmt.Errorf("unexpected expression %T", expr)
+}
+
+func (ev *evaluator) evalSelector(sel *Selector, t time.Time) ([]element, error) {
+	loaded, err := ev.load(sel)
+	if err != nil {
+		return nil, err
+	}
+	vector := make([]element, 0, len(loaded))
+	for _, s := range loaded {
+		i := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].Timestamp.After(t) }) - 1
+		if i < 0 {
+			continue
+		}
+		sample := s.samples[i]
+		if i < len(s.samples)-1 && t.Sub(sample.Timestamp) > lookback {
+			continue
+		}
+		vector = append(vector, element{id: s.metric.ID, mType: s.metric.MType, labels: s.metric.Labels, value: valueOf(sample)})
+	}
+	return vector, nil
+}
+
+func (ev *evaluator) evalCall(call *Call, t time.Time) ([]element, error) {
+	loaded, err := ev.load(call.Arg)
+	if err != nil {
+		return nil, err
+	}
+	start := t.Add(-call.Arg.Range)
+	vector := make([]element, 0, len(loaded))
+	for _, s := range loaded {
+		// окно (t-range, t]
+		lo := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].Timestamp.After(start) })
+		hi := sort.Search(len(s.samples), func(i int) bool { return s.samples[i].Timestamp.After(t) })
+		value, ok := apply(call.Func, s.samples[lo:hi])
+		if !ok {
+			continue
+		}
+		vector = append(vector, element{id: s.metric.ID, mType: s.metric.MType, labels: s.metric.Labels, value: value})
+	}
+	return vector, nil
+}
+
+// apply вычисляет функцию над сэмплами окна.
+func apply(fn string, samples []storage.Sample) (float64, bool) {
+	if len(samples) == 0 {
+		return 0, false
+	}
+	first, last := valueOf(samples[0]), valueOf(samples[len(samples)-1])
+	switch fn {
+	case "rate", "increase":
+		if len(samples) < 2 {
+			return 0, false
+		}
+		if fn == "rate" {
+			span := samples[len(samples)-1].Timestamp.Sub(samples[0].Timestamp)
+			if span <= 0 {
+				return 0, false
+			}
+			return (last - first) / span.Seconds(), true
+		}
+		return last - first, true
+	case "count_over_time":
+		return float64(len(samples)), true
+	}
+
+	result := first
+	for _, s := range samples[1:] {
+		v := valueOf(s)
+		switch fn {
+		case "min_over_time":
+			result = math.Min(result, v)
+		case "max_over_time":
+			result = math.Max(result, v)
+		default:
+			result += v
+		}
+	}
+	if fn == "avg_over_time" {
+		result /= float64(len(samples))
+	}
+	return result, true
+}
+
+// aggregate сворачивает ряды по группам меток By.
+func aggregate(agg *Aggregation, vector []element) []element {
+	groups := make(map[string][]element)
+	keys := make([]string, 0)
+	heads := make(map[string]element)
+	for _, el := range vector {
+		head := groupOf(el, agg.By)
+		key := head.key()
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+			heads[key] = head
+		}
+		groups[key] = append(groups[key], el)
+	}
+	sort.Strings(keys)
+
+	result := make([]element, 0, len(keys))
+	for _, key := range keys {
+		members := groups[key]
+		if agg.Op == "topk" {
+			sort.SliceStable(members, func(i, j int) bool {
+				a, b := members[i].value, members[j].value
+				return a > b || !math.IsNaN(a) && math.IsNaN(b)
+			})
+			if len(members) > agg.Param {
+				members = members[:agg.Param]
+			}
+			result = append(result, members...)
+			continue
+		}
+
+		head := heads[key]
+		head.value = members[0].value
+		for _, el := range members[1:] {
+			switch agg.Op {
+			case "min":
+				head.value = math.Min(head.value, el.value)
+			case "max":
+				head.value = math.Max(head.value, el.value)
+			default:
+				head.value += el.value
+			}
+		}
+		switch agg.Op {
+		case "avg":
+			head.value /= float64(len(members))
+		case "count":
+			head.value = float64(len(members))
+		}
+		result = append(result, head)
+	}
+	return result
+}
+
+// groupOf возвращает ряд-группу элемента: метки из by и имя, если by его содержит.
+func groupOf(el element, by []string) element {
+	var group element
+	for _, name := range by {
+		if name == storage.NameLabel {
+			group.id = el.id
+			continue
+		}
+		value, ok := el.labels[name]
+		if !ok {
+			continue
+		}
+		if group.labels == nil {
+			group.labels = make(storage.Labels)
+		}
+		group.labels[name] = value
+	}
+	return group
+}
+
+// currentSample возвращает текущее значение ряда как сэмпл. Ряд без времени
+// считается записанным раньше всех сэмплов.
+func currentSample(m storage.Metric) (storage.Sample, bool) {
+	var s storage.Sample
+	if m.Timestamp != nil {
+		s.Timestamp = *m.Timestamp
+	}
+	switch {
+	case m.Value != nil:
+		s.Value = m.Value
+	case m.Delta != nil:
+		s.Delta = m.Delta
+	case m.Histogram != nil:
+		count := int64(m.Histogram.Count)
+		s.Delta = &count
+	case m.Summary != nil:
+		count := int64(m.Summary.Count)
+		s.Delta = &count
+	case m.Set != nil:
+		count := int64(m.Set.Count)
+		s.Delta = &count
+	default:
+		return storage.Sample{}, false
+	}
+	return s, true
+}
+
+func valueOf(s storage.Sample) float64 {
+	if s.Value != nil {
+		return *s.Value
+	}
+	if s.Delta != nil {
+		return float64(*s.Delta)
+	}
+	return math.NaN()
+}
@@ -0,0 +1,161 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sersus/go-yandex-metrics/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ptrFloat64(f float64) *float64 {
+	return &f
+}
+
+func ptrInt64(i int64) *int64 {
+	return &i
+}
+
+var start = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// newStore заполняет хранилище: Alloc на трёх хостах и счётчик PollCount,
+// который каждую минуту растёт на 6 на web-1 и на 12 на web-2.
+func newStore(t *testing.T) *storage.MetricCollection {
+	ctx := context.Background()
+	store := storage.NewMetricCollection()
+	store.SetHistoryLength(100)
+
+	for i, host := range []string{"web-1", "web-2", "db-1"} {
+		ts := start
+		_, err := store.Update(ctx, storage.Metric{ID: "Alloc", MType: storage.Gauge, Labels: storage.Labels{"host": host}, Value: ptrFloat64(float64(10 * (i + 1))), Timestamp: &ts})
+		require.NoError(t, err)
+	}
+	for minute := 0; minute <= 10; minute++ {
+		ts := start.Add(time.Duration(minute) * time.Minute)
+		for host, delta := range map[string]int64{"web-1": 6, "web-2": 12} {
+			_, err := store.Update(ctx, storage.Metric{ID: "PollCount", MType: storage.Counter, Labels: storage.Labels{"host": host}, Delta: ptrInt64(delta), Timestamp: &ts})
+			require.NoError(t, err)
+		}
+	}
+	return store
+}
+
+func values(series []Series) map[string]float64 {
+	result := make(map[string]float64)
+	for _, s := range series {
+		result[s.ID+s.Labels.Key()] = s.Points[len(s.Points)-1].Value
+	}
+	return result
+}
+
+func TestInstant(t *testing.T) {
+	e := New(newStore(t))
+	ctx := context.Background()
+	at := start.Add(10 * time.Minute)
+
+	tests := []struct {
+		name  string
+		query string
+		want  map[string]float64
+	}{
+		{"selector", `Alloc{host=~"web-.*"}`, map[string]float64{`Alloc{host="web-1"}`: 10, `Alloc{host="web-2"}`: 20}},
+		{"name pattern", `*Count{host="web-1"}`, map[string]float64{`PollCount{host="web-1"}`: 66}},
+		{"rate", `rate(PollCount[5m])`, map[string]float64{`PollCount{host="web-1"}`: 0.1, `PollCount{host="web-2"}`: 0.2}},
+		{"increase", `increase(PollCount{host="web-2"}[10m])`, map[string]float64{`PollCount{host="web-2"}`: 108}},
+		{"sum", `sum(Alloc)`, map[string]float64{"": 60}},
+		{"avg by", `avg by (host) (Alloc)`, map[string]float64{`{host="db-1"}`: 30, `{host="web-1"}`: 10, `{host="web-2"}`: 20}},
+		{"max by name", `max by (__name__) (rate(PollCount[5m]))`, map[string]float64{"PollCount": 0.2}},
+		{"count", `count(Alloc)`, map[string]float64{"": 3}},
+		{"max over time", `max_over_time(PollCount{host="web-1"}[2m])`, map[string]float64{`PollCount{host="web-1"}`: 66}},
+		{"avg over time", `avg_over_time(PollCount{host="web-1"}[2m])`, map[string]float64{`PollCount{host="web-1"}`: 63}},
+		{"no match", `Missing`, map[string]float64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			series, err := e.Instant(ctx, tt.query, at)
+			require.NoError(t, err)
+			got := values(series)
+			require.Len(t, got, len(tt.want))
+			for key, want := range tt.want {
+				assert.InDelta(t, want, got[key], 1e-9, key)
+			}
+		})
+	}
+}
+
+func TestInstantTopk(t *testing.T) {
+	e := New(newStore(t))
+	series, err := e.Instant(context.Background(), "topk(2, Alloc)", start)
+	require.NoError(t, err)
+	require.Len(t, series, 2)
+	assert.Equal(t, "db-1", series[0].Labels["host"])
+	assert.Equal(t, "web-2", series[1].Labels["host"])
+}
+
+func TestInstantPast(t *testing.T) {
+	e := New(newStore(t))
+	ctx := context.Background()
+
+	// в прошлом значение берётся из истории
+	series, err := e.Instant(ctx, `PollCount{host="web-1"}`, start.Add(3*time.Minute+30*time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{`PollCount{host="web-1"}`: 24}, values(series))
+
+	// до первого сэмпла ряда ещё нет
+	series, err = e.Instant(ctx, `PollCount`, start.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, series)
+
+	// последнее значение ряда не устаревает
+	series, err = e.Instant(ctx, `Alloc{host="web-1"}`, start.Add(24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{`Alloc{host="web-1"}`: 10}, values(series))
+}
+
+func TestRange(t *testing.T) {
+	e := New(newStore(t))
+	ctx := context.Background()
+
+	series, err := e.Range(ctx, `sum(increase(PollCount[2m]))`, start.Add(2*time.Minute), start.Add(6*time.Minute), 2*time.Minute)
+	require.NoError(t, err)
+	require.Len(t, series, 1)
+	assert.Equal(t, []Point{
+		{Timestamp: start.Add(2 * time.Minute), Value: 18},
+		{Timestamp: start.Add(4 * time.Minute), Value: 18},
+		{Timestamp: start.Add(6 * time.Minute), Value: 18},
+	}, series[0].Points)
+
+	_, err = e.Range(ctx, `Alloc`, start, start.Add(time.Hour), time.Millisecond)
+	assert.ErrorIs(t, err, storage.ErrBadRequest)
+	_, err = e.Range(ctx, `Alloc`, start, start.Add(-time.Hour), time.Second)
+	assert.ErrorIs(t, err, storage.ErrBadRequest)
+}
+
+func TestInstantMaxSeries(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMetricCollection()
+	batch := make([]storage.Metric, 0, maxSeries+1)
+	for i := 0; i <= maxSeries; i++ {
+		batch = append(batch, storage.Metric{ID: "Alloc", MType: storage.Gauge, Labels: storage.Labels{"host": strconv.Itoa(i)}, Value: ptrFloat64(1), Timestamp: &start})
+	}
+	_, err := store.UpdateBatch(ctx, batch)
+	require.NoError(t, err)
+	e := New(store)
+
+	_, err = e.Instant(ctx, `Alloc`, start)
+	assert.ErrorIs(t, err, storage.ErrBadRequest)
+	series, err := e.Instant(ctx, `Alloc{host="1"}`, start)
+	require.NoError(t, err)
+	assert.Len(t, series, 1)
+}
+
+func TestPointMarshalJSON(t *testing.T) {
+	data, err := json.Marshal(Point{Timestamp: start, Value: math.Inf(1)})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"timestamp":"2024-05-01T12:00:00Z","value":"+Inf"}`, string(data))
+}
@@ -0,0 +1,100 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokPunct // ( ) { } [ ] ,
+	tokOp    // = != =~ !~
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of query"
+	}
+	return strconv.Quote(t.value)
+}
+
+// isIdentRune сообщает, может ли символ входить в имя; * — для шаблонов.
+func isIdentRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_:.-*", r)
+}
+
+// lex разбивает запрос на токены; числа и длительности различает парсер.
+func lex(input string) ([]token, error) {
+	var tokens []token
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case strings.ContainsRune("(){}[],", r):
+			tokens = append(tokens, token{kind: tokPunct, value: string(r), pos: i})
+			i++
+		case r == '=' || r == '!':
+			op := string(r)
+			if i+1 < len(runes) && (runes[i+1] == '~' || r == '!' && runes[i+1] == '=') {
+				op += string(runes[i+1])
+			}
+			if op == "!" {
+				return nil, syntaxError(i, "unexpected %q", r)
+			}
+			tokens = append(tokens, token{kind: tokOp, value: op, pos: i})
+			i += len(op)
+		case r == '"':
+			j := i + 1
+			for ; j < len(runes) && runes[j] != '"'; j++ {
+				if runes[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(runes) {
+				return nil, syntaxError(i, "unterminated string")
+			}
+			value, err := strconv.Unquote(string(runes[i : j+1]))
+			if err != nil {
+				return nil, syntaxError(i, "invalid string: %v", err)
+			}
+			tokens = append(tokens, token{kind: tokString, value: value, pos: i})
+			i = j + 1
+		case unicode.IsDigit(r):
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || unicode.IsLetter(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokNumber, value: string(runes[i:j]), pos: i})
+			i = j
+		case isIdentRune(r):
+			j := i
+			for j < len(runes) && isIdentRune(runes[j]) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokIdent, value: string(runes[i:j]), pos: i})
+			i = j
+		default:
+			return nil, syntaxError(i, "unexpected %q", r)
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(runes)}), nil
+}
+
+func syntaxError(pos int, format string, args ...any) error {
+	return badQuery(fmt.Sprintf("at position %d: ", pos+1) + fmt.Sprintf(format, args...))
+}
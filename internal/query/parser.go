@@ -0,0 +1,337 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sersus/go-yandex-metrics/internal/storage"
+)
+
+// Expr — узел разобранного запроса.
+type Expr interface {
+	String() string
+}
+
+// Selector отбирает ряды по имени и меткам. С Range он выбирает сэмплы за
+// окно и может быть только аргументом функции.
+type Selector struct {
+	Matchers []*storage.Matcher
+	Range    time.Duration
+}
+
+// Call — функция над сэмплами окна, например rate(x[5m]).
+type Call struct {
+	Func string
+	Arg  *Selector
+}
+
+// Aggregation сворачивает ряды в группы по меткам By. Param — k у topk.
+type Aggregation struct {
+	Op    string
+	Param int
+	By    []string
+	Expr  Expr
+}
+
+// rangeFuncs — функции над окном сэмплов.
+var rangeFuncs = map[string]bool{
+	"rate":            true,
+	"increase":        true,
+	"avg_over_time":   true,
+	"min_over_time":   true,
+	"max_over_time":   true,
+	"sum_over_time":   true,
+	"count_over_time": true,
+}
+
+// aggregations — операторы агрегации по рядам.
+var aggregations = map[string]bool{
+	"sum":   true,
+	"avg":   true,
+	"min":   true,
+	"max":   true,
+	"count": true,
+	"topk":  true,
+}
+
+func (s *Selector) String() string {
+	matchers := make([]string, 0, len(s.Matchers))
+	for _, m := range s.Matchers {
+		matchers = append(matchers, m.String())
+	}
+	str := "{" + strings.Join(matchers, ",") + "}"
+	if s.Range > 0 {
+		str += "[" + s.Range.String() + "]"
+	}
+	return str
+}
+
+func (c *Call) String() string {
+	return c.Func + "(" + c.Arg.String() + ")"
+}
+
+func (a *Aggregation) String() string {
+	str := a.Op
+	if len(a.By) > 0 {
+		str += " by (" + strings.Join(a.By, ", ") + ")"
+	}
+	if a.Op == "topk" {
+		return str + "(" + strconv.Itoa(a.Param) + ", " + a.Expr.String() + ")"
+	}
+	return str + "(" + a.Expr.String() + ")"
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse разбирает запрос на подмножестве PromQL, например
+// topk(3, max by (host) (rate(cpu_*{host=~"web-.*"}[5m]))).
+func Parse(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, syntaxError(t.pos, "unexpected %s", t)
+	}
+	if sel, ok := expr.(*Selector); ok && sel.Range > 0 {
+		return nil, badQuery("range selector must be an argument of a function")
+	}
+	return expr, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) is(kind tokenKind, value string) bool {
+	t := p.peek()
+	return t.kind == kind && t.value == value
+}
+
+func (p *parser) expect(kind tokenKind, value string) error {
+	if t := p.next(); t.kind != kind || t.value != value {
+		return syntaxError(t.pos, "expected %q, got %s", value, t)
+	}
+	return nil
+}
+
+func (p *parser) parseExpr() (Expr, error) {
+	t := p.peek()
+	if t.kind == tokIdent {
+		after := p.tokens[p.pos+1]
+		call := after.kind == tokPunct && after.value == "("
+		grouped := after.kind == tokIdent && after.value == "by"
+		switch {
+		case aggregations[t.value] && (call || grouped):
+			return p.parseAggregation()
+		case rangeFuncs[t.value] && call:
+			return p.parseCall()
+		case call:
+			return nil, syntaxError(t.pos, "unknown function %q", t.value)
+		}
+	}
+	return p.parseSelector()
+}
+
+func (p *parser) parseAggregation() (Expr, error) {
+	agg := &Aggregation{Op: p.next().value}
+	if p.is(tokIdent, "by") {
+		by, err := p.parseBy()
+		if err != nil {
+			return nil, err
+		}
+		agg.By = by
+	}
+	if err := p.expect(tokPunct, "("); err != nil {
+		return nil, err
+	}
+	if agg.Op == "topk" {
+		t := p.next()
+		k, err := strconv.Atoi(t.value)
+		if t.kind != tokNumber || err != nil || k <= 0 {
+			return nil, syntaxError(t.pos, "topk expects a positive integer, got %s", t)
+		}
+		agg.Param = k
+		if err := p.expect(tokPunct, ","); err != nil {
+			return nil, err
+		}
+	}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if sel, ok := expr.(*Selector); ok && sel.Range > 0 {
+		return nil, badQuery(fmt.Sprintf("%s expects an instant vector, got a range selector", agg.Op))
+	}
+	agg.Expr = expr
+	if err := p.expect(tokPunct, ")"); err != nil {
+		return nil, err
+	}
+	if p.is(tokIdent, "by") {
+		if agg.By != nil {
+			return nil, syntaxError(p.peek().pos, "duplicate by clause")
+		}
+		by, err := p.parseBy()
+		if err != nil {
+			return nil, err
+		}
+		agg.By = by
+	}
+	return agg, nil
+}
+
+// parseBy разбирает by (метка, ...).
+func (p *parser) parseBy() ([]string, error) {
+	p.next()
+	if err := p.expect(tokPunct, "("); err != nil {
+		return nil, err
+	}
+	by := make([]string, 0)
+	for !p.is(tokPunct, ")") {
+		t := p.next()
+		if t.kind != tokIdent {
+			return nil, syntaxError(t.pos, "expected label name, got %s", t)
+		}
+		by = append(by, t.value)
+		if !p.is(tokPunct, ")") {
+			if err := p.expect(tokPunct, ","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	p.next()
+	return by, nil
+}
+
+func (p *parser) parseCall() (Expr, error) {
+	call := &Call{Func: p.next().value}
+	p.next()
+	t := p.peek()
+	expr, err := p.parseSelector()
+	if err != nil {
+		return nil, err
+	}
+	sel := expr.(*Selector)
+	if sel.Range <= 0 {
+		return nil, syntaxError(t.pos, "%s expects a range selector like name[5m]", call.Func)
+	}
+	call.Arg = sel
+	if err := p.expect(tokPunct, ")"); err != nil {
+		return nil, err
+	}
+	return call, nil
+}
+
+func (p *parser) parseSelector() (Expr, error) {
+	sel := &Selector{}
+	if t := p.peek(); t.kind == tokIdent {
+		p.next()
+		matcher, err := nameMatcher(t.value)
+		if err != nil {
+			return nil, syntaxError(t.pos, "%v", err)
+		}
+		sel.Matchers = append(sel.Matchers, matcher)
+	}
+	if p.is(tokPunct, "{") {
+		p.next()
+		for !p.is(tokPunct, "}") {
+			matcher, err := p.parseMatcher()
+			if err != nil {
+				return nil, err
+			}
+			sel.Matchers = append(sel.Matchers, matcher)
+			if !p.is(tokPunct, "}") {
+				if err := p.expect(tokPunct, ","); err != nil {
+					return nil, err
+				}
+			}
+		}
+		p.next()
+	}
+	if len(sel.Matchers) == 0 {
+		t := p.peek()
+		return nil, syntaxError(t.pos, "expected metric name or {matchers}, got %s", t)
+	}
+	if p.is(tokPunct, "[") {
+		p.next()
+		t := p.next()
+		window, err := parseDuration(t.value)
+		if t.kind != tokNumber || err != nil {
+			return nil, syntaxError(t.pos, "invalid range %s", t)
+		}
+		sel.Range = window
+		if err := p.expect(tokPunct, "]"); err != nil {
+			return nil, err
+		}
+	}
+	return sel, nil
+}
+
+func (p *parser) parseMatcher() (*storage.Matcher, error) {
+	name := p.next()
+	if name.kind != tokIdent {
+		return nil, syntaxError(name.pos, "expected label name, got %s", name)
+	}
+	op := p.next()
+	if op.kind != tokOp {
+		return nil, syntaxError(op.pos, "expected matcher operator, got %s", op)
+	}
+	value := p.next()
+	if value.kind != tokString {
+		return nil, syntaxError(value.pos, "expected quoted label value, got %s", value)
+	}
+	matcher, err := storage.NewMatcher(storage.MatchType(op.value), name.value, value.value)
+	if err != nil {
+		return nil, syntaxError(value.pos, "%v", err)
+	}
+	return matcher, nil
+}
+
+// nameMatcher превращает имя ряда в матчер; * в имени — шаблон.
+func nameMatcher(name string) (*storage.Matcher, error) {
+	if !strings.Contains(name, "*") {
+		return storage.NewMatcher(storage.MatchEqual, storage.NameLabel, name)
+	}
+	pattern := strings.ReplaceAll(regexp.QuoteMeta(name), `\*`, ".*")
+	return storage.NewMatcher(storage.MatchRegexp, storage.NameLabel, pattern)
+}
+
+// parseDuration понимает длительности Go и дни вида 7d.
+func parseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// badQuery — ошибка в тексте запроса, клиент получает на неё 400.
+func badQuery(reason string) error {
+	return &storage.ValidationError{Field: "query", Reason: reason, Err: storage.ErrBadRequest}
+}
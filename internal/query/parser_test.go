@@ -0,0 +1,71 @@
+package query
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sersus/go-yandex-metrics/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"name", "Alloc", `{__name__="Alloc"}`},
+		{"name pattern", "cpu_*", `{__name__=~"cpu_.*"}`},
+		{"matchers", `Alloc{host="web-1", dc!~"eu-.*"}`, `{__name__="Alloc",host="web-1",dc!~"eu-.*"}`},
+		{"only matchers", `{__name__=~"Heap.*"}`, `{__name__=~"Heap.*"}`},
+		{"rate", "rate(PollCount[5m])", `rate({__name__="PollCount"}[5m0s])`},
+		{"days", "increase(PollCount[2d])", `increase({__name__="PollCount"}[48h0m0s])`},
+		{"aggregation", "sum by (host) (Alloc)", `sum by (host)({__name__="Alloc"})`},
+		{"trailing by", "avg(Alloc) by (host, dc)", `avg by (host, dc)({__name__="Alloc"})`},
+		{"topk", "topk(3, max_over_time(Alloc[1h]))", `topk(3, max_over_time({__name__="Alloc"}[1h0m0s]))`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := Parse(tt.query)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, expr.String())
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"empty", ""},
+		{"empty matchers", "{}"},
+		{"unknown function", "deriv(Alloc[5m])"},
+		{"rate without range", "rate(Alloc)"},
+		{"bare range", "Alloc[5m]"},
+		{"aggregation of range", "sum(Alloc[5m])"},
+		{"bad range", "rate(Alloc[5x])"},
+		{"unquoted value", "Alloc{host=web}"},
+		{"bad regexp", `Alloc{host=~"("}`},
+		{"topk without k", "topk(Alloc)"},
+		{"unterminated string", `Alloc{host="web}`},
+		{"trailing tokens", "Alloc Alloc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.query)
+			assert.True(t, errors.Is(err, storage.ErrBadRequest), "got %v", err)
+		})
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	d, err := parseDuration("90s")
+	require.NoError(t, err)
+	assert.Equal(t, 90*time.Second, d)
+
+	_, err = parseDuration("0s")
+	assert.Error(t, err)
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/sersus/go-yandex-metrics/internal/middleware"
+	"github.com/sersus/go-yandex-metrics/internal/storage"
+)
+
+// Коды ошибок в ответах API. Код отличает причины, у которых общий HTTP-статус.
+const (
+	codeMalformedJSON    = "malformed_json"
+	codeInvalidValue     = "invalid_value"
+	codeUnknownType      = "unknown_type"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeOutOfOrder       = "out_of_order"
+	codeInternal         = "internal_error"
+)
+
+// apiError — описание ошибки, которое получает клиент.
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// errorResponse — конверт, в котором ошибка отдаётся в JSON.
+type errorResponse struct {
+	Error *apiError `json:"error"`
+}
+
+func malformedJSON(err error) *apiError {
+	return &apiError{Status: http.StatusBadRequest, Code: codeMalformedJSON, Message: err.Error()}
+}
+
+func invalidValue(field, message string) *apiError {
+	return &apiError{Status: http.StatusBadRequest, Code: codeInvalidValue, Message: message, Field: field}
+}
+
+func methodNotAllowed(method string) *apiError {
+	return &apiError{Status: http.StatusMethodNotAllowed, Code: codeMethodNotAllowed, Message: "method " + method + " is not allowed"}
+}
+
+// toAPIError сопоставляет ошибку хранилища с ответом клиенту.
+// Внутренние ошибки не раскрываются, а только пишутся в лог.
+func toAPIError(err error) *apiError {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var field string
+	message := err.Error()
+	var validationErr *storage.ValidationError
+	if errors.As(err, &validationErr) {
+		field = validationErr.Field
+		message = validationErr.Reason
+	}
+
+	switch {
+	case errors.Is(err, storage.ErrBadRequest):
+		return &apiError{Status: http.StatusBadRequest, Code: codeInvalidValue, Message: message, Field: field}
+	case errors.Is(err, storage.ErrNotImplemented):
+		return &apiError{Status: http.StatusNotImplemented, Code: codeUnknownType, Message: message, Field: field}
+	case errors.Is(err, storage.ErrOutOfOrder):
+		return &apiError{Status: http.StatusConflict, Code: codeOutOfOrder, Message: message, Field: field}
+	case errors.Is(err, storage.ErrNotFound):
+		return &apiError{Status: http.StatusNotFound, Code: codeNotFound, Message: "metric not found"}
+	default:
+		middleware.SugarLogger.Errorw(err.Error(), "event", "handle request")
+		return &apiError{Status: http.StatusInternalServerError, Code: codeInternal, Message: "internal server error"}
+	}
+}
+
+func statusFromError(err error) int {
+	return toAPIError(err).Status
+}
+
+// writeError отвечает клиенту ошибкой в JSON или текстом, если клиент просит текст.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr := toAPIError(err)
+	if prefersText(r) {
+		w.Header().Set("content-type", "text/plain; charset=utf-8")
+		w.WriteHeader(apiErr.Status)
+		_, _ = io.WriteString(w, apiErr.Message)
+		return
+	}
+
+	body, err := json.Marshal(errorResponse{Error: apiErr})
+	if err != nil {
+		w.WriteHeader(apiErr.Status)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	_, _ = w.Write(body)
+}
+
+// prefersText сообщает, что в Accept указан текстовый формат и нет JSON.
+func prefersText(r *http.Request) bool {
+	text := false
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			return false
+		case "text/plain", "text/html":
+			text = true
+		}
+	}
+	return text
+}
@@ -5,277 +5,709 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/sersus/go-yandex-metrics/internal/harvester"
+	"github.com/sersus/go-yandex-metrics/internal/prometheus"
+	"github.com/sersus/go-yandex-metrics/internal/query"
 	"github.com/sersus/go-yandex-metrics/internal/storage"
 )
 
+// queryEngine вычисляет запросы GET /query.
+type queryEngine interface {
+	Instant(ctx context.Context, q string, at time.Time) ([]query.Series, error)
+	Range(ctx context.Context, q string, start, end time.Time, step time.Duration) ([]query.Series, error)
+}
+
 type handler struct {
-	dbAddress string
+	storage    storage.Storage
+	queries    queryEngine
+	dbAddress  string
+	prometheus prometheus.Options
 }
 
-func New(db string) *handler {
+func New(store storage.Storage, db string) *handler {
 	return &handler{
+		storage:   store,
+		queries:   query.New(store),
 		dbAddress: db,
 	}
 }
 
+// SetUpDownCounters сообщает, что счётчики могут уменьшаться; /metrics тогда
+// отдаёт их как gauge.
+func (h *handler) SetUpDownCounters(allow bool) {
+	h.prometheus.UpDownCounters = allow
+}
+
 func (h *handler) SaveMetric(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, r, methodNotAllowed(r.Method))
 		return
 	}
 
 	metricType := chi.URLParam(r, "type")
 	metricName := chi.URLParam(r, "name")
 	metricValue := chi.URLParam(r, "value")
-
-	if metricName == "" {
-		w.WriteHeader(http.StatusBadRequest)
+	labels, err := labelsFromQuery(r)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
+
 	metric := storage.Metric{
-		ID:    metricName,
-		MType: metricType,
+		ID:     metricName,
+		MType:  metricType,
+		Labels: labels,
+	}
+	ts, err := timeFromQuery(r, "timestamp")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !ts.IsZero() {
+		metric.Timestamp = &ts
 	}
 	switch metricType {
 	case storage.Counter:
-		v, err := strconv.Atoi(metricValue)
+		v, err := strconv.ParseInt(metricValue, 10, 64)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, r, invalidValue("value", fmt.Sprintf("counter value %q is not an integer", metricValue)))
 			return
 		}
-		metric.Delta = harvester.PtrInt64(int64(v))
-	case storage.Gauge:
+		metric.Delta = harvester.PtrInt64(v)
+	case storage.Gauge, storage.Histogram, storage.Summary:
 		v, err := strconv.ParseFloat(metricValue, 64)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			writeError(w, r, invalidValue("value", fmt.Sprintf("%s value %q is not a number", metricType, metricValue)))
 			return
 		}
 		metric.Value = &v
+	case storage.Set:
+		metric.Members = []string{metricValue}
 	}
-	err := storage.MetricStorage.Collect(metric)
-	if errors.Is(err, storage.ErrBadRequest) {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	if errors.Is(err, storage.ErrNotImplemented) {
-		w.WriteHeader(http.StatusNotImplemented)
+	if _, err := h.storage.Update(r.Context(), metric); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
+	w.Header().Set("content-type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
-	if _, err = io.WriteString(w, fmt.Sprintf("inserted metric %q with value %q", metricName, metricValue)); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	if _, err := io.WriteString(w, fmt.Sprintf("inserted metric %q with value %q", metricName, metricValue)); err != nil {
 		return
 	}
-	w.Header().Set("content-type", "text/plain; charset=utf-8")
-	w.Header().Set("content-length", strconv.Itoa(len(metricName)))
 }
 
 func (h *handler) SaveMetricFromJSON(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, r, methodNotAllowed(r.Method))
 		return
 	}
 	var buf bytes.Buffer
 	if _, err := buf.ReadFrom(r.Body); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, malformedJSON(err))
 		return
 	}
 
 	var metric storage.Metric
 	if err := json.Unmarshal(buf.Bytes(), &metric); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	if metric.ID == "" {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, malformedJSON(err))
 		return
 	}
 
-	err := storage.MetricStorage.Collect(metric)
-	if errors.Is(err, storage.ErrBadRequest) {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	if errors.Is(err, storage.ErrNotImplemented) {
-		w.WriteHeader(http.StatusNotImplemented)
+	result, err := h.storage.Update(r.Context(), metric)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	resultJSON, err := storage.MetricStorage.GetMetricJSON(metric.ID)
-	if errors.Is(err, storage.ErrBadRequest) {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	if errors.Is(err, storage.ErrNotFound) {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-	if errors.Is(err, storage.ErrNotImplemented) {
-		w.WriteHeader(http.StatusNotImplemented)
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	if _, err = w.Write(resultJSON); err != nil {
 		return
 	}
-	w.Header().Set("content-length", strconv.Itoa(len(metric.ID)))
-	w.Header().Set("content-type", "application/json")
-	w.WriteHeader(http.StatusOK)
 }
 
 func (h *handler) SaveListMetricsFromJSON(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeError(w, r, methodNotAllowed(r.Method))
 		return
 	}
 	var buf bytes.Buffer
 	if _, err := buf.ReadFrom(r.Body); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, malformedJSON(err))
 		return
 	}
 
 	var metrics []storage.Metric
 	if err := json.Unmarshal(buf.Bytes(), &metrics); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, malformedJSON(err))
 		return
 	}
 
-	var results []byte
-	for _, metric := range metrics {
-		if metric.ID == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			return
+	// в режиме partial корректные метрики применяются, даже если часть пакета отвергнута
+	partial := r.URL.Query().Get("partial") == "true"
+
+	results := make([]batchResult, len(metrics))
+	valid := make([]storage.Metric, 0, len(metrics))
+	validIdx := make([]int, 0, len(metrics))
+	var batchErr error
+	for i, metric := range metrics {
+		if err := h.storage.Validate(metric); err != nil {
+			apiErr := toAPIError(err)
+			results[i] = batchResult{Metric: metric, Status: apiErr.Status, Error: apiErr}
+			if batchErr == nil {
+				batchErr = err
+			}
+			continue
 		}
+		valid = append(valid, metric)
+		validIdx = append(validIdx, i)
+	}
 
-		err := storage.MetricStorage.Collect(metric)
-		if errors.Is(err, storage.ErrBadRequest) {
-			w.WriteHeader(http.StatusBadRequest)
-			return
+	status := http.StatusOK
+	switch {
+	case batchErr != nil && !partial:
+		// пакет применяется целиком или не применяется вовсе
+		status = statusFromError(batchErr)
+		for _, i := range validIdx {
+			results[i] = batchResult{Metric: metrics[i], Status: http.StatusFailedDependency, Error: errBatchRejected}
 		}
-		if errors.Is(err, storage.ErrNotImplemented) {
-			w.WriteHeader(http.StatusNotImplemented)
-			return
+	case partial:
+		// ошибка применения одной метрики не должна отменять остальные
+		for _, i := range validIdx {
+			updated, err := h.storage.Update(r.Context(), metrics[i])
+			if err != nil {
+				apiErr := toAPIError(err)
+				results[i] = batchResult{Metric: metrics[i], Status: apiErr.Status, Error: apiErr}
+				batchErr = err
+				continue
+			}
+			results[i] = batchResult{Metric: updated, Status: http.StatusOK}
 		}
-
-		resultJSON, err := storage.MetricStorage.GetMetricJSON(metric.ID)
-		if errors.Is(err, storage.ErrBadRequest) {
-			w.WriteHeader(http.StatusBadRequest)
-			return
+		if batchErr != nil {
+			status = http.StatusMultiStatus
 		}
-		if errors.Is(err, storage.ErrNotFound) {
-			w.WriteHeader(http.StatusNotFound)
+	default:
+		updated, err := h.storage.UpdateBatch(r.Context(), valid)
+		if err != nil {
+			writeError(w, r, err)
 			return
 		}
-		if errors.Is(err, storage.ErrNotImplemented) {
-			w.WriteHeader(http.StatusNotImplemented)
-			return
+		for j, i := range validIdx {
+			results[i] = batchResult{Metric: updated[j], Status: http.StatusOK}
 		}
-		results = append(results, resultJSON...)
 	}
-	if _, err := w.Write(results); err != nil {
+
+	resultJSON, err := json.Marshal(results)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 	w.Header().Set("content-type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
+	if _, err := w.Write(resultJSON); err != nil {
+		return
+	}
+}
+
+// batchResult — состояние метрики пакета и её собственный код ответа.
+type batchResult struct {
+	storage.Metric
+	Status int       `json:"status"`
+	Error  *apiError `json:"error,omitempty"`
+}
+
+// MarshalJSON дописывает статус к полям метрики.
+func (r batchResult) MarshalJSON() ([]byte, error) {
+	return marshalWithFields(r.Metric, struct {
+		Status int       `json:"status"`
+		Error  *apiError `json:"error,omitempty"`
+	}{r.Status, r.Error})
+}
+
+// marshalWithFields кодирует метрику и дописывает к её объекту поля extra.
+func marshalWithFields(metric storage.Metric, extra any) ([]byte, error) {
+	metricJSON, err := json.Marshal(metric)
+	if err != nil {
+		return nil, err
+	}
+	extraJSON, err := json.Marshal(extra)
+	if err != nil {
+		return nil, err
+	}
+	if len(extraJSON) <= 2 {
+		return metricJSON, nil
+	}
+	// склеиваем два объекта: {"id":...} и {"status":...}
+	result := append(metricJSON[:len(metricJSON)-1], ',')
+	return append(result, extraJSON[1:]...), nil
+}
+
+// errBatchRejected отмечает корректные метрики пакета, отвергнутого из-за соседних.
+var errBatchRejected = &apiError{
+	Status:  http.StatusFailedDependency,
+	Code:    "batch_rejected",
+	Message: "batch rejected because of other invalid metrics",
 }
 
 func (h *handler) GetMetricFromJSON(w http.ResponseWriter, r *http.Request) {
 	var buf bytes.Buffer
 	if _, err := buf.ReadFrom(r.Body); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, malformedJSON(err))
 		return
 	}
 
 	var metric storage.Metric
 	if err := json.Unmarshal(buf.Bytes(), &metric); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, malformedJSON(err))
 		return
 	}
-
-	resultJSON, err := storage.MetricStorage.GetMetricJSON(metric.ID)
-	if errors.Is(err, storage.ErrBadRequest) {
-		w.WriteHeader(http.StatusBadRequest)
+	// квантили читаются отдельно: Metric разбирает JSON собственным методом
+	var request struct {
+		Quantiles []float64 `json:"quantiles"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &request); err != nil {
+		writeError(w, r, malformedJSON(err))
 		return
 	}
-	if errors.Is(err, storage.ErrNotFound) {
-		w.WriteHeader(http.StatusNotFound)
+	quantiles, err := checkQuantiles(request.Quantiles)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-	if errors.Is(err, storage.ErrNotImplemented) {
-		w.WriteHeader(http.StatusNotImplemented)
+
+	value, err := h.storage.Get(r.Context(), metric.MType, metric.ID, metric.Labels)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	w.Header().Set("content-type", "application/json")
-	if _, err = w.Write(resultJSON); err != nil {
+	var extra struct {
+		Quantiles []storage.Quantile `json:"quantiles,omitempty"`
+	}
+	if value.Summary != nil {
+		extra.Quantiles = value.Summary.Quantiles(quantiles)
+	}
+	resultJSON, err := marshalWithFields(value, extra)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-	w.Header().Set("content-length", strconv.Itoa(len(metric.ID)))
+
 	w.Header().Set("content-type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(resultJSON); err != nil {
+		return
+	}
 }
 
 func (h *handler) GetMetric(w http.ResponseWriter, r *http.Request) {
 	metricType := chi.URLParam(r, "type")
 	metricName := chi.URLParam(r, "name")
 
-	if metricType != storage.Counter && metricType != storage.Gauge {
-		w.WriteHeader(http.StatusBadRequest)
+	if !storage.KnownType(metricType) {
+		writeError(w, r, &apiError{
+			Status:  http.StatusBadRequest,
+			Code:    codeUnknownType,
+			Message: fmt.Sprintf("unknown metric type %q", metricType),
+			Field:   "type",
+		})
 		return
 	}
-	value, err := storage.MetricStorage.GetMetric(metricName)
-	if errors.Is(err, storage.ErrNotFound) {
-		w.WriteHeader(http.StatusNotFound)
+	labels, err := labelsFromQuery(r)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-	if errors.Is(err, storage.ErrNotImplemented) {
-		w.WriteHeader(http.StatusNotImplemented)
+	value, err := h.storage.Get(r.Context(), metricType, metricName, labels)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	var text string
 	switch metricType {
 	case storage.Counter:
-		if _, err = io.WriteString(w, fmt.Sprintf("%d", *value.Delta)); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+		text = fmt.Sprintf("%d", *value.Delta)
 	case storage.Gauge:
-		if _, err = io.WriteString(w, fmt.Sprintf("%g", *value.Value)); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		text = fmt.Sprintf("%g", *value.Value)
+	case storage.Histogram:
+		text = formatHistogram(value.Histogram)
+	case storage.Summary:
+		var quantiles []float64
+		for _, q := range r.URL.Query()["q"] {
+			for _, part := range strings.Split(q, ",") {
+				v, err := strconv.ParseFloat(part, 64)
+				if err != nil {
+					writeError(w, r, invalidValue("q", fmt.Sprintf("quantile %q is not a number", part)))
+					return
+				}
+				quantiles = append(quantiles, v)
+			}
+		}
+		if quantiles, err = checkQuantiles(quantiles); err != nil {
+			writeError(w, r, err)
 			return
 		}
+		text = formatSummary(value.Summary, quantiles)
+	case storage.Set:
+		text = fmt.Sprintf("%d", value.Set.Count)
 	}
 	w.Header().Set("content-type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if _, err = io.WriteString(w, text); err != nil {
+		return
+	}
+}
+
+// formatHistogram выводит число, сумму и накопительные счётчики корзин построчно.
+func formatHistogram(h *storage.HistogramValue) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "count %d\nsum %g\n", h.Count, h.Sum)
+	var cumulative uint64
+	for i, c := range h.Counts {
+		cumulative += c
+		le := "+Inf"
+		if i < len(h.Bounds) {
+			le = strconv.FormatFloat(h.Bounds[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(&b, "le %s %d\n", le, cumulative)
+	}
+	return b.String()
+}
+
+// formatSummary выводит число, сумму, минимум и максимум наблюдений и оценки квантилей.
+func formatSummary(s *storage.SummaryValue, quantiles []float64) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "count %d\nsum %g\nmin %g\nmax %g\n", s.Count, s.Sum, s.Min, s.Max)
+	for _, q := range s.Quantiles(quantiles) {
+		fmt.Fprintf(&b, "quantile %g %g\n", q.Quantile, q.Value)
+	}
+	return b.String()
+}
+
+// checkQuantiles проверяет запрошенные квантили; если их нет, возвращает квантили по умолчанию.
+func checkQuantiles(quantiles []float64) ([]float64, error) {
+	if len(quantiles) == 0 {
+		return storage.DefaultQuantiles, nil
+	}
+	for _, q := range quantiles {
+		if !(q >= 0 && q <= 1) {
+			return nil, invalidValue("quantiles", fmt.Sprintf("quantile %g must be in [0, 1]", q))
+		}
+	}
+	return quantiles, nil
 }
 
 func (h *handler) ShowMetrics(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("content-type", "Content-Type: text/html; charset=utf-8")
 	if r.URL.Path != "/" {
-		http.Error(w, fmt.Sprintf("wrong path %q", r.URL.Path), http.StatusNotFound)
+		writeError(w, r, &apiError{Status: http.StatusNotFound, Code: codeNotFound, Message: fmt.Sprintf("wrong path %q", r.URL.Path)})
+		return
+	}
+	matchers, err := matchersFromQuery(r)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-	page := ""
-	for _, n := range storage.MetricStorage.GetAvailableMetrics() {
-		page += fmt.Sprintf("<h1>	%s</h1>", n)
+	metrics, err := h.storage.List(r.Context(), matchers...)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	names := make([]string, 0, len(metrics))
+	for _, m := range metrics {
+		names = append(names, m.ID+m.Labels.Key())
 	}
 	tmpl, _ := template.New("data").Parse("<h1>AVAILABLE METRICS</h1>{{range .}}<h3>{{ .}}</h3>{{end}}")
-	if err := tmpl.Execute(w, storage.MetricStorage.GetAvailableMetrics()); err != nil {
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	if err := tmpl.Execute(w, names); err != nil {
+		return
+	}
+}
+
+// ListMetrics отдаёт в JSON ряды, подходящие под все матчеры из ?match=.
+func (h *handler) ListMetrics(w http.ResponseWriter, r *http.Request) {
+	matchers, err := matchersFromQuery(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	metrics, err := h.storage.List(r.Context(), matchers...)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if metrics == nil {
+		metrics = []storage.Metric{}
+	}
+	resultJSON, err := json.Marshal(metrics)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(resultJSON); err != nil {
+		return
+	}
+}
+
+// Metrics отдаёт все метрики в текстовом формате Prometheus для опроса.
+func (h *handler) Metrics(w http.ResponseWriter, r *http.Request) {
+	metrics, err := h.storage.List(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := prometheus.WriteText(&buf, metrics, h.prometheus); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("content-type", prometheus.ContentType)
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(buf.Bytes()); err != nil {
+		return
+	}
+}
+
+// historyResponse — общая часть ответа GET /history/{type}/{name}.
+type historyResponse struct {
+	ID         string         `json:"id"`
+	MType      string         `json:"type"`
+	Labels     storage.Labels `json:"labels,omitempty"`
+	Resolution string         `json:"resolution"`
+}
+
+// samplesResponse — история в сырых сэмплах.
+type samplesResponse struct {
+	historyResponse
+	Samples []storage.Sample `json:"samples"`
+}
+
+// bucketsResponse — история в корзинах минутного или часового разрешения.
+type bucketsResponse struct {
+	historyResponse
+	Buckets []storage.Bucket `json:"buckets"`
+}
+
+// GetHistory отдаёт историю ряда за ?from=&to= в разрешении ?resolution=raw|1m|1h|auto.
+func (h *handler) GetHistory(w http.ResponseWriter, r *http.Request) {
+	metricType := chi.URLParam(r, "type")
+	metricName := chi.URLParam(r, "name")
+
+	if !storage.KnownType(metricType) {
+		writeError(w, r, &apiError{
+			Status:  http.StatusBadRequest,
+			Code:    codeUnknownType,
+			Message: fmt.Sprintf("unknown metric type %q", metricType),
+			Field:   "type",
+		})
+		return
+	}
+	labels, err := labelsFromQuery(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	from, err := timeFromQuery(r, "from")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	to, err := timeFromQuery(r, "to")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		writeError(w, r, invalidValue("to", "to must not be before from"))
+		return
+	}
+	resolution := r.URL.Query().Get("resolution")
+	if resolution == "" || resolution == "auto" {
+		resolution = storage.ChooseResolution(from, to, time.Now())
+	}
+
+	head := historyResponse{ID: metricName, MType: metricType, Labels: labels, Resolution: resolution}
+	var response any
+	if resolution == storage.ResolutionRaw {
+		samples, err := h.storage.History(r.Context(), metricType, metricName, labels, from, to)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if samples == nil {
+			samples = []storage.Sample{}
+		}
+		response = samplesResponse{historyResponse: head, Samples: samples}
+	} else {
+		buckets, err := h.storage.Rollups(r.Context(), metricType, metricName, labels, resolution, from, to)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if buckets == nil {
+			buckets = []storage.Bucket{}
+		}
+		response = bucketsResponse{historyResponse: head, Buckets: buckets}
+	}
+	resultJSON, err := json.Marshal(response)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(resultJSON); err != nil {
+		return
+	}
+}
+
+// defaultQueryPoints — сколько точек получает запрос по интервалу без ?step=.
+const defaultQueryPoints = 250
+
+// queryResponse — ответ GET /query.
+type queryResponse struct {
+	Query  string         `json:"query"`
+	Result []query.Series `json:"result"`
+}
+
+// Query вычисляет запрос из ?query=. С ?start= и необязательными ?end= и
+// ?step= запрос вычисляется по интервалу, иначе — в момент ?time= или сейчас.
+func (h *handler) Query(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("query")
+	if strings.TrimSpace(q) == "" {
+		writeError(w, r, invalidValue("query", "query must not be empty"))
+		return
+	}
+	start, err := timeFromQuery(r, "start")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	end, err := timeFromQuery(r, "end")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var result []query.Series
+	if start.IsZero() {
+		if !end.IsZero() {
+			writeError(w, r, invalidValue("start", "start is required when end is set"))
+			return
+		}
+		at, err := timeFromQuery(r, "time")
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if at.IsZero() {
+			at = time.Now().UTC()
+		}
+		result, err = h.queries.Instant(r.Context(), q, at)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	} else {
+		if end.IsZero() {
+			end = time.Now().UTC()
+		}
+		step := end.Sub(start) / defaultQueryPoints
+		if step < time.Second {
+			step = time.Second
+		}
+		if value := r.URL.Query().Get("step"); value != "" {
+			step, err = time.ParseDuration(value)
+			if err != nil {
+				seconds, convErr := strconv.ParseFloat(value, 64)
+				if convErr != nil {
+					writeError(w, r, invalidValue("step", fmt.Sprintf("step %q must be a duration or a number of seconds", value)))
+					return
+				}
+				step = time.Duration(seconds * float64(time.Second))
+			}
+		}
+		result, err = h.queries.Range(r.Context(), q, start, end, step)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	resultJSON, err := json.Marshal(queryResponse{Query: q, Result: result})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(resultJSON); err != nil {
 		return
 	}
-	w.Header().Set("content-type", "Content-Type: text/html; charset=utf-8")
+}
+
+// timeFromQuery читает время RFC 3339 из параметра; без параметра — нулевое.
+func timeFromQuery(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, invalidValue(name, fmt.Sprintf("%s %q is not in RFC 3339 format", name, value))
+	}
+	return t, nil
+}
+
+// labelsFromQuery читает метки URL API из повторяющегося параметра ?label=имя=значение.
+func labelsFromQuery(r *http.Request) (storage.Labels, error) {
+	var labels storage.Labels
+	for _, param := range r.URL.Query()["label"] {
+		name, value, err := storage.ParseLabel(param)
+		if err != nil {
+			return nil, invalidValue("label", err.Error())
+		}
+		if labels == nil {
+			labels = make(storage.Labels)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+// matchersFromQuery читает матчеры из повторяющегося параметра ?match=host="web-1".
+func matchersFromQuery(r *http.Request) ([]*storage.Matcher, error) {
+	var matchers []*storage.Matcher
+	for _, param := range r.URL.Query()["match"] {
+		matcher, err := storage.ParseMatcher(param)
+		if err != nil {
+			return nil, invalidValue("match", err.Error())
+		}
+		matchers = append(matchers, matcher)
+	}
+	return matchers, nil
 }
 
 func (h *handler) Ping(w http.ResponseWriter, r *http.Request) {
@@ -284,14 +716,15 @@ func (h *handler) Ping(w http.ResponseWriter, r *http.Request) {
 
 	db, err := sql.Open("pgx", h.dbAddress)
 	if err != nil {
-		panic(err)
+		writeError(w, r, err)
+		return
 	}
 	defer db.Close()
 	if err := db.PingContext(ctx); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-	} else {
-		w.WriteHeader(http.StatusOK)
+		writeError(w, r, err)
+		return
 	}
+	w.WriteHeader(http.StatusOK)
 	_, err = w.Write([]byte("pong"))
 	if err != nil {
 		return
@@ -1,11 +1,14 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-resty/resty/v2"
@@ -14,9 +17,31 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// withoutTimestamps убирает из JSON-ответа время сэмплов, которое проставил сервер.
+func withoutTimestamps(t *testing.T, body []byte) string {
+	var v any
+	assert.NoError(t, json.Unmarshal(body, &v))
+	var strip func(v any)
+	strip = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			delete(v, "timestamp")
+		case []any:
+			for _, item := range v {
+				strip(item)
+			}
+		}
+	}
+	strip(v)
+	data, err := json.Marshal(v)
+	assert.NoError(t, err)
+	return string(data)
+}
+
 func TestSaveMetric(t *testing.T) {
 	r := chi.NewRouter()
-	h := handler{}
+	store := storage.NewMetricCollection()
+	h := New(store, "")
 	r.Post("/update/{type}/{name}/{value}", h.SaveMetric)
 	r.Get("/value/{type}/{name}", h.GetMetric)
 	r.Post("/update/", h.SaveMetricFromJSON)
@@ -64,7 +89,7 @@ func TestSaveMetric(t *testing.T) {
 			mName:         "Gauge1",
 			mValue:        "12.282",
 			expectedCode:  http.StatusNotImplemented,
-			expectedError: storage.ErrNotImplemented,
+			expectedError: storage.ErrNotFound,
 		},
 		{
 			name:          "case3",
@@ -100,13 +125,15 @@ func TestSaveMetric(t *testing.T) {
 			assert.NoError(t, err, "error making HTTP request")
 			assert.Equal(t, resp.StatusCode(), tt.expectedCode)
 
-			value, err := storage.MetricStorage.GetMetric(tt.mName)
+			value, err := store.GetMetric(tt.mType, tt.mName)
 			if err != nil {
 				assert.EqualError(t, err, tt.expectedError.Error())
 			} else {
 				assert.NoError(t, err)
 			}
 			if tt.expectedCode == http.StatusOK {
+				assert.NotNil(t, value.Timestamp)
+				value.Timestamp = nil
 				assert.Equal(t, value, tt.expectedMetric)
 			}
 		})
@@ -115,7 +142,8 @@ func TestSaveMetric(t *testing.T) {
 
 func TestSaveMetricFromJSON(t *testing.T) {
 	r := chi.NewRouter()
-	h := handler{}
+	store := storage.NewMetricCollection()
+	h := New(store, "")
 	r.Post("/update/{type}/{name}/{value}", h.SaveMetric)
 	r.Get("/value/{type}/{name}", h.GetMetric)
 	r.Post("/update/", h.SaveMetricFromJSON)
@@ -153,7 +181,7 @@ func TestSaveMetricFromJSON(t *testing.T) {
 			mName:         "Gauge1",
 			mValue:        12.282,
 			expectedCode:  http.StatusNotImplemented,
-			expectedError: storage.ErrNotImplemented,
+			expectedError: storage.ErrNotFound,
 		},
 		{
 			name:          "negative (invalid name)",
@@ -164,12 +192,11 @@ func TestSaveMetricFromJSON(t *testing.T) {
 			expectedError: storage.ErrNotFound,
 		},
 		{
-			name:          "negative (invalid gauge value)",
-			mType:         storage.Gauge,
-			mName:         "invalidGauge",
-			mValue:        -1.9,
-			expectedCode:  http.StatusBadRequest,
-			expectedError: storage.ErrNotFound,
+			name:         "positive (negative gauge value)",
+			mType:        storage.Gauge,
+			mName:        "negativeGauge",
+			mValue:       -1.9,
+			expectedCode: http.StatusOK,
 		},
 	}
 	for _, tt := range testCases {
@@ -191,7 +218,7 @@ func TestSaveMetricFromJSON(t *testing.T) {
 			assert.NoError(t, err, "error making HTTP request")
 			assert.Equal(t, resp.StatusCode(), tt.expectedCode)
 
-			value, err := storage.MetricStorage.GetMetricJSON(tt.mName)
+			value, err := store.GetMetricJSON(tt.mType, tt.mName)
 			if err != nil {
 				assert.EqualError(t, err, tt.expectedError.Error())
 			} else {
@@ -199,6 +226,7 @@ func TestSaveMetricFromJSON(t *testing.T) {
 			}
 			actual := storage.Metric{}
 			json.Unmarshal(value, &actual)
+			actual.Timestamp = nil
 
 			expected := storage.Metric{
 				MType: tt.mType,
@@ -215,7 +243,8 @@ func TestSaveMetricFromJSON(t *testing.T) {
 
 func TestGetMetric(t *testing.T) {
 	r := chi.NewRouter()
-	h := handler{}
+	store := storage.NewMetricCollection()
+	h := New(store, "")
 	r.Post("/update/{type}/{name}/{value}", h.SaveMetric)
 	r.Get("/value/{type}/{name}", h.GetMetric)
 	srv := httptest.NewServer(r)
@@ -305,14 +334,17 @@ func TestGetMetric(t *testing.T) {
 
 			assert.NoError(t, err)
 			assert.Equal(t, resp.StatusCode(), tt.expectedCode)
-			assert.Equal(t, string(resp.Body()), tt.mValue)
+			if tt.expectedCode == http.StatusOK {
+				assert.Equal(t, string(resp.Body()), tt.mValue)
+			}
 		})
 	}
 }
 
 func TestGetMetricFromJSON(t *testing.T) {
 	r := chi.NewRouter()
-	h := handler{}
+	store := storage.NewMetricCollection()
+	h := New(store, "")
 	r.Post("/update/{type}/{name}/{value}", h.SaveMetric)
 	r.Post("/value/", h.GetMetricFromJSON)
 	srv := httptest.NewServer(r)
@@ -402,7 +434,8 @@ func TestGetMetricFromJSON(t *testing.T) {
 
 func TestShowMetrics(t *testing.T) {
 	r := chi.NewRouter()
-	h := handler{}
+	store := storage.NewMetricCollection()
+	h := New(store, "")
 	r.Post("/update/{type}/{name}/{value}", h.SaveMetric)
 	r.Get("/", h.ShowMetrics)
 	srv := httptest.NewServer(r)
@@ -447,3 +480,816 @@ func TestShowMetrics(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlersUseInjectedStorage(t *testing.T) {
+	first := storage.NewMetricCollection()
+	second := storage.NewMetricCollection()
+
+	r := chi.NewRouter()
+	h := New(first, "")
+	r.Post("/update/{type}/{name}/{value}", h.SaveMetric)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	resp, err := resty.New().R().Post(fmt.Sprintf("%s/update/counter/Counter1/5", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	_, err = first.GetMetric(storage.Counter, "Counter1")
+	assert.NoError(t, err)
+	_, err = second.GetMetric(storage.Counter, "Counter1")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestSaveListMetricsFromJSON(t *testing.T) {
+	store := storage.NewMetricCollection()
+	r := chi.NewRouter()
+	h := New(store, "")
+	r.Post("/updates/", h.SaveListMetricsFromJSON)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	testCases := []struct {
+		name         string
+		body         []storage.Metric
+		expectedCode int
+		expected     map[string]int64
+	}{
+		{
+			name: "valid batch",
+			body: []storage.Metric{
+				{ID: "Counter1", MType: storage.Counter, Delta: harvester.PtrInt64(2)},
+				{ID: "Counter1", MType: storage.Counter, Delta: harvester.PtrInt64(3)},
+				{ID: "Counter2", MType: storage.Counter, Delta: harvester.PtrInt64(1)},
+			},
+			expectedCode: http.StatusOK,
+			expected:     map[string]int64{"Counter1": 5, "Counter2": 1},
+		},
+		{
+			name: "one invalid metric rejects whole batch",
+			body: []storage.Metric{
+				{ID: "Counter1", MType: storage.Counter, Delta: harvester.PtrInt64(10)},
+				{ID: "Counter3", MType: storage.Counter, Delta: harvester.PtrInt64(1)},
+				{ID: "Gauge1", MType: storage.Gauge},
+			},
+			expectedCode: http.StatusBadRequest,
+			expected:     map[string]int64{"Counter1": 5, "Counter2": 1},
+		},
+		{
+			name: "unknown type rejects whole batch",
+			body: []storage.Metric{
+				{ID: "Counter2", MType: storage.Counter, Delta: harvester.PtrInt64(10)},
+				{ID: "Histogram1", MType: "unknown", Value: harvester.PtrFloat64(1)},
+			},
+			expectedCode: http.StatusNotImplemented,
+			expected:     map[string]int64{"Counter1": 5, "Counter2": 1},
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			resBody, err := json.Marshal(tt.body)
+			assert.NoError(t, err)
+			resp, err := resty.New().R().
+				SetHeader("Content-Type", "application/json").
+				SetBody(resBody).
+				Post(fmt.Sprintf("%s/updates/", srv.URL))
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+
+			metrics := store.Snapshot()
+			assert.Len(t, metrics, len(tt.expected))
+			for _, m := range metrics {
+				assert.Equal(t, tt.expected[m.ID], *m.Delta)
+			}
+		})
+	}
+}
+
+func TestSaveListMetricsFromJSONResponse(t *testing.T) {
+	store := storage.NewMetricCollection()
+	r := chi.NewRouter()
+	h := New(store, "")
+	r.Post("/updates/", h.SaveListMetricsFromJSON)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	type item struct {
+		ID     string    `json:"id"`
+		Delta  *int64    `json:"delta"`
+		Status int       `json:"status"`
+		Error  *apiError `json:"error"`
+	}
+	body := []storage.Metric{
+		{ID: "Counter1", MType: storage.Counter, Delta: harvester.PtrInt64(2)},
+		{ID: "Gauge1", MType: storage.Gauge, Value: harvester.PtrFloat64(1.5)},
+		{ID: "Unknown1", MType: "unknown", Value: harvester.PtrFloat64(1)},
+		{ID: "Counter1", MType: storage.Counter, Delta: harvester.PtrInt64(3)},
+	}
+	resBody, err := json.Marshal(body)
+	assert.NoError(t, err)
+
+	t.Run("atomic by default", func(t *testing.T) {
+		resp, err := resty.New().R().SetBody(resBody).Post(fmt.Sprintf("%s/updates/", srv.URL))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNotImplemented, resp.StatusCode())
+		assert.Equal(t, "application/json", resp.Header().Get("Content-Type"))
+
+		var items []item
+		assert.NoError(t, json.Unmarshal(resp.Body(), &items))
+		assert.Len(t, items, 4)
+		assert.Equal(t, http.StatusFailedDependency, items[0].Status)
+		assert.Equal(t, "batch_rejected", items[0].Error.Code)
+		assert.Equal(t, http.StatusNotImplemented, items[2].Status)
+		assert.Equal(t, codeUnknownType, items[2].Error.Code)
+		assert.Equal(t, "type", items[2].Error.Field)
+		assert.Empty(t, store.Snapshot())
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		resp, err := resty.New().R().SetBody(resBody).Post(fmt.Sprintf("%s/updates/?partial=true", srv.URL))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusMultiStatus, resp.StatusCode())
+
+		var items []item
+		assert.NoError(t, json.Unmarshal(resp.Body(), &items))
+		assert.Len(t, items, 4)
+		assert.Equal(t, http.StatusOK, items[0].Status)
+		assert.Equal(t, int64(2), *items[0].Delta)
+		assert.Equal(t, http.StatusOK, items[1].Status)
+		assert.Equal(t, http.StatusNotImplemented, items[2].Status)
+		assert.Equal(t, int64(5), *items[3].Delta)
+
+		counter, err := store.GetMetric(storage.Counter, "Counter1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(5), *counter.Delta)
+	})
+
+	t.Run("partial with apply errors", func(t *testing.T) {
+		store := storage.NewMetricCollection()
+		store.SetPolicy(storage.Policy{OutOfOrder: storage.OutOfOrderReject})
+		r := chi.NewRouter()
+		h := New(store, "")
+		r.Post("/updates/", h.SaveListMetricsFromJSON)
+		srv := httptest.NewServer(r)
+		defer srv.Close()
+
+		body := `[
+			{"id":"Temp","type":"gauge","value":20,"timestamp":"2024-05-01T12:01:00Z"},
+			{"id":"Temp","type":"gauge","value":19,"timestamp":"2024-05-01T12:00:00Z"},
+			{"id":"Latency","type":"histogram","histogram":{"bounds":[1],"counts":[1,0],"sum":0.5,"count":1}},
+			{"id":"Latency","type":"histogram","histogram":{"bounds":[2],"counts":[1,0],"sum":0.5,"count":1}},
+			{"id":"PollCount","type":"counter","delta":3}
+		]`
+		resp, err := resty.New().R().SetBody(body).Post(fmt.Sprintf("%s/updates/?partial=true", srv.URL))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusMultiStatus, resp.StatusCode())
+
+		var items []item
+		assert.NoError(t, json.Unmarshal(resp.Body(), &items))
+		assert.Len(t, items, 5)
+		assert.Equal(t, http.StatusOK, items[0].Status)
+		assert.Equal(t, http.StatusConflict, items[1].Status)
+		assert.Equal(t, codeOutOfOrder, items[1].Error.Code)
+		assert.Equal(t, http.StatusOK, items[2].Status)
+		assert.Equal(t, http.StatusBadRequest, items[3].Status)
+		assert.Equal(t, http.StatusOK, items[4].Status)
+		assert.Equal(t, int64(3), *items[4].Delta)
+
+		temp, err := store.Get(context.Background(), storage.Gauge, "Temp", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 20.0, *temp.Value)
+	})
+
+	t.Run("valid batch", func(t *testing.T) {
+		resp, err := resty.New().R().SetBody(`[{"id":"Gauge2","type":"gauge","value":2.5}]`).Post(fmt.Sprintf("%s/updates/", srv.URL))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+		assert.JSONEq(t, `[{"id":"Gauge2","type":"gauge","value":2.5,"status":200}]`, withoutTimestamps(t, resp.Body()))
+	})
+
+	t.Run("empty batch", func(t *testing.T) {
+		resp, err := resty.New().R().SetBody(`[]`).Post(fmt.Sprintf("%s/updates/", srv.URL))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+		assert.JSONEq(t, `[]`, string(resp.Body()))
+	})
+}
+
+func TestErrorResponses(t *testing.T) {
+	store := storage.NewMetricCollection()
+	r := chi.NewRouter()
+	h := New(store, "")
+	r.Post("/update/{type}/{name}/{value}", h.SaveMetric)
+	r.Get("/value/{type}/{name}", h.GetMetric)
+	r.Post("/update/", h.SaveMetricFromJSON)
+	r.Post("/value/", h.GetMetricFromJSON)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	testCases := []struct {
+		name         string
+		method       string
+		path         string
+		body         string
+		expectedCode int
+		expected     apiError
+	}{
+		{
+			name:         "unknown type in path",
+			method:       http.MethodPost,
+			path:         "/update/unknown/Metric1/1",
+			expectedCode: http.StatusNotImplemented,
+			expected:     apiError{Code: codeUnknownType, Field: "type"},
+		},
+		{
+			name:         "not a number in path",
+			method:       http.MethodPost,
+			path:         "/update/counter/Counter1/1.5",
+			expectedCode: http.StatusBadRequest,
+			expected:     apiError{Code: codeInvalidValue, Field: "value"},
+		},
+		{
+			name:         "negative delta",
+			method:       http.MethodPost,
+			path:         "/update/",
+			body:         `{"id":"Counter1","type":"counter","delta":-1}`,
+			expectedCode: http.StatusBadRequest,
+			expected:     apiError{Code: codeInvalidValue, Field: "delta"},
+		},
+		{
+			name:         "missing name",
+			method:       http.MethodPost,
+			path:         "/update/",
+			body:         `{"type":"counter","delta":1}`,
+			expectedCode: http.StatusBadRequest,
+			expected:     apiError{Code: codeInvalidValue, Field: "id"},
+		},
+		{
+			name:         "malformed json",
+			method:       http.MethodPost,
+			path:         "/update/",
+			body:         `{"id":`,
+			expectedCode: http.StatusBadRequest,
+			expected:     apiError{Code: codeMalformedJSON},
+		},
+		{
+			name:         "unknown metric",
+			method:       http.MethodPost,
+			path:         "/value/",
+			body:         `{"id":"Gauge2","type":"gauge"}`,
+			expectedCode: http.StatusNotFound,
+			expected:     apiError{Code: codeNotFound},
+		},
+		{
+			name:         "unknown metric in path",
+			method:       http.MethodGet,
+			path:         "/value/gauge/Gauge2",
+			expectedCode: http.StatusNotFound,
+			expected:     apiError{Code: codeNotFound},
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().
+				SetBody(tt.body).
+				Execute(tt.method, srv.URL+tt.path)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+			assert.Equal(t, "application/json", resp.Header().Get("Content-Type"))
+
+			var body errorResponse
+			assert.NoError(t, json.Unmarshal(resp.Body(), &body))
+			if assert.NotNil(t, body.Error) {
+				assert.Equal(t, tt.expected.Code, body.Error.Code)
+				assert.Equal(t, tt.expected.Field, body.Error.Field)
+				assert.NotEmpty(t, body.Error.Message)
+			}
+		})
+	}
+}
+
+func TestNonFiniteGauges(t *testing.T) {
+	testCases := []struct {
+		name         string
+		policy       storage.Policy
+		expectedCode int
+	}{
+		{
+			name:         "rejected by default",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "allowed by policy",
+			policy:       storage.Policy{AllowNonFinite: true},
+			expectedCode: http.StatusOK,
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			store := storage.NewMetricCollection()
+			store.SetPolicy(tt.policy)
+			r := chi.NewRouter()
+			h := New(store, "")
+			r.Post("/update/{type}/{name}/{value}", h.SaveMetric)
+			r.Post("/update/", h.SaveMetricFromJSON)
+			r.Post("/value/", h.GetMetricFromJSON)
+			srv := httptest.NewServer(r)
+			defer srv.Close()
+
+			resp, err := resty.New().R().Post(fmt.Sprintf("%s/update/gauge/Gauge1/-Inf", srv.URL))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+
+			resp, err = resty.New().R().
+				SetBody(`{"id":"Gauge2","type":"gauge","value":"NaN"}`).
+				Post(fmt.Sprintf("%s/update/", srv.URL))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, resp.StatusCode())
+
+			if tt.expectedCode != http.StatusOK {
+				return
+			}
+			resp, err = resty.New().R().
+				SetBody(`{"id":"Gauge1","type":"gauge"}`).
+				Post(fmt.Sprintf("%s/value/", srv.URL))
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode())
+			assert.JSONEq(t, `{"id":"Gauge1","type":"gauge","value":"-Inf"}`, withoutTimestamps(t, resp.Body()))
+		})
+	}
+}
+
+func TestNegativeCounterDelta(t *testing.T) {
+	store := storage.NewMetricCollection()
+	r := chi.NewRouter()
+	h := New(store, "")
+	r.Post("/update/{type}/{name}/{value}", h.SaveMetric)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	resp, err := resty.New().R().Post(fmt.Sprintf("%s/update/counter/Counter1/-3", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+
+	store.SetPolicy(storage.Policy{AllowNegativeDelta: true})
+	for _, delta := range []string{"5", "-3", "-4"} {
+		resp, err = resty.New().R().Post(fmt.Sprintf("%s/update/counter/Counter1/%s", srv.URL, delta))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+	}
+	counter, err := store.GetMetric(storage.Counter, "Counter1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-2), *counter.Delta)
+}
+
+func TestHistogram(t *testing.T) {
+	store := storage.NewMetricCollection()
+	store.SetPolicy(storage.Policy{HistogramBounds: []float64{0.1, 1}})
+	r := chi.NewRouter()
+	h := New(store, "")
+	r.Post("/update/{type}/{name}/{value}", h.SaveMetric)
+	r.Get("/value/{type}/{name}", h.GetMetric)
+	r.Post("/update/", h.SaveMetricFromJSON)
+	r.Post("/updates/", h.SaveListMetricsFromJSON)
+	r.Post("/value/", h.GetMetricFromJSON)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// наблюдения через URL попадают в корзины по умолчанию
+	for _, v := range []string{"0.0625", "0.5", "3"} {
+		resp, err := resty.New().R().Post(fmt.Sprintf("%s/update/histogram/Latency/%s", srv.URL, v))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+	}
+
+	// гистограммы от разных агентов складываются
+	resp, err := resty.New().R().
+		SetBody(`{"id":"Latency","type":"histogram","histogram":{"bounds":[0.1,1],"counts":[1,0,1],"sum":2.0625,"count":2}}`).
+		Post(fmt.Sprintf("%s/update/", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	resp, err = resty.New().R().
+		SetBody(`[{"id":"Latency","type":"histogram","histogram":{"bounds":[0.1,1],"counts":[0,2,0],"sum":1,"count":2}},{"id":"Latency","type":"histogram","value":0.03125}]`).
+		Post(fmt.Sprintf("%s/updates/", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetBody(`{"id":"Latency","type":"histogram"}`).
+		Post(fmt.Sprintf("%s/value/", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.JSONEq(t, `{"id":"Latency","type":"histogram","histogram":{"bounds":[0.1,1],"counts":[3,3,2],"sum":6.65625,"count":8}}`, withoutTimestamps(t, resp.Body()))
+
+	resp, err = resty.New().R().Get(fmt.Sprintf("%s/value/histogram/Latency", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, "count 8\nsum 6.65625\nle 0.1 3\nle 1 6\nle +Inf 8\n", string(resp.Body()))
+
+	t.Run("different bounds", func(t *testing.T) {
+		resp, err := resty.New().R().
+			SetBody(`{"id":"Latency","type":"histogram","histogram":{"bounds":[1,2],"counts":[1,0,0],"sum":0.5,"count":1}}`).
+			Post(fmt.Sprintf("%s/update/", srv.URL))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+		assert.Contains(t, string(resp.Body()), `"field":"histogram.bounds"`)
+	})
+
+	t.Run("inconsistent count", func(t *testing.T) {
+		resp, err := resty.New().R().
+			SetBody(`{"id":"Latency2","type":"histogram","histogram":{"bounds":[1],"counts":[1,1],"sum":3,"count":5}}`).
+			Post(fmt.Sprintf("%s/update/", srv.URL))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+		assert.Contains(t, string(resp.Body()), `"field":"histogram.count"`)
+	})
+}
+
+func TestSummary(t *testing.T) {
+	store := storage.NewMetricCollection()
+	r := chi.NewRouter()
+	h := New(store, "")
+	r.Post("/update/{type}/{name}/{value}", h.SaveMetric)
+	r.Get("/value/{type}/{name}", h.GetMetric)
+	r.Post("/value/", h.GetMetricFromJSON)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for i := 1; i <= 100; i++ {
+		resp, err := resty.New().R().Post(fmt.Sprintf("%s/update/summary/Latency/%d", srv.URL, i))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+	}
+
+	resp, err := resty.New().R().
+		SetBody(`{"id":"Latency","type":"summary","quantiles":[0.5,0.99]}`).
+		Post(fmt.Sprintf("%s/value/", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	var metric storage.Metric
+	assert.NoError(t, json.Unmarshal(resp.Body(), &metric))
+	if assert.NotNil(t, metric.Summary) {
+		assert.Equal(t, uint64(100), metric.Summary.Count)
+	}
+	var quantiles struct {
+		Quantiles []storage.Quantile `json:"quantiles"`
+	}
+	assert.NoError(t, json.Unmarshal(resp.Body(), &quantiles))
+	if assert.Len(t, quantiles.Quantiles, 2) {
+		assert.InEpsilon(t, 50, quantiles.Quantiles[0].Value, 0.02)
+		assert.InEpsilon(t, 99, quantiles.Quantiles[1].Value, 0.02)
+	}
+
+	resp, err = resty.New().R().Get(fmt.Sprintf("%s/value/summary/Latency?q=0.5", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Contains(t, string(resp.Body()), "count 100\nsum 5050\nmin 1\nmax 100\nquantile 0.5 ")
+
+	resp, err = resty.New().R().Get(fmt.Sprintf("%s/value/summary/Latency?q=1.5", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+}
+
+func TestSet(t *testing.T) {
+	store := storage.NewMetricCollection()
+	r := chi.NewRouter()
+	h := New(store, "")
+	r.Post("/update/{type}/{name}/{value}", h.SaveMetric)
+	r.Get("/value/{type}/{name}", h.GetMetric)
+	r.Post("/updates/", h.SaveListMetricsFromJSON)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for _, host := range []string{"web-1", "web-2", "web-1"} {
+		resp, err := resty.New().R().Post(fmt.Sprintf("%s/update/set/Hosts/%s", srv.URL, host))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+	}
+
+	// скетч с другого агента объединяется с сохранённым
+	agent := storage.NewSet(storage.DefaultSetPrecision)
+	agent.Add("web-2", "web-3")
+	body, err := json.Marshal([]storage.Metric{{ID: "Hosts", MType: storage.Set, Set: agent}})
+	assert.NoError(t, err)
+	resp, err := resty.New().R().SetBody(body).Post(fmt.Sprintf("%s/updates/", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	resp, err = resty.New().R().Get(fmt.Sprintf("%s/value/set/Hosts", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, "3", string(resp.Body()))
+}
+
+func TestErrorResponsesForTextClients(t *testing.T) {
+	store := storage.NewMetricCollection()
+	r := chi.NewRouter()
+	h := New(store, "")
+	r.Post("/update/{type}/{name}/{value}", h.SaveMetric)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	resp, err := resty.New().R().
+		SetHeader("Accept", "text/plain").
+		Post(fmt.Sprintf("%s/update/gauge/Gauge1/abc", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header().Get("Content-Type"))
+	assert.Equal(t, `gauge value "abc" is not a number`, string(resp.Body()))
+
+	resp, err = resty.New().R().
+		SetHeader("Accept", "text/plain, application/json").
+		Post(fmt.Sprintf("%s/update/gauge/Gauge1/abc", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, "application/json", resp.Header().Get("Content-Type"))
+}
+
+func TestLabels(t *testing.T) {
+	store := storage.NewMetricCollection()
+	r := chi.NewRouter()
+	h := New(store, "")
+	r.Post("/update/", h.SaveMetricFromJSON)
+	r.Post("/value/", h.GetMetricFromJSON)
+	r.Post("/update/{type}/{name}/{value}", h.SaveMetric)
+	r.Get("/value/{type}/{name}", h.GetMetric)
+	r.Get("/values/", h.ListMetrics)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for host, value := range map[string]string{"web-1": "1.5", "web-2": "2.5"} {
+		resp, err := resty.New().R().
+			SetQueryParamsFromValues(url.Values{"label": {"host=" + host, "region=eu"}}).
+			Post(fmt.Sprintf("%s/update/gauge/Alloc/%s", srv.URL, value))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+	}
+	resp, err := resty.New().R().
+		SetBody(`{"id":"Alloc","type":"gauge","value":3.5,"labels":{"host":"web-3","region":"us"}}`).
+		Post(fmt.Sprintf("%s/update/", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	t.Run("GetByLabels", func(t *testing.T) {
+		resp, err := resty.New().R().
+			SetQueryParamsFromValues(url.Values{"label": {"region=eu", "host=web-2"}}).
+			Get(fmt.Sprintf("%s/value/gauge/Alloc", srv.URL))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+		assert.Equal(t, "2.5", string(resp.Body()))
+
+		resp, err = resty.New().R().
+			SetBody(`{"id":"Alloc","type":"gauge","labels":{"host":"web-3","region":"us"}}`).
+			Post(fmt.Sprintf("%s/value/", srv.URL))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+		assert.JSONEq(t, `{"id":"Alloc","type":"gauge","value":3.5,"labels":{"host":"web-3","region":"us"}}`, withoutTimestamps(t, resp.Body()))
+
+		resp, err = resty.New().R().Get(fmt.Sprintf("%s/value/gauge/Alloc", srv.URL))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode())
+	})
+
+	t.Run("InvalidLabels", func(t *testing.T) {
+		resp, err := resty.New().R().
+			SetQueryParam("label", "host").
+			Post(fmt.Sprintf("%s/update/gauge/Alloc/1", srv.URL))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+
+		resp, err = resty.New().R().
+			SetQueryParam("label", "__host=web-1").
+			Post(fmt.Sprintf("%s/update/gauge/Alloc/1", srv.URL))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+		assert.Contains(t, string(resp.Body()), `"field":"labels"`)
+	})
+
+	t.Run("ListByMatchers", func(t *testing.T) {
+		tests := []struct {
+			match []string
+			want  int
+			code  int
+		}{
+			{nil, 3, http.StatusOK},
+			{[]string{`region="eu"`}, 2, http.StatusOK},
+			{[]string{`region="eu"`, `host!="web-1"`}, 1, http.StatusOK},
+			{[]string{`host=~"web-[13]"`}, 2, http.StatusOK},
+			{[]string{`host=~"("`}, 0, http.StatusBadRequest},
+		}
+		for _, tt := range tests {
+			resp, err := resty.New().R().
+				SetQueryParamsFromValues(url.Values{"match": tt.match}).
+				Get(fmt.Sprintf("%s/values/", srv.URL))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.code, resp.StatusCode())
+			if tt.code != http.StatusOK {
+				continue
+			}
+			var metrics []storage.Metric
+			assert.NoError(t, json.Unmarshal(resp.Body(), &metrics))
+			assert.Len(t, metrics, tt.want, tt.match)
+		}
+	})
+}
+
+func TestOutOfOrderSamples(t *testing.T) {
+	store := storage.NewMetricCollection()
+	store.SetPolicy(storage.Policy{OutOfOrder: storage.OutOfOrderReject})
+	r := chi.NewRouter()
+	h := New(store, "")
+	r.Post("/update/", h.SaveMetricFromJSON)
+	r.Post("/update/{type}/{name}/{value}", h.SaveMetric)
+	r.Get("/value/{type}/{name}", h.GetMetric)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	resp, err := resty.New().R().
+		SetBody(`{"id":"Temp","type":"gauge","value":21.5,"timestamp":"2024-05-01T12:00:00Z"}`).
+		Post(fmt.Sprintf("%s/update/", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.JSONEq(t, `{"id":"Temp","type":"gauge","value":21.5,"timestamp":"2024-05-01T12:00:00Z"}`, string(resp.Body()))
+
+	resp, err = resty.New().R().
+		SetQueryParam("timestamp", "2024-05-01T11:00:00Z").
+		Post(fmt.Sprintf("%s/update/gauge/Temp/19", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode())
+	assert.Contains(t, string(resp.Body()), `"code":"out_of_order"`)
+
+	resp, err = resty.New().R().
+		SetQueryParam("timestamp", "yesterday").
+		Post(fmt.Sprintf("%s/update/gauge/Temp/19", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode())
+
+	resp, err = resty.New().R().
+		SetQueryParam("timestamp", "2024-05-01T13:00:00Z").
+		Post(fmt.Sprintf("%s/update/gauge/Temp/23", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+
+	resp, err = resty.New().R().Get(fmt.Sprintf("%s/value/gauge/Temp", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, "23", string(resp.Body()))
+}
+
+func TestHistory(t *testing.T) {
+	store := storage.NewMetricCollection()
+	store.SetHistoryLength(100)
+	r := chi.NewRouter()
+	h := New(store, "")
+	r.Post("/update/{type}/{name}/{value}", h.SaveMetric)
+	r.Get("/history/{type}/{name}", h.GetHistory)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for i, ts := range []string{"2024-05-01T12:00:00Z", "2024-05-01T12:01:00Z", "2024-05-01T12:02:00Z"} {
+		resp, err := resty.New().R().
+			SetQueryParamsFromValues(url.Values{"timestamp": {ts}, "label": {"host=web-1"}}).
+			Post(fmt.Sprintf("%s/update/gauge/Temp/%d", srv.URL, 20+i))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+	}
+
+	resp, err := resty.New().R().
+		SetQueryParamsFromValues(url.Values{"label": {"host=web-1"}, "from": {"2024-05-01T12:01:00Z"}, "resolution": {"raw"}}).
+		Get(fmt.Sprintf("%s/history/gauge/Temp", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.JSONEq(t, `{"id":"Temp","type":"gauge","labels":{"host":"web-1"},"resolution":"raw","samples":[
+		{"timestamp":"2024-05-01T12:01:00Z","value":21},
+		{"timestamp":"2024-05-01T12:02:00Z","value":22}
+	]}`, string(resp.Body()))
+
+	// за шесть часов интервала выбираются минутные корзины
+	assert.NoError(t, store.Rollup(context.Background(), time.Now(), nil))
+	resp, err = resty.New().R().
+		SetQueryParamsFromValues(url.Values{"label": {"host=web-1"}, "from": {"2024-05-01T12:00:00Z"}, "to": {"2024-05-01T18:00:00Z"}}).
+		Get(fmt.Sprintf("%s/history/gauge/Temp", srv.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.JSONEq(t, `{"id":"Temp","type":"gauge","labels":{"host":"web-1"},"resolution":"1m","buckets":[
+		{"start":"2024-05-01T12:00:00Z","count":1,"min":20,"max":20,"avg":20,"last":20},
+		{"start":"2024-05-01T12:01:00Z","count":1,"min":21,"max":21,"avg":21,"last":21},
+		{"start":"2024-05-01T12:02:00Z","count":1,"min":22,"max":22,"avg":22,"last":22}
+	]}`, string(resp.Body()))
+
+	tests := []struct {
+		name   string
+		path   string
+		params url.Values
+		code   int
+	}{
+		{"unknown series", "/history/gauge/Temp", nil, http.StatusNotFound},
+		{"unknown type", "/history/unknown/Temp", nil, http.StatusBadRequest},
+		{"bad from", "/history/gauge/Temp", url.Values{"label": {"host=web-1"}, "from": {"noon"}}, http.StatusBadRequest},
+		{"to before from", "/history/gauge/Temp", url.Values{"label": {"host=web-1"}, "from": {"2024-05-01T12:01:00Z"}, "to": {"2024-05-01T12:00:00Z"}}, http.StatusBadRequest},
+		{"unknown resolution", "/history/gauge/Temp", url.Values{"label": {"host=web-1"}, "resolution": {"5m"}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().SetQueryParamsFromValues(tt.params).Get(srv.URL + tt.path)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.code, resp.StatusCode())
+		})
+	}
+}
+
+func TestQuery(t *testing.T) {
+	store := storage.NewMetricCollection()
+	store.SetHistoryLength(100)
+	r := chi.NewRouter()
+	h := New(store, "")
+	r.Post("/update/{type}/{name}/{value}", h.SaveMetric)
+	r.Get("/query", h.Query)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for i, ts := range []string{"2024-05-01T12:00:00Z", "2024-05-01T12:01:00Z", "2024-05-01T12:02:00Z"} {
+		for _, host := range []string{"web-1", "web-2"} {
+			resp, err := resty.New().R().
+				SetQueryParamsFromValues(url.Values{"timestamp": {ts}, "label": {"host=" + host}}).
+				Post(fmt.Sprintf("%s/update/gauge/Temp/%d", srv.URL, 20+i))
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode())
+		}
+	}
+
+	resp, err := resty.New().R().
+		SetQueryParamsFromValues(url.Values{"query": {`max(Temp{host=~"web-.*"})`}, "time": {"2024-05-01T12:01:30Z"}}).
+		Get(srv.URL + "/query")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.JSONEq(t, `{"query":"max(Temp{host=~\"web-.*\"})","result":[
+		{"points":[{"timestamp":"2024-05-01T12:01:30Z","value":21}]}
+	]}`, string(resp.Body()))
+
+	resp, err = resty.New().R().
+		SetQueryParamsFromValues(url.Values{
+			"query": {`Temp{host="web-1"}`},
+			"start": {"2024-05-01T12:00:00Z"},
+			"end":   {"2024-05-01T12:02:00Z"},
+			"step":  {"60"},
+		}).
+		Get(srv.URL + "/query")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.JSONEq(t, `{"query":"Temp{host=\"web-1\"}","result":[
+		{"id":"Temp","type":"gauge","labels":{"host":"web-1"},"points":[
+			{"timestamp":"2024-05-01T12:00:00Z","value":20},
+			{"timestamp":"2024-05-01T12:01:00Z","value":21},
+			{"timestamp":"2024-05-01T12:02:00Z","value":22}
+		]}
+	]}`, string(resp.Body()))
+
+	tests := []struct {
+		name   string
+		params url.Values
+		code   int
+	}{
+		{"empty query", nil, http.StatusBadRequest},
+		{"syntax error", url.Values{"query": {"sum(Temp"}}, http.StatusBadRequest},
+		{"end without start", url.Values{"query": {"Temp"}, "end": {"2024-05-01T12:00:00Z"}}, http.StatusBadRequest},
+		{"bad step", url.Values{"query": {"Temp"}, "start": {"2024-05-01T12:00:00Z"}, "step": {"often"}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := resty.New().R().SetQueryParamsFromValues(tt.params).Get(srv.URL + "/query")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.code, resp.StatusCode())
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	store := storage.NewMetricCollection()
+	r := chi.NewRouter()
+	h := New(store, "")
+	r.Post("/update/{type}/{name}/{value}", h.SaveMetric)
+	r.Get("/metrics", h.Metrics)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for _, path := range []string{"/update/counter/PollCount/5", "/update/gauge/Heap.Alloc/1.5"} {
+		resp, err := resty.New().R().SetQueryParam("label", "host=web-1").Post(srv.URL + path)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode())
+	}
+
+	resp, err := resty.New().R().Get(srv.URL + "/metrics")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header().Get("content-type"))
+	assert.Equal(t, `# TYPE Heap_Alloc gauge
+Heap_Alloc{host="web-1"} 1.5
+# TYPE PollCount counter
+PollCount{host="web-1"} 5
+`, string(resp.Body()))
+	// уменьшающийся счётчик не может быть counter в Prometheus
+	h.SetUpDownCounters(true)
+	resp, err = resty.New().R().Get(srv.URL + "/metrics")
+	assert.NoError(t, err)
+	assert.Contains(t, string(resp.Body()), "# TYPE PollCount gauge\n")
+}
@@ -5,10 +5,12 @@ import (
 	"github.com/sersus/go-yandex-metrics/internal/config"
 	"github.com/sersus/go-yandex-metrics/internal/middleware"
 	"github.com/sersus/go-yandex-metrics/internal/router/handlers"
+	"github.com/sersus/go-yandex-metrics/internal/storage"
 )
 
-func New(params config.Options) *chi.Mux {
-	handler := handlers.New(params.DatabaseAddress)
+func New(params config.Options, store storage.Storage) *chi.Mux {
+	handler := handlers.New(store, params.DatabaseAddress)
+	handler.SetUpDownCounters(params.AllowNegativeDelta)
 
 	r := chi.NewRouter()
 	r.Use(middleware.RequestLogger)
@@ -17,6 +19,10 @@ func New(params config.Options) *chi.Mux {
 	r.Post("/value/", handler.GetMetricFromJSON)
 	r.Post("/update/{type}/{name}/{value}", handler.SaveMetric)
 	r.Get("/value/{type}/{name}", handler.GetMetric)
+	r.Get("/values/", handler.ListMetrics)
+	r.Get("/history/{type}/{name}", handler.GetHistory)
+	r.Get("/query", handler.Query)
+	r.Get("/metrics", handler.Metrics)
 	r.Get("/", handler.ShowMetrics)
 	r.Get("/ping", handler.Ping)
 	r.Post("/updates/", handler.SaveListMetricsFromJSON)
@@ -1,81 +1,454 @@
 package storage
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"time"
 )
 
 var (
 	ErrBadRequest     = errors.New("bad request")
 	ErrNotImplemented = errors.New("not implemented")
 	ErrNotFound       = errors.New("not found")
+	ErrOutOfOrder     = errors.New("out of order")
 )
 
-var MetricStorage = MetricCollection{
-	Metrics: make([]Metric, 0),
+var _ Storage = (*MetricCollection)(nil)
+
+func NewMetricCollection(metrics ...Metric) *MetricCollection {
+	mc := &MetricCollection{
+		metrics: make([]Metric, 0, len(metrics)),
+		index:   make(map[metricKey]int, len(metrics)),
+	}
+	for _, m := range metrics {
+		mc.upsert(m)
+	}
+	return mc
 }
 
 func (mc *MetricCollection) Collect(metric Metric) error {
-	if (metric.Delta != nil && *metric.Delta < 0) || (metric.Value != nil && *metric.Value < 0) {
-		return ErrBadRequest
+	if err := mc.Validate(metric); err != nil {
+		return err
 	}
-	switch metric.MType {
-	case Counter:
-		v, err := mc.GetMetric(metric.ID)
-		if err != nil {
-			if !errors.Is(err, ErrNotFound) {
-				return err
-			}
-		}
-		if v.Delta != nil {
-			*metric.Delta += *v.Delta
-		}
-		mc.UpsertMetric(metric)
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	_, err := mc.collect(metric)
+	return err
+}
+
+// ValidationError уточняет, какое поле метрики не прошло проверку.
+// Err — одна из ошибок ErrBadRequest, ErrNotImplemented или ErrOutOfOrder.
+type ValidationError struct {
+	Field  string
+	Reason string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Reason)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// SetPolicy задаёт, какие значения принимает коллекция.
+func (mc *MetricCollection) SetPolicy(policy Policy) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.policy = policy
+}
 
-	case Gauge:
-		mc.UpsertMetric(metric)
-	default:
-		return ErrNotImplemented
+// Journal записывает изменения коллекции до того, как они применены: новые
+// состояния метрик или, если deleted, удаляемые ряды. Ошибка отменяет изменение.
+type Journal func(metrics []Metric, deleted bool) error
+
+// SetJournal задаёт журнал изменений. Журнал вызывается под блокировкой коллекции.
+func (mc *MetricCollection) SetJournal(journal Journal) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.journal = journal
+}
+
+// write передаёт изменения журналу, если он задан. Вызывается только под mc.mu.
+func (mc *MetricCollection) write(metrics []Metric, deleted bool) error {
+	if mc.journal == nil {
+		return nil
+	}
+	return mc.journal(metrics, deleted)
+}
+
+// SetHistoryLength задаёт, сколько последних сэмплов хранить для каждого ряда.
+// Вызывается до начала работы с коллекцией; 0 отключает историю.
+func (mc *MetricCollection) SetHistoryLength(length int) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.historyLength = length
+}
+
+// Validate проверяет метрику по политике коллекции.
+func (mc *MetricCollection) Validate(metric Metric) error {
+	mc.mu.RLock()
+	policy := mc.policy
+	mc.mu.RUnlock()
+	return policy.Validate(metric)
+}
+
+// collect вызывается только под mc.mu для уже проверенной метрики.
+func (mc *MetricCollection) collect(metric Metric) (Metric, error) {
+	result, err := mc.policy.Apply(mc.stored(keyOf(metric)), metric)
+	if err != nil {
+		return Metric{}, err
+	}
+	if err := mc.write([]Metric{result}, false); err != nil {
+		return Metric{}, err
+	}
+	mc.record(result)
+	return mc.upsert(result), nil
+}
+
+// stored возвращает сохранённую метрику или nil. Вызывается только под mc.mu.
+func (mc *MetricCollection) stored(key metricKey) *Metric {
+	if i, ok := mc.index[key]; ok {
+		return &mc.metrics[i]
 	}
 	return nil
 }
 
-func (mc *MetricCollection) GetMetric(metricName string) (Metric, error) {
-	for _, m := range mc.Metrics {
-		if m.ID == metricName {
-			return m, nil
-		}
+// GetMetric возвращает ряд без меток.
+func (mc *MetricCollection) GetMetric(metricType, metricName string) (Metric, error) {
+	return mc.getSeries(metricKey{mType: metricType, id: metricName})
+}
+
+func (mc *MetricCollection) getSeries(key metricKey) (Metric, error) {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	if i, ok := mc.index[key]; ok {
+		return mc.metrics[i].clone(), nil
 	}
 	return Metric{}, ErrNotFound
 }
 
-func (mc *MetricCollection) GetMetricJSON(metricName string) ([]byte, error) {
-	for _, m := range mc.Metrics {
-		if m.ID == metricName {
-			resultJSON, err := json.Marshal(m)
-			if err != nil {
-				return nil, ErrBadRequest
-			}
-			return resultJSON, nil
-		}
+func (mc *MetricCollection) GetMetricJSON(metricType, metricName string) ([]byte, error) {
+	m, err := mc.GetMetric(metricType, metricName)
+	if err != nil {
+		return nil, err
+	}
+	resultJSON, err := json.Marshal(m)
+	if err != nil {
+		return nil, ErrBadRequest
 	}
-	return nil, ErrNotFound
+	return resultJSON, nil
 }
 
 func (mc *MetricCollection) GetAvailableMetrics() []string {
-	names := make([]string, 0)
-	for _, m := range mc.Metrics {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	names := make([]string, 0, len(mc.metrics))
+	for _, m := range mc.metrics {
 		names = append(names, m.ID)
 	}
 	return names
 }
 
+// Len возвращает число рядов в коллекции.
+func (mc *MetricCollection) Len() int {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+	return len(mc.metrics)
+}
+
+// Snapshot возвращает согласованную копию всех метрик.
+func (mc *MetricCollection) Snapshot() []Metric {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	metrics := make([]Metric, 0, len(mc.metrics))
+	for _, m := range mc.metrics {
+		metrics = append(metrics, m.clone())
+	}
+	return metrics
+}
+
+// Replace целиком заменяет содержимое коллекции, например при восстановлении.
+func (mc *MetricCollection) Replace(metrics []Metric) {
+	replacement := make([]Metric, 0, len(metrics))
+	for _, m := range metrics {
+		replacement = append(replacement, m.clone())
+	}
+
+	index := make(map[metricKey]int, len(replacement))
+	for i, m := range replacement {
+		index[keyOf(m)] = i
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.metrics = replacement
+	mc.index = index
+	mc.updated = nil
+	mc.history = nil
+	mc.rollups = nil
+}
+
 func (mc *MetricCollection) UpsertMetric(metric Metric) {
-	for i, m := range mc.Metrics {
-		if m.ID == metric.ID {
-			mc.Metrics[i] = metric
-			return
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.upsert(metric)
+}
+
+// upsert вызывается только под mc.mu; новые метрики добавляются в конец.
+func (mc *MetricCollection) upsert(metric Metric) Metric {
+	metric = metric.clone()
+	key := keyOf(metric)
+	if mc.updated == nil {
+		mc.updated = make(map[metricKey]time.Time)
+	}
+	mc.updated[key] = mc.policy.now()
+	if i, ok := mc.index[key]; ok {
+		mc.metrics[i] = metric
+		return metric.clone()
+	}
+	if mc.index == nil {
+		mc.index = make(map[metricKey]int)
+	}
+	mc.index[key] = len(mc.metrics)
+	mc.metrics = append(mc.metrics, metric)
+	return metric.clone()
+}
+
+// record добавляет новое состояние метрики в историю и корзины ряда до того,
+// как оно сохранено. Вызывается только под mc.mu.
+func (mc *MetricCollection) record(metric Metric) {
+	sample, ok := sampleOf(metric)
+	if !ok {
+		return
+	}
+	key := keyOf(metric)
+	if mc.historyLength > 0 {
+		if mc.history == nil {
+			mc.history = make(map[metricKey]*history)
+		}
+		h, ok := mc.history[key]
+		if !ok {
+			h = &history{}
+			mc.history[key] = h
+		}
+		h.push(sample, mc.historyLength)
+	}
+
+	if mc.rollups == nil {
+		mc.rollups = make(map[metricKey]*rollup)
+	}
+	r, ok := mc.rollups[key]
+	if !ok {
+		r = newRollup(mc.stored(key))
+		mc.rollups[key] = r
+	}
+	r.add(key.mType, sample)
+}
+
+func (mc *MetricCollection) Update(ctx context.Context, metric Metric) (Metric, error) {
+	if err := mc.Validate(metric); err != nil {
+		return Metric{}, err
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.collect(mc.policy.Stamp(metric))
+}
+
+// UpdateBatch применяет набор целиком или не применяет вовсе.
+// Повторы одной метрики схлопываются, как в базе.
+func (mc *MetricCollection) UpdateBatch(ctx context.Context, metrics []Metric) ([]Metric, error) {
+	for _, metric := range metrics {
+		if err := mc.Validate(metric); err != nil {
+			return nil, err
+		}
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	pending := make(map[metricKey]Metric, len(metrics))
+	keys := make([]metricKey, 0, len(metrics))
+	for _, metric := range metrics {
+		key := keyOf(metric)
+		stored := mc.stored(key)
+		p, seen := pending[key]
+		if seen {
+			stored = &p
+		}
+		result, err := mc.policy.Apply(stored, mc.policy.Stamp(metric))
+		if err != nil {
+			return nil, err
+		}
+		pending[key] = result
+		if !seen {
+			keys = append(keys, key)
+		}
+	}
+	states := make([]Metric, 0, len(keys))
+	for _, key := range keys {
+		states = append(states, pending[key])
+	}
+	if err := mc.write(states, false); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		mc.record(pending[key])
+		pending[key] = mc.upsert(pending[key])
+	}
+	results := make([]Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		results = append(results, pending[keyOf(metric)].clone())
+	}
+	return results, nil
+}
+
+func (mc *MetricCollection) Get(ctx context.Context, metricType, metricName string, labels Labels) (Metric, error) {
+	return mc.getSeries(metricKey{mType: metricType, id: metricName, labels: labels.Key()})
+}
+
+func (mc *MetricCollection) List(ctx context.Context, matchers ...*Matcher) ([]Metric, error) {
+	if len(matchers) == 0 {
+		return mc.Snapshot(), nil
+	}
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	var metrics []Metric
+	for _, m := range mc.metrics {
+		if MatchAll(m, matchers) {
+			metrics = append(metrics, m.clone())
+		}
+	}
+	return metrics, nil
+}
+
+// Delete сохраняет порядок оставшихся метрик, поэтому работает за O(n).
+func (mc *MetricCollection) Delete(ctx context.Context, metricType, metricName string, labels Labels) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	key := metricKey{mType: metricType, id: metricName, labels: labels.Key()}
+	i, ok := mc.index[key]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := mc.write([]Metric{{ID: metricName, MType: metricType, Labels: labels}}, true); err != nil {
+		return err
+	}
+	// на место удалённой встаёт последняя метрика, остальные индексы не меняются
+	last := len(mc.metrics) - 1
+	if i != last {
+		mc.metrics[i] = mc.metrics[last]
+		mc.index[keyOf(mc.metrics[i])] = i
+	}
+	mc.metrics[last] = Metric{}
+	mc.metrics = mc.metrics[:last]
+	delete(mc.index, key)
+	delete(mc.updated, key)
+	delete(mc.history, key)
+	delete(mc.rollups, key)
+	return nil
+}
+
+// History отдаёт сэмплы из буфера истории ряда; после перезапуска он пуст.
+func (mc *MetricCollection) History(ctx context.Context, metricType, metricName string, labels Labels, from, to time.Time) ([]Sample, error) {
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	key := metricKey{mType: metricType, id: metricName, labels: labels.Key()}
+	if _, ok := mc.index[key]; !ok {
+		return nil, ErrNotFound
+	}
+	h, ok := mc.history[key]
+	if !ok {
+		return []Sample{}, nil
+	}
+	return h.between(from, to), nil
+}
+
+// Prune удаляет ряды, которые сервер не записывал с before, и более старые сэмплы.
+// Ряды из снимка считаются записанными при первой чистке.
+func (mc *MetricCollection) Prune(ctx context.Context, before time.Time) ([]Metric, error) {
+	if before.IsZero() {
+		return nil, nil
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if mc.updated == nil {
+		mc.updated = make(map[metricKey]time.Time)
+	}
+	var removed []Metric
+	for _, m := range mc.metrics {
+		key := keyOf(m)
+		updated, ok := mc.updated[key]
+		if !ok {
+			updated = mc.policy.now()
+			mc.updated[key] = updated
+		}
+		if updated.Before(before) {
+			removed = append(removed, m)
+		}
+	}
+	if len(removed) > 0 {
+		if err := mc.write(removed, true); err != nil {
+			return nil, err
 		}
+		kept := mc.metrics[:0]
+		for _, m := range mc.metrics {
+			key := keyOf(m)
+			if mc.updated[key].Before(before) {
+				delete(mc.updated, key)
+				delete(mc.history, key)
+				delete(mc.rollups, key)
+				continue
+			}
+			kept = append(kept, m)
+		}
+		mc.metrics = kept
+		mc.index = make(map[metricKey]int, len(kept))
+		for i, m := range kept {
+			mc.index[keyOf(m)] = i
+		}
+	}
+	for _, h := range mc.history {
+		h.dropBefore(before)
+	}
+	return removed, nil
+}
+
+// Rollup удаляет корзины старше срока хранения; сэмплы попадают в них при записи.
+func (mc *MetricCollection) Rollup(ctx context.Context, now time.Time, retention RollupRetention) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	for _, r := range mc.rollups {
+		r.expire(now, retention)
+	}
+	return nil
+}
+
+// Rollups отдаёт корзины ряда из [from, to] в разрешении resolution.
+func (mc *MetricCollection) Rollups(ctx context.Context, metricType, metricName string, labels Labels, resolution string, from, to time.Time) ([]Bucket, error) {
+	if _, err := ResolutionStep(resolution); err != nil {
+		return nil, err
+	}
+	mc.mu.RLock()
+	defer mc.mu.RUnlock()
+
+	key := metricKey{mType: metricType, id: metricName, labels: labels.Key()}
+	if _, ok := mc.index[key]; !ok {
+		return nil, ErrNotFound
+	}
+	r, ok := mc.rollups[key]
+	if !ok {
+		return []Bucket{}, nil
 	}
-	mc.Metrics = append(mc.Metrics, metric)
+	return r.between(metricType, resolution, from, to), nil
 }
@@ -1,8 +1,14 @@
 package storage
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
 	"testing"
+	"time"
 )
 
 func ptrFloat64(f float64) *float64 {
@@ -36,30 +42,119 @@ func TestMetricCollection_Collect(t *testing.T) {
 		},
 	}
 
-	mc := MetricCollection{
-		Metrics: make([]Metric, 0),
-	}
+	mc := NewMetricCollection()
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			err := mc.Collect(test.metric)
-			if err != test.expected {
+			if !errors.Is(err, test.expected) {
 				t.Errorf("Expected error: %v, got: %v", test.expected, err)
 			}
 		})
 	}
 }
 
-func TestMetricCollection_GetMetric(t *testing.T) {
-	mc := MetricCollection{
-		Metrics: []Metric{
-			{ID: "metric1", MType: Counter, Delta: ptrInt64(5)},
-			{ID: "metric2", MType: Gauge, Value: ptrFloat64(10.5)},
+func TestValidateReportsField(t *testing.T) {
+	tests := []struct {
+		name     string
+		metric   Metric
+		field    string
+		expected error
+	}{
+		{
+			name:     "EmptyName",
+			metric:   Metric{MType: Counter, Delta: ptrInt64(1)},
+			field:    "id",
+			expected: ErrBadRequest,
+		},
+		{
+			name:     "NonFiniteValue",
+			metric:   Metric{ID: "gauge1", MType: Gauge, Value: ptrFloat64(math.Inf(1))},
+			field:    "value",
+			expected: ErrBadRequest,
 		},
+		{
+			name:     "MissingDelta",
+			metric:   Metric{ID: "counter1", MType: Counter},
+			field:    "delta",
+			expected: ErrBadRequest,
+		},
+		{
+			name:     "UnknownType",
+			metric:   Metric{ID: "metric1", MType: "unknown", Value: ptrFloat64(1)},
+			field:    "type",
+			expected: ErrNotImplemented,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Validate(test.metric)
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("Expected ValidationError, got: %v", err)
+			}
+			if validationErr.Field != test.field {
+				t.Errorf("Expected field: %s, got: %s", test.field, validationErr.Field)
+			}
+			if !errors.Is(err, test.expected) {
+				t.Errorf("Expected error: %v, got: %v", test.expected, err)
+			}
+		})
 	}
+}
+
+func TestPolicy(t *testing.T) {
+	negativeGauge := Metric{ID: "gauge1", MType: Gauge, Value: ptrFloat64(-273.15)}
+	nan := Metric{ID: "gauge2", MType: Gauge, Value: ptrFloat64(math.NaN())}
+	negativeDelta := Metric{ID: "counter1", MType: Counter, Delta: ptrInt64(-1)}
+
+	if err := (Policy{}).Validate(negativeGauge); err != nil {
+		t.Errorf("Expected negative gauge to be valid, got: %v", err)
+	}
+	if err := (Policy{}).Validate(nan); !errors.Is(err, ErrBadRequest) {
+		t.Errorf("Expected ErrBadRequest for NaN, got: %v", err)
+	}
+	if err := (Policy{AllowNonFinite: true}).Validate(nan); err != nil {
+		t.Errorf("Expected NaN to be allowed, got: %v", err)
+	}
+	if err := (Policy{}).Validate(negativeDelta); !errors.Is(err, ErrBadRequest) {
+		t.Errorf("Expected ErrBadRequest for negative delta, got: %v", err)
+	}
+	if err := (Policy{AllowNegativeDelta: true}).Validate(negativeDelta); err != nil {
+		t.Errorf("Expected negative delta to be allowed, got: %v", err)
+	}
+}
+
+func TestMetricJSONNonFinite(t *testing.T) {
+	for _, value := range []float64{math.Inf(1), math.Inf(-1), math.NaN(), -1.5} {
+		data, err := json.Marshal(Metric{ID: "gauge1", MType: Gauge, Value: ptrFloat64(value)})
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		var decoded Metric
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("Expected no error for %s, got: %v", data, err)
+		}
+		if decoded.Value == nil || (*decoded.Value != value && !math.IsNaN(value)) || (math.IsNaN(value) && !math.IsNaN(*decoded.Value)) {
+			t.Errorf("Expected %v after round trip of %s, got: %v", value, data, decoded.Value)
+		}
+	}
+
+	var m Metric
+	if err := json.Unmarshal([]byte(`{"id":"gauge1","type":"gauge","value":"12"}`), &m); err == nil {
+		t.Errorf("Expected error for numeric string value")
+	}
+}
+
+func TestMetricCollection_GetMetric(t *testing.T) {
+	mc := NewMetricCollection(
+		Metric{ID: "metric1", MType: Counter, Delta: ptrInt64(5)},
+		Metric{ID: "metric2", MType: Gauge, Value: ptrFloat64(10.5)},
+	)
 
 	t.Run("ExistingMetric", func(t *testing.T) {
-		metric, err := mc.GetMetric("metric1")
+		metric, err := mc.GetMetric(Counter, "metric1")
 		if err != nil {
 			t.Errorf("Expected no error, got: %v", err)
 		}
@@ -69,7 +164,7 @@ func TestMetricCollection_GetMetric(t *testing.T) {
 	})
 
 	t.Run("NonExistingMetric", func(t *testing.T) {
-		_, err := mc.GetMetric("nonexistent")
+		_, err := mc.GetMetric(Counter, "nonexistent")
 		if err != ErrNotFound {
 			t.Errorf("Expected ErrNotFound, got: %v", err)
 		}
@@ -77,15 +172,13 @@ func TestMetricCollection_GetMetric(t *testing.T) {
 }
 
 func TestMetricCollection_GetMetricJSON(t *testing.T) {
-	mc := MetricCollection{
-		Metrics: []Metric{
-			{ID: "metric1", MType: Counter, Delta: ptrInt64(5)},
-			{ID: "metric2", MType: Gauge, Value: ptrFloat64(10.5)},
-		},
-	}
+	mc := NewMetricCollection(
+		Metric{ID: "metric1", MType: Counter, Delta: ptrInt64(5)},
+		Metric{ID: "metric2", MType: Gauge, Value: ptrFloat64(10.5)},
+	)
 
 	t.Run("ExistingMetric", func(t *testing.T) {
-		jsonData, err := mc.GetMetricJSON("metric1")
+		jsonData, err := mc.GetMetricJSON(Counter, "metric1")
 		if err != nil {
 			t.Errorf("Expected no error, got: %v", err)
 		}
@@ -101,7 +194,7 @@ func TestMetricCollection_GetMetricJSON(t *testing.T) {
 	})
 
 	t.Run("NonExistingMetric", func(t *testing.T) {
-		_, err := mc.GetMetricJSON("nonexistent")
+		_, err := mc.GetMetricJSON(Counter, "nonexistent")
 		if err != ErrNotFound {
 			t.Errorf("Expected ErrNotFound, got: %v", err)
 		}
@@ -109,12 +202,10 @@ func TestMetricCollection_GetMetricJSON(t *testing.T) {
 }
 
 func TestMetricCollection_GetAvailableMetrics(t *testing.T) {
-	mc := MetricCollection{
-		Metrics: []Metric{
-			{ID: "metric1", MType: Counter, Delta: ptrInt64(5)},
-			{ID: "metric2", MType: Gauge, Value: ptrFloat64(10.5)},
-		},
-	}
+	mc := NewMetricCollection(
+		Metric{ID: "metric1", MType: Counter, Delta: ptrInt64(5)},
+		Metric{ID: "metric2", MType: Gauge, Value: ptrFloat64(10.5)},
+	)
 
 	expected := []string{"metric1", "metric2"}
 	result := mc.GetAvailableMetrics()
@@ -129,3 +220,426 @@ func TestMetricCollection_GetAvailableMetrics(t *testing.T) {
 		}
 	}
 }
+
+func TestMetricCollection_ConcurrentCollect(t *testing.T) {
+	const (
+		workers    = 50
+		iterations = 200
+	)
+	mc := NewMetricCollection()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				if err := mc.Collect(Metric{ID: "counter", MType: Counter, Delta: ptrInt64(1)}); err != nil {
+					t.Errorf("Expected no error, got: %v", err)
+				}
+				if err := mc.Collect(Metric{ID: fmt.Sprintf("gauge%d", w), MType: Gauge, Value: ptrFloat64(float64(i))}); err != nil {
+					t.Errorf("Expected no error, got: %v", err)
+				}
+			}
+		}(w)
+	}
+
+	// читатели работают параллельно с писателями
+	for r := 0; r < 5; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				for _, m := range mc.Snapshot() {
+					if m.Delta != nil {
+						*m.Delta = -1 // изменение копии не должно влиять на коллекцию
+					}
+				}
+				_, _ = mc.GetMetric(Counter, "counter")
+				_ = mc.GetAvailableMetrics()
+			}
+		}()
+	}
+	wg.Wait()
+
+	metric, err := mc.GetMetric(Counter, "counter")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if *metric.Delta != workers*iterations {
+		t.Errorf("Expected delta: %d, got: %d", workers*iterations, *metric.Delta)
+	}
+	if got := len(mc.GetAvailableMetrics()); got != workers+1 {
+		t.Errorf("Expected %d metrics, got: %d", workers+1, got)
+	}
+}
+
+func TestMetricCollection_SnapshotIsCopy(t *testing.T) {
+	mc := NewMetricCollection(Metric{ID: "metric1", MType: Counter, Delta: ptrInt64(5)})
+
+	snapshot := mc.Snapshot()
+	*snapshot[0].Delta = 100
+
+	metric, err := mc.GetMetric(Counter, "metric1")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if *metric.Delta != 5 {
+		t.Errorf("Expected delta: 5, got: %d", *metric.Delta)
+	}
+}
+
+func TestMetricCollection_Replace(t *testing.T) {
+	mc := NewMetricCollection(Metric{ID: "metric1", MType: Counter, Delta: ptrInt64(5)})
+	mc.Replace([]Metric{{ID: "metric2", MType: Gauge, Value: ptrFloat64(1.5)}})
+
+	if _, err := mc.GetMetric(Counter, "metric1"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got: %v", err)
+	}
+	if _, err := mc.GetMetric(Gauge, "metric2"); err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+}
+
+func TestMetricCollection_KeyedByTypeAndName(t *testing.T) {
+	mc := NewMetricCollection()
+	if err := mc.Collect(Metric{ID: "metric1", MType: Counter, Delta: ptrInt64(3)}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := mc.Collect(Metric{ID: "metric1", MType: Gauge, Value: ptrFloat64(1.5)}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := mc.Collect(Metric{ID: "metric0", MType: Gauge, Value: ptrFloat64(2.5)}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	counter, err := mc.GetMetric(Counter, "metric1")
+	if err != nil || *counter.Delta != 3 {
+		t.Errorf("Expected counter with delta 3, got: %v, %v", counter, err)
+	}
+	gauge, err := mc.GetMetric(Gauge, "metric1")
+	if err != nil || *gauge.Value != 1.5 {
+		t.Errorf("Expected gauge with value 1.5, got: %v, %v", gauge, err)
+	}
+
+	expected := []string{"metric1", "metric1", "metric0"}
+	result := mc.GetAvailableMetrics()
+	if len(expected) != len(result) {
+		t.Fatalf("Expected length: %d, got: %d", len(expected), len(result))
+	}
+	for i := range expected {
+		if expected[i] != result[i] {
+			t.Errorf("Expected metric: %s, got: %s", expected[i], result[i])
+		}
+	}
+}
+
+const benchmarkMetricsCount = 100000
+
+func newBenchmarkCollection() *MetricCollection {
+	mc := NewMetricCollection()
+	for i := 0; i < benchmarkMetricsCount; i++ {
+		mc.UpsertMetric(Metric{ID: fmt.Sprintf("gauge%d", i), MType: Gauge, Value: ptrFloat64(float64(i))})
+	}
+	return mc
+}
+
+func BenchmarkMetricCollection_Collect(b *testing.B) {
+	mc := newBenchmarkCollection()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id := fmt.Sprintf("gauge%d", i%benchmarkMetricsCount)
+		if err := mc.Collect(Metric{ID: id, MType: Gauge, Value: ptrFloat64(float64(i))}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMetricCollection_GetMetric(b *testing.B) {
+	mc := newBenchmarkCollection()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := mc.GetMetric(Gauge, fmt.Sprintf("gauge%d", i%benchmarkMetricsCount)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMetricCollection_GetAvailableMetrics(b *testing.B) {
+	mc := newBenchmarkCollection()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = mc.GetAvailableMetrics()
+	}
+}
+
+func TestMetricCollection_UpdateBatch(t *testing.T) {
+	ctx := context.Background()
+	mc := NewMetricCollection(Metric{ID: "counter1", MType: Counter, Delta: ptrInt64(1)})
+
+	t.Run("ValidBatch", func(t *testing.T) {
+		results, err := mc.UpdateBatch(ctx, []Metric{
+			{ID: "counter1", MType: Counter, Delta: ptrInt64(2)},
+			{ID: "counter1", MType: Counter, Delta: ptrInt64(3)},
+			{ID: "gauge1", MType: Gauge, Value: ptrFloat64(1.5)},
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		// повторы счётчика получают состояние после всего набора
+		if len(results) != 3 || *results[0].Delta != 6 || *results[1].Delta != 6 || *results[2].Value != 1.5 {
+			t.Errorf("Unexpected results: %v", results)
+		}
+	})
+
+	t.Run("InvalidBatch", func(t *testing.T) {
+		_, err := mc.UpdateBatch(ctx, []Metric{
+			{ID: "counter1", MType: Counter, Delta: ptrInt64(10)},
+			{ID: "gauge2", MType: "invalid", Value: ptrFloat64(1.5)},
+		})
+		if !errors.Is(err, ErrNotImplemented) {
+			t.Errorf("Expected ErrNotImplemented, got: %v", err)
+		}
+		metric, _ := mc.Get(ctx, Counter, "counter1", nil)
+		if *metric.Delta != 6 {
+			t.Errorf("Expected delta: 6, got: %d", *metric.Delta)
+		}
+	})
+}
+
+func TestMetricCollection_Delete(t *testing.T) {
+	ctx := context.Background()
+	mc := NewMetricCollection(
+		Metric{ID: "metric1", MType: Counter, Delta: ptrInt64(5)},
+		Metric{ID: "metric2", MType: Gauge, Value: ptrFloat64(10.5)},
+		Metric{ID: "metric3", MType: Gauge, Value: ptrFloat64(1.5)},
+	)
+
+	if err := mc.Delete(ctx, Counter, "metric1", nil); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := mc.Delete(ctx, Counter, "metric1", nil); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got: %v", err)
+	}
+	if _, err := mc.Get(ctx, Gauge, "metric3", nil); err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+
+	if _, err := mc.Get(ctx, Gauge, "metric2", nil); err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+
+	metrics, _ := mc.List(ctx)
+	if len(metrics) != 2 {
+		t.Errorf("Unexpected metrics after delete: %v", metrics)
+	}
+}
+
+func TestMetricCollection_Labels(t *testing.T) {
+	ctx := context.Background()
+	mc := NewMetricCollection()
+
+	for _, m := range []Metric{
+		{ID: "Alloc", MType: Gauge, Value: ptrFloat64(1), Labels: Labels{"host": "web-1", "region": "eu"}},
+		{ID: "Alloc", MType: Gauge, Value: ptrFloat64(2), Labels: Labels{"host": "web-2", "region": "eu"}},
+		{ID: "Alloc", MType: Gauge, Value: ptrFloat64(3)},
+		{ID: "Requests", MType: Counter, Delta: ptrInt64(5), Labels: Labels{"host": "web-1"}},
+	} {
+		if _, err := mc.Update(ctx, m); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+
+	metric, err := mc.Get(ctx, Gauge, "Alloc", Labels{"region": "eu", "host": "web-2"})
+	if err != nil || *metric.Value != 2 {
+		t.Errorf("Expected series with host web-2, got: %v, %v", metric, err)
+	}
+	metric, err = mc.Get(ctx, Gauge, "Alloc", nil)
+	if err != nil || *metric.Value != 3 {
+		t.Errorf("Expected series without labels, got: %v, %v", metric, err)
+	}
+	if _, err := mc.Get(ctx, Gauge, "Alloc", Labels{"host": "web-3"}); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got: %v", err)
+	}
+
+	tests := []struct {
+		matcher string
+		want    int
+	}{
+		{`host="web-1"`, 2},
+		{`host!="web-1"`, 2},
+		{`host=~"web-.*"`, 3},
+		{`host=""`, 1},
+		{`__name__="Alloc"`, 3},
+		{`region!~"eu|us"`, 2},
+	}
+	for _, tt := range tests {
+		matcher, err := ParseMatcher(tt.matcher)
+		if err != nil {
+			t.Fatalf("Expected no error for %s, got: %v", tt.matcher, err)
+		}
+		metrics, _ := mc.List(ctx, matcher)
+		if len(metrics) != tt.want {
+			t.Errorf("%s: expected %d metrics, got: %v", tt.matcher, tt.want, metrics)
+		}
+	}
+
+	if err := mc.Delete(ctx, Gauge, "Alloc", Labels{"host": "web-1", "region": "eu"}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	metrics, _ := mc.List(ctx)
+	if len(metrics) != 3 {
+		t.Errorf("Expected 3 metrics after delete, got: %v", metrics)
+	}
+}
+
+func TestLabelsValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels Labels
+		valid  bool
+	}{
+		{"Valid", Labels{"host": "web-1", "_zone": "a"}, true},
+		{"BadName", Labels{"1host": "web-1"}, false},
+		{"Reserved", Labels{"__name__": "x"}, false},
+		{"EmptyValue", Labels{"host": ""}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(Metric{ID: "m", MType: Gauge, Value: ptrFloat64(1), Labels: tt.labels})
+			if tt.valid && err != nil {
+				t.Errorf("Expected no error, got: %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrBadRequest) {
+				t.Errorf("Expected ErrBadRequest, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseMatcher(t *testing.T) {
+	if _, err := ParseMatcher(`host`); err == nil {
+		t.Error("Expected error for matcher without operator")
+	}
+	if _, err := ParseMatcher(`host=~"("`); err == nil {
+		t.Error("Expected error for invalid regexp")
+	}
+	m, err := ParseMatcher(`host!=web-1`)
+	if err != nil || m.Type != MatchNotEqual || m.Value != "web-1" {
+		t.Errorf("Unexpected matcher: %v, %v", m, err)
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+	ctx := context.Background()
+	at := func(sec int64) *time.Time {
+		ts := time.Unix(sec, 0).UTC()
+		return &ts
+	}
+
+	tests := []struct {
+		policy    string
+		wantGauge float64
+		wantDelta int64
+		wantErr   error
+	}{
+		{OutOfOrderAccept, 1, 3, nil},
+		{OutOfOrderNewer, 2, 3, nil},
+		{OutOfOrderReject, 2, 2, ErrOutOfOrder},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			mc := NewMetricCollection()
+			mc.SetPolicy(Policy{OutOfOrder: tt.policy})
+			if _, err := mc.UpdateBatch(ctx, []Metric{
+				{ID: "g", MType: Gauge, Value: ptrFloat64(2), Timestamp: at(20)},
+				{ID: "c", MType: Counter, Delta: ptrInt64(2), Timestamp: at(20)},
+			}); err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+
+			_, gaugeErr := mc.Update(ctx, Metric{ID: "g", MType: Gauge, Value: ptrFloat64(1), Timestamp: at(10)})
+			_, counterErr := mc.Update(ctx, Metric{ID: "c", MType: Counter, Delta: ptrInt64(1), Timestamp: at(10)})
+			if !errors.Is(gaugeErr, tt.wantErr) || !errors.Is(counterErr, tt.wantErr) {
+				t.Errorf("Expected %v, got: %v, %v", tt.wantErr, gaugeErr, counterErr)
+			}
+
+			gauge, _ := mc.Get(ctx, Gauge, "g", nil)
+			if *gauge.Value != tt.wantGauge {
+				t.Errorf("Expected gauge %g, got: %g", tt.wantGauge, *gauge.Value)
+			}
+			counter, _ := mc.Get(ctx, Counter, "c", nil)
+			if *counter.Delta != tt.wantDelta {
+				t.Errorf("Expected delta %d, got: %d", tt.wantDelta, *counter.Delta)
+			}
+			// накопительная метрика помнит время самого свежего сэмпла
+			if !counter.Timestamp.Equal(*at(20)) {
+				t.Errorf("Expected counter timestamp %v, got: %v", at(20), counter.Timestamp)
+			}
+		})
+	}
+}
+
+func TestPolicyStamp(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mc := NewMetricCollection()
+	mc.SetPolicy(Policy{Now: func() time.Time { return now }})
+
+	metric, err := mc.Update(context.Background(), Metric{ID: "g", MType: Gauge, Value: ptrFloat64(1)})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if metric.Timestamp == nil || !metric.Timestamp.Equal(now) {
+		t.Errorf("Expected timestamp %v, got: %v", now, metric.Timestamp)
+	}
+
+	zero := time.Time{}
+	if err := Validate(Metric{ID: "g", MType: Gauge, Value: ptrFloat64(1), Timestamp: &zero}); !errors.Is(err, ErrBadRequest) {
+		t.Errorf("Expected ErrBadRequest for zero timestamp, got: %v", err)
+	}
+}
+
+func TestMetricCollection_Journal(t *testing.T) {
+	ctx := context.Background()
+	mc := NewMetricCollection()
+	var journaled []Metric
+	var failure error
+	mc.SetJournal(func(metrics []Metric, deleted bool) error {
+		if failure != nil {
+			return failure
+		}
+		for _, m := range metrics {
+			// журнал вызывается под блокировкой коллекции
+			if stored := mc.stored(keyOf(m)); deleted == (stored == nil) {
+				t.Errorf("Expected journal to run before %s is applied", m.ID)
+			}
+		}
+		journaled = append(journaled, metrics...)
+		return nil
+	})
+
+	if _, err := mc.UpdateBatch(ctx, []Metric{
+		{ID: "c", MType: Counter, Delta: ptrInt64(1)},
+		{ID: "c", MType: Counter, Delta: ptrInt64(2)},
+	}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(journaled) != 1 || *journaled[0].Delta != 3 {
+		t.Errorf("Expected the final state to be journaled once, got: %v", journaled)
+	}
+
+	failure = errors.New("disk full")
+	if _, err := mc.Update(ctx, Metric{ID: "c", MType: Counter, Delta: ptrInt64(5)}); !errors.Is(err, failure) {
+		t.Errorf("Expected journal error, got: %v", err)
+	}
+	if err := mc.Delete(ctx, Counter, "c", nil); !errors.Is(err, failure) {
+		t.Errorf("Expected journal error, got: %v", err)
+	}
+	if _, err := mc.Prune(ctx, time.Now().Add(time.Hour)); !errors.Is(err, failure) {
+		t.Errorf("Expected journal error, got: %v", err)
+	}
+	metric, err := mc.Get(ctx, Counter, "c", nil)
+	if err != nil || *metric.Delta != 3 {
+		t.Errorf("Expected failed writes to leave the collection unchanged, got: %v, %v", metric, err)
+	}
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultHistogramBounds — границы корзин для гистограмм, созданных по одному
+// наблюдению, если сервер не настроен иначе.
+var DefaultHistogramBounds = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// HistogramValue — распределение наблюдений по корзинам (Bounds[i-1], Bounds[i]]
+// и последней корзине сверх всех границ. Счётчики не накопительные.
+type HistogramValue struct {
+	Bounds []float64 `json:"bounds"` // верхние границы корзин по возрастанию
+	Counts []uint64  `json:"counts"` // число наблюдений в корзинах, на одну больше, чем границ
+	Sum    float64   `json:"sum"`    // сумма наблюдений
+	Count  uint64    `json:"count"`  // общее число наблюдений
+}
+
+// NewHistogram возвращает пустую гистограмму с заданными границами.
+func NewHistogram(bounds []float64) *HistogramValue {
+	return &HistogramValue{
+		Bounds: append([]float64(nil), bounds...),
+		Counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// ParseHistogramBounds разбирает границы корзин, перечисленные через запятую.
+// Пустая строка означает границы по умолчанию.
+func ParseHistogramBounds(s string) ([]float64, error) {
+	if strings.TrimSpace(s) == "" {
+		return DefaultHistogramBounds, nil
+	}
+	parts := strings.Split(s, ",")
+	bounds := make([]float64, 0, len(parts))
+	for _, part := range parts {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid histogram bound %q: %w", part, err)
+		}
+		bounds = append(bounds, bound)
+	}
+	if err := validateBounds(bounds); err != nil {
+		return nil, err
+	}
+	return bounds, nil
+}
+
+func validateBounds(bounds []float64) error {
+	for i, bound := range bounds {
+		if isNonFinite(bound) {
+			return fmt.Errorf("histogram bound %v must be finite", bound)
+		}
+		if i > 0 && bound <= bounds[i-1] {
+			return fmt.Errorf("histogram bounds must be strictly increasing")
+		}
+	}
+	return nil
+}
+
+// validate проверяет согласованность гистограммы, пришедшей от клиента.
+func (h *HistogramValue) validate() error {
+	if err := validateBounds(h.Bounds); err != nil {
+		return &ValidationError{Field: "histogram.bounds", Reason: err.Error(), Err: ErrBadRequest}
+	}
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return &ValidationError{Field: "histogram.counts", Reason: "must have one more element than bounds", Err: ErrBadRequest}
+	}
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total != h.Count {
+		return &ValidationError{Field: "histogram.count", Reason: "must equal the sum of bucket counts", Err: ErrBadRequest}
+	}
+	if math.IsNaN(h.Sum) {
+		return &ValidationError{Field: "histogram.sum", Reason: "must be a number", Err: ErrBadRequest}
+	}
+	return nil
+}
+
+func (h *HistogramValue) clone() *HistogramValue {
+	if h == nil {
+		return nil
+	}
+	return &HistogramValue{
+		Bounds: append([]float64(nil), h.Bounds...),
+		Counts: append([]uint64(nil), h.Counts...),
+		Sum:    h.Sum,
+		Count:  h.Count,
+	}
+}
+
+// Observe добавляет одно наблюдение.
+func (h *HistogramValue) Observe(v float64) {
+	// первая граница, не меньшая v; если таких нет — последняя корзина
+	i := sort.SearchFloat64s(h.Bounds, v)
+	h.Counts[i]++
+	h.Sum += v
+	h.Count++
+}
+
+// merge прибавляет к гистограмме другую с теми же границами.
+func (h *HistogramValue) merge(other *HistogramValue) error {
+	if !sameBounds(h.Bounds, other.Bounds) {
+		return &ValidationError{Field: "histogram.bounds", Reason: "differ from the stored histogram", Err: ErrBadRequest}
+	}
+	for i, c := range other.Counts {
+		h.Counts[i] += c
+	}
+	h.Sum += other.Sum
+	h.Count += other.Count
+	return nil
+}
+
+func sameBounds(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
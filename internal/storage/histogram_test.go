@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestHistogramObserve(t *testing.T) {
+	h := NewHistogram([]float64{1, 5})
+	for _, v := range []float64{0.5, 1, 3, 5, 7} {
+		h.Observe(v)
+	}
+	expected := []uint64{2, 2, 1}
+	for i, c := range expected {
+		if h.Counts[i] != c {
+			t.Errorf("Expected counts: %v, got: %v", expected, h.Counts)
+			break
+		}
+	}
+	if h.Count != 5 || h.Sum != 16.5 {
+		t.Errorf("Unexpected count or sum: %d, %g", h.Count, h.Sum)
+	}
+}
+
+func TestParseHistogramBounds(t *testing.T) {
+	bounds, err := ParseHistogramBounds("0.5, 1,10")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !sameBounds(bounds, []float64{0.5, 1, 10}) {
+		t.Errorf("Unexpected bounds: %v", bounds)
+	}
+	if bounds, _ := ParseHistogramBounds(""); !sameBounds(bounds, DefaultHistogramBounds) {
+		t.Errorf("Expected default bounds, got: %v", bounds)
+	}
+	for _, s := range []string{"1,1", "2,1", "1,abc", "1,+Inf"} {
+		if _, err := ParseHistogramBounds(s); err == nil {
+			t.Errorf("Expected error for %q", s)
+		}
+	}
+}
+
+func TestMetricCollection_Histogram(t *testing.T) {
+	ctx := context.Background()
+	mc := NewMetricCollection()
+	mc.SetPolicy(Policy{HistogramBounds: []float64{1}})
+
+	if _, err := mc.Update(ctx, Metric{ID: "latency", MType: Histogram, Value: ptrFloat64(0.5)}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	result, err := mc.Update(ctx, Metric{ID: "latency", MType: Histogram, Histogram: &HistogramValue{
+		Bounds: []float64{1}, Counts: []uint64{1, 2}, Sum: 7, Count: 3,
+	}})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if result.Histogram.Count != 4 || result.Histogram.Sum != 7.5 || result.Histogram.Counts[0] != 2 {
+		t.Errorf("Unexpected histogram: %+v", result.Histogram)
+	}
+
+	t.Run("BatchWithDifferentBoundsIsNotApplied", func(t *testing.T) {
+		_, err := mc.UpdateBatch(ctx, []Metric{
+			{ID: "latency", MType: Histogram, Value: ptrFloat64(0.1)},
+			{ID: "latency", MType: Histogram, Histogram: &HistogramValue{Bounds: []float64{2}, Counts: []uint64{1, 0}, Sum: 1, Count: 1}},
+		})
+		if !errors.Is(err, ErrBadRequest) {
+			t.Errorf("Expected ErrBadRequest, got: %v", err)
+		}
+		metric, _ := mc.GetMetric(Histogram, "latency")
+		if metric.Histogram.Count != 4 {
+			t.Errorf("Expected count: 4, got: %d", metric.Histogram.Count)
+		}
+	})
+
+	t.Run("SnapshotIsCopy", func(t *testing.T) {
+		snapshot := mc.Snapshot()
+		snapshot[0].Histogram.Counts[0] = 100
+		metric, _ := mc.GetMetric(Histogram, "latency")
+		if metric.Histogram.Counts[0] != 2 {
+			t.Errorf("Expected stored histogram to be unchanged, got: %v", metric.Histogram.Counts)
+		}
+	})
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Sample — значение ряда в момент времени: Value у gauge, иначе накопленное
+// значение или число наблюдений в Delta.
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Delta     *int64    `json:"delta,omitempty"`
+	Value     *float64  `json:"value,omitempty"`
+}
+
+// sampleJSON — представление Sample без собственных методов кодирования.
+type sampleJSON Sample
+
+// MarshalJSON, как и у Metric, кодирует NaN и ±Inf строками.
+func (s Sample) MarshalJSON() ([]byte, error) {
+	if s.Value == nil || !isNonFinite(*s.Value) {
+		return json.Marshal(sampleJSON(s))
+	}
+	return json.Marshal(struct {
+		sampleJSON
+		Value string `json:"value"`
+	}{
+		sampleJSON: sampleJSON(s),
+		Value:      strconv.FormatFloat(*s.Value, 'g', -1, 64),
+	})
+}
+
+func (s Sample) equal(other Sample) bool {
+	if !s.Timestamp.Equal(other.Timestamp) {
+		return false
+	}
+	if (s.Delta == nil) != (other.Delta == nil) || s.Delta != nil && *s.Delta != *other.Delta {
+		return false
+	}
+	if (s.Value == nil) != (other.Value == nil) || s.Value != nil && *s.Value != *other.Value {
+		return false
+	}
+	return true
+}
+
+// sampleOf возвращает сэмпл состояния метрики. Метрика без времени сэмпла не даёт.
+func sampleOf(metric Metric) (Sample, bool) {
+	if metric.Timestamp == nil {
+		return Sample{}, false
+	}
+	s := Sample{Timestamp: *metric.Timestamp}
+	if metric.MType == Gauge {
+		if metric.Value == nil {
+			return Sample{}, false
+		}
+		value := *metric.Value
+		s.Value = &value
+		return s, true
+	}
+	total, ok := totalOf(metric)
+	if !ok {
+		return Sample{}, false
+	}
+	s.Delta = &total
+	return s, true
+}
+
+// totalOf возвращает накопленное значение counter, histogram, summary или set.
+func totalOf(metric Metric) (int64, bool) {
+	switch metric.MType {
+	case Counter:
+		if metric.Delta != nil {
+			return *metric.Delta, true
+		}
+	case Histogram:
+		if metric.Histogram != nil {
+			return int64(metric.Histogram.Count), true
+		}
+	case Summary:
+		if metric.Summary != nil {
+			return int64(metric.Summary.Count), true
+		}
+	case Set:
+		if metric.Set != nil {
+			return int64(metric.Set.Count), true
+		}
+	}
+	return 0, false
+}
+
+// history — кольцевой буфер последних сэмплов ряда.
+type history struct {
+	samples []Sample
+	next    int // куда писать следующий сэмпл, когда буфер заполнен
+}
+
+func (h *history) push(s Sample, limit int) {
+	if n := len(h.samples); n > 0 {
+		// пока буфер не заполнен, next равен нулю
+		last := h.samples[(h.next+n-1)%n]
+		// отброшенный поздний сэмпл оставляет состояние прежним
+		if last.equal(s) {
+			return
+		}
+	}
+	if len(h.samples) < limit {
+		h.samples = append(h.samples, s)
+		return
+	}
+	h.samples[h.next] = s
+	h.next = (h.next + 1) % len(h.samples)
+}
+
+// between возвращает сэмплы из [from, to] по возрастанию времени.
+// Нулевая граница интервал не ограничивает.
+func (h *history) between(from, to time.Time) []Sample {
+	samples := make([]Sample, 0, len(h.samples))
+	for _, s := range h.samples {
+		if !from.IsZero() && s.Timestamp.Before(from) || !to.IsZero() && s.Timestamp.After(to) {
+			continue
+		}
+		samples = append(samples, s)
+	}
+	// при политике accept поздние сэмплы попадают в буфер не по порядку
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Timestamp.Before(samples[j].Timestamp)
+	})
+	return samples
+}
+
+// dropBefore удаляет сэмплы старше before.
+func (h *history) dropBefore(before time.Time) {
+	samples := h.between(before, time.Time{})
+	if len(samples) == len(h.samples) {
+		return
+	}
+	h.samples = samples
+	h.next = 0
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHistoryRing(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mc := NewMetricCollection()
+	mc.SetHistoryLength(3)
+
+	for i := 0; i < 5; i++ {
+		ts := start.Add(time.Duration(i) * time.Minute)
+		if _, err := mc.Update(ctx, Metric{ID: "g", MType: Gauge, Value: ptrFloat64(float64(i)), Timestamp: &ts}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+
+	samples, err := mc.History(ctx, Gauge, "g", nil, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(samples) != 3 {
+		t.Fatalf("Expected 3 samples, got: %v", samples)
+	}
+	for i, s := range samples {
+		if *s.Value != float64(i+2) || !s.Timestamp.Equal(start.Add(time.Duration(i+2)*time.Minute)) {
+			t.Errorf("Unexpected sample %d: %v at %v", i, *s.Value, s.Timestamp)
+		}
+	}
+
+	samples, _ = mc.History(ctx, Gauge, "g", nil, start.Add(3*time.Minute), start.Add(3*time.Minute))
+	if len(samples) != 1 || *samples[0].Value != 3 {
+		t.Errorf("Expected only the sample at 00:03, got: %v", samples)
+	}
+
+	if _, err := mc.History(ctx, Gauge, "missing", nil, time.Time{}, time.Time{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got: %v", err)
+	}
+	if err := mc.Delete(ctx, Gauge, "g", nil); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if _, err := mc.Update(ctx, Metric{ID: "g", MType: Gauge, Value: ptrFloat64(7)}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	samples, _ = mc.History(ctx, Gauge, "g", nil, time.Time{}, time.Time{})
+	if len(samples) != 1 {
+		t.Errorf("Expected history to restart after delete, got: %v", samples)
+	}
+}
+
+func TestHistorySamples(t *testing.T) {
+	ctx := context.Background()
+	at := func(sec int64) *time.Time {
+		ts := time.Unix(sec, 0).UTC()
+		return &ts
+	}
+	mc := NewMetricCollection()
+	mc.SetPolicy(Policy{OutOfOrder: OutOfOrderNewer})
+	mc.SetHistoryLength(10)
+
+	for _, m := range []Metric{
+		{ID: "c", MType: Counter, Delta: ptrInt64(2), Timestamp: at(10)},
+		{ID: "c", MType: Counter, Delta: ptrInt64(3), Timestamp: at(20)},
+		{ID: "g", MType: Gauge, Value: ptrFloat64(1), Timestamp: at(20)},
+		// поздний gauge отбрасывается и не добавляет сэмпл
+		{ID: "g", MType: Gauge, Value: ptrFloat64(5), Timestamp: at(10)},
+		{ID: "h", MType: Histogram, Value: ptrFloat64(0.5), Timestamp: at(30)},
+	} {
+		if _, err := mc.Update(ctx, m); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+
+	counter, _ := mc.History(ctx, Counter, "c", nil, time.Time{}, time.Time{})
+	if len(counter) != 2 || *counter[0].Delta != 2 || *counter[1].Delta != 5 {
+		t.Errorf("Expected cumulative counter samples 2 and 5, got: %v", counter)
+	}
+	gauge, _ := mc.History(ctx, Gauge, "g", nil, time.Time{}, time.Time{})
+	if len(gauge) != 1 {
+		t.Errorf("Expected a single gauge sample, got: %v", gauge)
+	}
+	histogram, _ := mc.History(ctx, Histogram, "h", nil, time.Time{}, time.Time{})
+	if len(histogram) != 1 || *histogram[0].Delta != 1 {
+		t.Errorf("Expected histogram sample with one observation, got: %v", histogram)
+	}
+}
+
+func TestSampleJSONNonFinite(t *testing.T) {
+	data, err := json.Marshal(Sample{Timestamp: time.Unix(0, 0).UTC(), Value: ptrFloat64(math.Inf(1))})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if string(data) != `{"timestamp":"1970-01-01T00:00:00Z","value":"+Inf"}` {
+		t.Errorf("Unexpected JSON: %s", data)
+	}
+}
+
+func TestMetricCollection_Prune(t *testing.T) {
+	ctx := context.Background()
+	at := func(sec int64) *time.Time {
+		ts := time.Unix(sec, 0).UTC()
+		return &ts
+	}
+	now := time.Unix(100, 0).UTC()
+	mc := NewMetricCollection()
+	mc.SetPolicy(Policy{Now: func() time.Time { return now }})
+	mc.SetHistoryLength(10)
+	mc.Replace([]Metric{{ID: "legacy", MType: Gauge, Value: ptrFloat64(1)}})
+
+	update := func(m Metric) {
+		if _, err := mc.Update(ctx, m); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+	update(Metric{ID: "stale", MType: Gauge, Value: ptrFloat64(1), Timestamp: at(100)})
+	update(Metric{ID: "fresh", MType: Gauge, Value: ptrFloat64(1), Timestamp: at(100)})
+	// время сэмпла из будущего не продлевает жизнь ряда
+	update(Metric{ID: "future", MType: Gauge, Value: ptrFloat64(1), Timestamp: at(5000)})
+	now = time.Unix(600, 0).UTC()
+	update(Metric{ID: "fresh", MType: Gauge, Value: ptrFloat64(2), Timestamp: at(600)})
+	// свежая запись старого сэмпла не удаляется
+	update(Metric{ID: "backfill", MType: Gauge, Value: ptrFloat64(1), Timestamp: at(50)})
+
+	now = time.Unix(1000, 0).UTC()
+	removed, err := mc.Prune(ctx, time.Unix(500, 0))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(removed) != 2 || removed[0].ID != "stale" || removed[1].ID != "future" {
+		t.Errorf("Expected stale and future series to be removed, got: %v", removed)
+	}
+	if _, err := mc.Get(ctx, Gauge, "stale", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got: %v", err)
+	}
+	if _, err := mc.Get(ctx, Gauge, "backfill", nil); err != nil {
+		t.Errorf("Expected backfilled series to be kept, got: %v", err)
+	}
+	samples, _ := mc.History(ctx, Gauge, "fresh", nil, time.Time{}, time.Time{})
+	if len(samples) != 1 || *samples[0].Value != 2 {
+		t.Errorf("Expected history older than the cutoff to be dropped, got: %v", samples)
+	}
+
+	removed, _ = mc.Prune(ctx, time.Time{})
+	if len(removed) != 0 {
+		t.Errorf("Expected zero cutoff to keep everything, got: %v", removed)
+	}
+
+	// ряд из снимка считается записанным при первой чистке
+	now = time.Unix(2000, 0).UTC()
+	removed, _ = mc.Prune(ctx, time.Unix(900, 0))
+	for _, m := range removed {
+		if m.ID == "legacy" {
+			t.Errorf("Expected legacy series to live until %v, got removed", time.Unix(1000, 0))
+		}
+	}
+	removed, _ = mc.Prune(ctx, time.Unix(1500, 0))
+	if len(removed) != 1 || removed[0].ID != "legacy" {
+		t.Errorf("Expected legacy series to be removed, got: %v", removed)
+	}
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxLabels ограничивает число меток одной метрики.
+const maxLabels = 32
+
+// NameLabel — имя псевдометки, по которой матчеры сравнивают имя метрики.
+const NameLabel = "__name__"
+
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Labels — метки метрики. Метрики с одним именем и типом, но разными
+// метками — разные ряды.
+type Labels map[string]string
+
+// Key возвращает каноническую запись меток: {a="1",b="2"} с именами по
+// алфавиту. Пустые метки дают пустую строку.
+func (l Labels) Key() string {
+	if len(l) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(l[name]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func (l Labels) clone() Labels {
+	if l == nil {
+		return nil
+	}
+	c := make(Labels, len(l))
+	for name, value := range l {
+		c[name] = value
+	}
+	return c
+}
+
+func (l Labels) validate() error {
+	if len(l) > maxLabels {
+		return &ValidationError{Field: "labels", Reason: fmt.Sprintf("must not have more than %d labels", maxLabels), Err: ErrBadRequest}
+	}
+	for name, value := range l {
+		if !labelNameRe.MatchString(name) || strings.HasPrefix(name, "__") {
+			return &ValidationError{Field: "labels", Reason: fmt.Sprintf("invalid label name %q", name), Err: ErrBadRequest}
+		}
+		if value == "" {
+			return &ValidationError{Field: "labels", Reason: fmt.Sprintf("label %q must not be empty", name), Err: ErrBadRequest}
+		}
+	}
+	return nil
+}
+
+// ParseLabel разбирает метку из URL в виде имя=значение.
+func ParseLabel(s string) (string, string, error) {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return "", "", fmt.Errorf("label %q must look like name=value", s)
+	}
+	return name, value, nil
+}
+
+// MatchType — способ сравнения метки с образцом.
+type MatchType string
+
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+// Matcher отбирает метрики по значению метки. Отсутствующая метка
+// сравнивается как пустая строка, регулярные выражения применяются ко всему значению.
+type Matcher struct {
+	Name  string
+	Type  MatchType
+	Value string
+	re    *regexp.Regexp
+}
+
+// NewMatcher создаёт матчер и компилирует регулярное выражение, если оно нужно.
+func NewMatcher(matchType MatchType, name, value string) (*Matcher, error) {
+	m := &Matcher{Name: name, Type: matchType, Value: value}
+	switch matchType {
+	case MatchEqual, MatchNotEqual:
+	case MatchRegexp, MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp %q: %w", value, err)
+		}
+		m.re = re
+	default:
+		return nil, fmt.Errorf("unknown match type %q", matchType)
+	}
+	return m, nil
+}
+
+// ParseMatcher разбирает матчер вида host="web-1", host!="web-1",
+// host=~"web-.*" или host!~"web-.*". Кавычки вокруг значения необязательны.
+func ParseMatcher(s string) (*Matcher, error) {
+	i := strings.IndexAny(s, "=!")
+	if i <= 0 {
+		return nil, fmt.Errorf("matcher %q must look like name=\"value\"", s)
+	}
+	name := strings.TrimSpace(s[:i])
+	rest := s[i:]
+
+	var matchType MatchType
+	for _, t := range []MatchType{MatchRegexp, MatchNotRegexp, MatchNotEqual, MatchEqual} {
+		if strings.HasPrefix(rest, string(t)) {
+			matchType = t
+			break
+		}
+	}
+	if matchType == "" {
+		return nil, fmt.Errorf("matcher %q has unknown operator", s)
+	}
+
+	value := strings.TrimSpace(rest[len(matchType):])
+	if strings.HasPrefix(value, `"`) {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return nil, fmt.Errorf("matcher %q has invalid quoted value: %w", s, err)
+		}
+		value = unquoted
+	}
+	return NewMatcher(matchType, name, value)
+}
+
+// Matches сообщает, подходит ли метрика под матчер.
+func (m *Matcher) Matches(metric Metric) bool {
+	value := metric.Labels[m.Name]
+	if m.Name == NameLabel {
+		value = metric.ID
+	}
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	case MatchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+func (m *Matcher) String() string {
+	return m.Name + string(m.Type) + strconv.Quote(m.Value)
+}
+
+// MatchAll сообщает, подходит ли метрика под все матчеры.
+func MatchAll(metric Metric, matchers []*Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(metric) {
+			return false
+		}
+	}
+	return true
+}
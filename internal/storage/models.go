@@ -1,17 +1,137 @@
 package storage
 
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
 const (
-	Counter = "counter"
-	Gauge   = "gauge"
+	Counter   = "counter"
+	Gauge     = "gauge"
+	Histogram = "histogram"
+	Summary   = "summary"
+	Set       = "set"
 )
 
+// KnownType сообщает, поддерживает ли хранилище тип метрики.
+func KnownType(metricType string) bool {
+	switch metricType {
+	case Counter, Gauge, Histogram, Summary, Set:
+		return true
+	}
+	return false
+}
+
 type Metric struct {
-	ID    string   `json:"id"`              // имя метрики
-	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
-	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
-	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
+	ID        string          `json:"id"`                  // имя метрики
+	MType     string          `json:"type"`                // параметр, принимающий значение gauge, counter, histogram, summary или set
+	Delta     *int64          `json:"delta,omitempty"`     // значение метрики в случае передачи counter
+	Value     *float64        `json:"value,omitempty"`     // значение метрики в случае передачи gauge или одно наблюдение histogram и summary
+	Histogram *HistogramValue `json:"histogram,omitempty"` // значение метрики в случае передачи histogram
+	Summary   *SummaryValue   `json:"summary,omitempty"`   // значение метрики в случае передачи summary
+	Set       *SetValue       `json:"set,omitempty"`       // значение метрики в случае передачи set
+	Members   []string        `json:"members,omitempty"`   // новые элементы set; в хранилище не сохраняются
+	Labels    Labels          `json:"labels,omitempty"`    // метки ряда, например host или region
+	Timestamp *time.Time      `json:"timestamp,omitempty"` // время сэмпла; если агент его не прислал, ставит сервер
 }
 
+// metricJSON — представление Metric без собственных методов кодирования.
+type metricJSON Metric
+
+// MarshalJSON кодирует NaN и ±Inf строками "NaN", "+Inf" и "-Inf".
+func (m Metric) MarshalJSON() ([]byte, error) {
+	if m.Value == nil || !isNonFinite(*m.Value) {
+		return json.Marshal(metricJSON(m))
+	}
+	return json.Marshal(struct {
+		metricJSON
+		Value string `json:"value"`
+	}{
+		metricJSON: metricJSON(m),
+		Value:      strconv.FormatFloat(*m.Value, 'g', -1, 64),
+	})
+}
+
+// UnmarshalJSON принимает значение gauge как числом, так и строкой "NaN", "+Inf" или "-Inf".
+func (m *Metric) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		metricJSON
+		Value json.RawMessage `json:"value,omitempty"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*m = Metric(raw.metricJSON)
+	m.Value = nil
+	if len(raw.Value) == 0 || string(raw.Value) == "null" {
+		return nil
+	}
+
+	var value float64
+	if err := json.Unmarshal(raw.Value, &value); err == nil {
+		m.Value = &value
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(raw.Value, &text); err != nil {
+		return fmt.Errorf("value must be a number: %w", err)
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil || !isNonFinite(value) {
+		return fmt.Errorf("value %q must be a number, NaN, +Inf or -Inf", text)
+	}
+	m.Value = &value
+	return nil
+}
+
+// clone возвращает копию метрики, не разделяющую указатели с исходной.
+func (m Metric) clone() Metric {
+	if m.Delta != nil {
+		delta := *m.Delta
+		m.Delta = &delta
+	}
+	if m.Value != nil {
+		value := *m.Value
+		m.Value = &value
+	}
+	m.Histogram = m.Histogram.clone()
+	m.Summary = m.Summary.clone()
+	m.Set = m.Set.clone()
+	m.Labels = m.Labels.clone()
+	if m.Timestamp != nil {
+		ts := *m.Timestamp
+		m.Timestamp = &ts
+	}
+	if m.Members != nil {
+		m.Members = append([]string(nil), m.Members...)
+	}
+	return m
+}
+
+// metricKey однозначно определяет ряд.
+type metricKey struct {
+	mType  string
+	id     string
+	labels string // Labels.Key()
+}
+
+func keyOf(m Metric) metricKey {
+	return metricKey{mType: m.MType, id: m.ID, labels: m.Labels.Key()}
+}
+
+// MetricCollection безопасна для одновременного использования из нескольких горутин.
 type MetricCollection struct {
-	Metrics []Metric
+	mu      sync.RWMutex
+	metrics []Metric          // метрики рядов; удаление переносит на место ряда последний
+	index   map[metricKey]int // позиция метрики в metrics
+	policy  Policy
+	journal Journal
+
+	updated       map[metricKey]time.Time // когда сервер последний раз записал ряд
+	history       map[metricKey]*history  // последние сэмплы рядов
+	rollups       map[metricKey]*rollup   // корзины рядов, пополняются при каждой записи
+	historyLength int                     // размер буфера истории ряда; 0 — история не ведётся
 }
@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Политики для значений gauge, которые не являются конечными числами.
+const (
+	NonFiniteReject = "reject" // NaN и ±Inf отклоняются
+	NonFiniteAllow  = "allow"  // NaN и ±Inf сохраняются как есть
+)
+
+// Политики для поздних сэмплов — тех, чьё время раньше времени сохранённого.
+const (
+	OutOfOrderAccept = "accept" // поздний сэмпл применяется как обычный
+	OutOfOrderNewer  = "newer"  // поздний gauge отбрасывается, накопительные метрики складываются
+	OutOfOrderReject = "reject" // поздний сэмпл любого типа отклоняется с ErrOutOfOrder
+)
+
+// Policy задаёт, какие значения метрик принимает хранилище.
+// Нулевое значение отклоняет NaN, ±Inf и отрицательные приращения счётчиков.
+type Policy struct {
+	AllowNonFinite     bool             // gauge могут принимать NaN и ±Inf
+	AllowNegativeDelta bool             // счётчики могут уменьшаться (up/down counter)
+	HistogramBounds    []float64        // границы новых гистограмм; по умолчанию DefaultHistogramBounds
+	SummaryAccuracy    float64          // погрешность новых скетчей summary; по умолчанию DefaultSummaryAccuracy
+	OutOfOrder         string           // политика для поздних сэмплов; по умолчанию OutOfOrderAccept
+	Now                func() time.Time // время сэмплов без метки времени; по умолчанию time.Now
+}
+
+// ParseNonFinite возвращает признак AllowNonFinite для названия политики.
+func ParseNonFinite(name string) (bool, error) {
+	switch name {
+	case "", NonFiniteReject:
+		return false, nil
+	case NonFiniteAllow:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown non-finite gauge policy %q", name)
+	}
+}
+
+// ParseOutOfOrder проверяет название политики для поздних сэмплов.
+func ParseOutOfOrder(name string) (string, error) {
+	switch name {
+	case "":
+		return OutOfOrderAccept, nil
+	case OutOfOrderAccept, OutOfOrderNewer, OutOfOrderReject:
+		return name, nil
+	default:
+		return "", fmt.Errorf("unknown out-of-order policy %q", name)
+	}
+}
+
+// LateAction возвращает, как поступить с поздним сэмплом метрики этого типа.
+// Политика newer отбрасывает только gauge: суммам порядок не важен.
+func (p Policy) LateAction(metricType string) string {
+	switch p.OutOfOrder {
+	case OutOfOrderReject:
+		return OutOfOrderReject
+	case OutOfOrderNewer:
+		if metricType == Gauge {
+			return OutOfOrderNewer
+		}
+	}
+	return OutOfOrderAccept
+}
+
+// Stamp проставляет текущее время сэмплу, который пришёл без метки времени.
+func (p Policy) Stamp(metric Metric) Metric {
+	if metric.Timestamp == nil {
+		ts := p.now()
+		metric.Timestamp = &ts
+	}
+	return metric
+}
+
+func (p Policy) now() time.Time {
+	if p.Now != nil {
+		return p.Now().UTC()
+	}
+	return time.Now().UTC()
+}
+
+// Validate проверяет метрику по политике.
+func (p Policy) Validate(metric Metric) error {
+	if metric.ID == "" {
+		return &ValidationError{Field: "id", Reason: "metric name is required", Err: ErrBadRequest}
+	}
+	if err := metric.Labels.validate(); err != nil {
+		return err
+	}
+	if metric.Timestamp != nil && metric.Timestamp.IsZero() {
+		return &ValidationError{Field: "timestamp", Reason: "must not be zero", Err: ErrBadRequest}
+	}
+	switch metric.MType {
+	case Counter:
+		if metric.Delta == nil {
+			return &ValidationError{Field: "delta", Reason: "is required for counter", Err: ErrBadRequest}
+		}
+		if *metric.Delta < 0 && !p.AllowNegativeDelta {
+			return &ValidationError{Field: "delta", Reason: "must not be negative", Err: ErrBadRequest}
+		}
+	case Gauge:
+		if metric.Value == nil {
+			return &ValidationError{Field: "value", Reason: "is required for gauge", Err: ErrBadRequest}
+		}
+		if isNonFinite(*metric.Value) && !p.AllowNonFinite {
+			return &ValidationError{Field: "value", Reason: "must be a finite number", Err: ErrBadRequest}
+		}
+	case Histogram:
+		switch {
+		case metric.Histogram != nil && metric.Value != nil:
+			return &ValidationError{Field: "value", Reason: "must not be set together with histogram", Err: ErrBadRequest}
+		case metric.Histogram != nil:
+			return metric.Histogram.validate()
+		case metric.Value != nil:
+			if isNonFinite(*metric.Value) {
+				return &ValidationError{Field: "value", Reason: "observation must be a finite number", Err: ErrBadRequest}
+			}
+		default:
+			return &ValidationError{Field: "histogram", Reason: "histogram or value is required", Err: ErrBadRequest}
+		}
+	case Summary:
+		switch {
+		case metric.Summary != nil && metric.Value != nil:
+			return &ValidationError{Field: "value", Reason: "must not be set together with summary", Err: ErrBadRequest}
+		case metric.Summary != nil:
+			return metric.Summary.validate()
+		case metric.Value != nil:
+			if isNonFinite(*metric.Value) {
+				return &ValidationError{Field: "value", Reason: "observation must be a finite number", Err: ErrBadRequest}
+			}
+		default:
+			return &ValidationError{Field: "summary", Reason: "summary or value is required", Err: ErrBadRequest}
+		}
+	case Set:
+		switch {
+		case metric.Set != nil && len(metric.Members) > 0:
+			return &ValidationError{Field: "members", Reason: "must not be set together with set", Err: ErrBadRequest}
+		case metric.Set != nil:
+			return metric.Set.validate()
+		case len(metric.Members) == 0:
+			return &ValidationError{Field: "members", Reason: "set or members is required", Err: ErrBadRequest}
+		}
+	default:
+		return &ValidationError{Field: "type", Reason: fmt.Sprintf("unknown metric type %q", metric.MType), Err: ErrNotImplemented}
+	}
+	return nil
+}
+
+// Apply вычисляет новое состояние метрики по сохранённому (nil, если метрики
+// ещё нет) и проверенному обновлению. Сохранённая метрика не изменяется.
+func (p Policy) Apply(stored *Metric, update Metric) (Metric, error) {
+	if stored != nil && late(*stored, update) {
+		switch p.LateAction(update.MType) {
+		case OutOfOrderReject:
+			return Metric{}, &ValidationError{
+				Field:  "timestamp",
+				Reason: "is older than the stored sample at " + stored.Timestamp.Format(time.RFC3339Nano),
+				Err:    ErrOutOfOrder,
+			}
+		case OutOfOrderNewer:
+			return stored.clone(), nil
+		}
+	}
+
+	result := update.clone()
+	if update.MType != Gauge && stored != nil && late(*stored, update) {
+		// накопительная метрика помнит время самого свежего сэмпла
+		ts := *stored.Timestamp
+		result.Timestamp = &ts
+	}
+	switch update.MType {
+	case Counter:
+		delta := *update.Delta
+		if stored != nil && stored.Delta != nil {
+			delta += *stored.Delta
+		}
+		result.Delta = &delta
+	case Histogram:
+		var h *HistogramValue
+		if stored != nil && stored.Histogram != nil {
+			h = stored.Histogram.clone()
+		}
+		if update.Histogram != nil {
+			if h == nil {
+				h = NewHistogram(update.Histogram.Bounds)
+			}
+			if err := h.merge(update.Histogram); err != nil {
+				return Metric{}, err
+			}
+		} else {
+			if h == nil {
+				h = NewHistogram(p.histogramBounds())
+			}
+			h.Observe(*update.Value)
+		}
+		result.Value = nil
+		result.Histogram = h
+	case Summary:
+		var sketch *SummaryValue
+		if stored != nil && stored.Summary != nil {
+			sketch = stored.Summary.clone()
+		}
+		if update.Summary != nil {
+			if sketch == nil {
+				sketch = NewSummary(update.Summary.Accuracy)
+			}
+			if err := sketch.merge(update.Summary); err != nil {
+				return Metric{}, err
+			}
+		} else {
+			if sketch == nil {
+				sketch = NewSummary(p.summaryAccuracy())
+			}
+			sketch.Observe(*update.Value)
+		}
+		result.Value = nil
+		result.Summary = sketch
+	case Set:
+		var set *SetValue
+		if stored != nil && stored.Set != nil {
+			set = stored.Set.clone()
+		}
+		if update.Set != nil {
+			if set == nil {
+				set = NewSet(update.Set.Precision)
+			}
+			if err := set.merge(update.Set); err != nil {
+				return Metric{}, err
+			}
+		} else {
+			if set == nil {
+				set = NewSet(DefaultSetPrecision)
+			}
+			set.Add(update.Members...)
+		}
+		result.Members = nil
+		result.Set = set
+	}
+	return result, nil
+}
+
+// late сообщает, что сэмпл старше сохранённого. Сэмплы без времени не считаются поздними.
+func late(stored, update Metric) bool {
+	return stored.Timestamp != nil && update.Timestamp != nil && update.Timestamp.Before(*stored.Timestamp)
+}
+
+func (p Policy) summaryAccuracy() float64 {
+	if p.SummaryAccuracy == 0 {
+		return DefaultSummaryAccuracy
+	}
+	return p.SummaryAccuracy
+}
+
+// ParseSummaryAccuracy проверяет погрешность скетчей из настроек. Ноль означает
+// погрешность по умолчанию.
+func ParseSummaryAccuracy(accuracy float64) (float64, error) {
+	if accuracy == 0 {
+		return DefaultSummaryAccuracy, nil
+	}
+	if err := validateAccuracy(accuracy); err != nil {
+		return 0, err
+	}
+	return accuracy, nil
+}
+
+func (p Policy) histogramBounds() []float64 {
+	if len(p.HistogramBounds) == 0 {
+		return DefaultHistogramBounds
+	}
+	return p.HistogramBounds
+}
+
+// Validate проверяет метрику по политике по умолчанию.
+func Validate(metric Metric) error {
+	return Policy{}.Validate(metric)
+}
+
+func isNonFinite(f float64) bool {
+	return math.IsNaN(f) || math.IsInf(f, 0)
+}
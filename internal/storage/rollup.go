@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Разрешения истории: сырые сэмплы и корзины по минуте и по часу.
+const (
+	ResolutionRaw    = "raw"
+	ResolutionMinute = "1m"
+	ResolutionHour   = "1h"
+)
+
+// RollupResolutions — разрешения, в которые агрегируется история.
+var RollupResolutions = []string{ResolutionMinute, ResolutionHour}
+
+var resolutionSteps = map[string]time.Duration{
+	ResolutionMinute: time.Minute,
+	ResolutionHour:   time.Hour,
+}
+
+// ResolutionStep возвращает шаг корзин разрешения.
+func ResolutionStep(resolution string) (time.Duration, error) {
+	step, ok := resolutionSteps[resolution]
+	if !ok {
+		return 0, &ValidationError{Field: "resolution", Reason: fmt.Sprintf("unknown resolution %q", resolution), Err: ErrBadRequest}
+	}
+	return step, nil
+}
+
+// ChooseResolution выбирает разрешение по длине запрошенного интервала.
+func ChooseResolution(from, to, now time.Time) string {
+	if from.IsZero() {
+		return ResolutionRaw
+	}
+	if to.IsZero() {
+		to = now
+	}
+	switch span := to.Sub(from); {
+	case span <= time.Hour:
+		return ResolutionRaw
+	case span <= 24*time.Hour:
+		return ResolutionMinute
+	default:
+		return ResolutionHour
+	}
+}
+
+// RollupRetention — сколько хранить корзины каждого разрешения; 0 — всегда.
+type RollupRetention map[string]time.Duration
+
+// Bucket — агрегат сэмплов ряда за [Start, Start+шаг). У gauge это Min, Max,
+// Avg и Last, у остальных типов — прирост Sum и прирост в секунду Rate.
+type Bucket struct {
+	Start time.Time `json:"start"`
+	Count int64     `json:"count"` // число учтённых сэмплов
+	Min   *float64  `json:"min,omitempty"`
+	Max   *float64  `json:"max,omitempty"`
+	Avg   *float64  `json:"avg,omitempty"`
+	Last  *float64  `json:"last,omitempty"`
+	Sum   *int64    `json:"sum,omitempty"`
+	Rate  *float64  `json:"rate,omitempty"`
+}
+
+// Aggregate — накопленное состояние корзины, из которого строится Bucket.
+// Нечисловые значения gauge в агрегаты не попадают.
+type Aggregate struct {
+	Start    time.Time
+	Count    int64
+	Min      float64
+	Max      float64
+	Total    float64   // сумма значений gauge
+	Last     float64   // значение gauge с наибольшим временем
+	LastTime time.Time // время сэмпла Last
+	Increase int64     // прирост накопительной метрики
+}
+
+// Bucket строит корзину для ответа API.
+func (a Aggregate) Bucket(metricType string, step time.Duration) Bucket {
+	b := Bucket{Start: a.Start, Count: a.Count}
+	if metricType != Gauge {
+		increase := a.Increase
+		rate := float64(a.Increase) / step.Seconds()
+		b.Sum, b.Rate = &increase, &rate
+		return b
+	}
+	if a.Count > 0 {
+		minimum, maximum, last := a.Min, a.Max, a.Last
+		avg := a.Total / float64(a.Count)
+		b.Min, b.Max, b.Avg, b.Last = &minimum, &maximum, &avg, &last
+	}
+	return b
+}
+
+func (a *Aggregate) addValue(ts time.Time, v float64) {
+	if a.Count == 0 || v < a.Min {
+		a.Min = v
+	}
+	if a.Count == 0 || v > a.Max {
+		a.Max = v
+	}
+	if a.Count == 0 || !ts.Before(a.LastTime) {
+		a.Last, a.LastTime = v, ts
+	}
+	a.Total += v
+	a.Count++
+}
+
+// rollup — корзины одного ряда во всех разрешениях.
+type rollup struct {
+	last      *Sample // последний учтённый сэмпл; его повтор не учитывается
+	lastTotal *int64  // последнее накопленное значение, от которого считается прирост
+	buckets   map[string][]Aggregate
+}
+
+// newRollup начинает корзины ряда с сохранённого состояния stored; прирост
+// нового ряда считается от нуля.
+func newRollup(stored *Metric) *rollup {
+	r := &rollup{}
+	if stored == nil {
+		return r
+	}
+	if s, ok := sampleOf(*stored); ok {
+		r.last = &s
+	}
+	if total, ok := totalOf(*stored); ok && stored.MType != Gauge {
+		r.lastTotal = &total
+	}
+	return r
+}
+
+// add учитывает сэмпл во всех разрешениях; прирост считается в порядке поступления.
+func (r *rollup) add(metricType string, s Sample) {
+	if r.last != nil && r.last.equal(s) {
+		return
+	}
+	r.last = &s
+
+	var increase int64
+	switch {
+	case metricType == Gauge:
+		if s.Value == nil || isNonFinite(*s.Value) {
+			return
+		}
+	case s.Delta == nil:
+		return
+	default:
+		increase = *s.Delta
+		if r.lastTotal != nil {
+			increase -= *r.lastTotal
+		}
+		total := *s.Delta
+		r.lastTotal = &total
+	}
+
+	if r.buckets == nil {
+		r.buckets = make(map[string][]Aggregate)
+	}
+	for _, resolution := range RollupResolutions {
+		start := s.Timestamp.Truncate(resolutionSteps[resolution])
+		buckets := r.buckets[resolution]
+		// сэмплы почти всегда попадают в последнюю корзину
+		i := sort.Search(len(buckets), func(i int) bool { return !buckets[i].Start.Before(start) })
+		if i == len(buckets) || !buckets[i].Start.Equal(start) {
+			buckets = append(buckets, Aggregate{})
+			copy(buckets[i+1:], buckets[i:])
+			buckets[i] = Aggregate{Start: start}
+		}
+		if metricType == Gauge {
+			buckets[i].addValue(s.Timestamp, *s.Value)
+		} else {
+			buckets[i].Increase += increase
+			buckets[i].Count++
+		}
+		r.buckets[resolution] = buckets
+	}
+}
+
+// expire удаляет корзины, закончившиеся раньше срока хранения.
+func (r *rollup) expire(now time.Time, retention RollupRetention) {
+	for resolution, buckets := range r.buckets {
+		keep := retention[resolution]
+		if keep <= 0 {
+			continue
+		}
+		cutoff := now.Add(-keep)
+		step := resolutionSteps[resolution]
+		i := sort.Search(len(buckets), func(i int) bool { return buckets[i].Start.Add(step).After(cutoff) })
+		r.buckets[resolution] = append(buckets[:0], buckets[i:]...)
+	}
+}
+
+func (r *rollup) between(metricType, resolution string, from, to time.Time) []Bucket {
+	step := resolutionSteps[resolution]
+	result := make([]Bucket, 0)
+	for _, a := range r.buckets[resolution] {
+		if !from.IsZero() && a.Start.Before(from.Truncate(step)) || !to.IsZero() && a.Start.After(to) {
+			continue
+		}
+		result = append(result, a.Bucket(metricType, step))
+	}
+	return result
+}
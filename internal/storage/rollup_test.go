@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRollupGauge(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mc := NewMetricCollection()
+	mc.SetHistoryLength(100)
+	mc.SetPolicy(Policy{AllowNonFinite: true})
+
+	// поздний сэмпл попадает в свою минуту, NaN в агрегаты не попадает
+	values := []struct {
+		offset time.Duration
+		value  float64
+	}{
+		{0, 3}, {20 * time.Second, 1}, {40 * time.Second, 2},
+		{60 * time.Second, 10}, {50 * time.Second, 5}, {70 * time.Second, math.NaN()},
+	}
+	for _, v := range values {
+		ts := start.Add(v.offset)
+		if _, err := mc.Update(ctx, Metric{ID: "g", MType: Gauge, Value: ptrFloat64(v.value), Timestamp: &ts}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+	if err := mc.Rollup(ctx, start, nil); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	buckets, err := mc.Rollups(ctx, Gauge, "g", nil, ResolutionMinute, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(buckets) != 2 {
+		t.Fatalf("Expected 2 buckets, got: %v", buckets)
+	}
+	first := buckets[0]
+	if first.Count != 4 || *first.Min != 1 || *first.Max != 5 || *first.Avg != 2.75 || *first.Last != 5 {
+		t.Errorf("Unexpected first bucket: %+v", first)
+	}
+	second := buckets[1]
+	if second.Count != 1 || *second.Last != 10 || second.Sum != nil {
+		t.Errorf("Unexpected second bucket: %+v", second)
+	}
+
+	hours, _ := mc.Rollups(ctx, Gauge, "g", nil, ResolutionHour, time.Time{}, time.Time{})
+	if len(hours) != 1 || hours[0].Count != 5 || *hours[0].Last != 10 {
+		t.Errorf("Unexpected hour buckets: %v", hours)
+	}
+
+	// повторный вызов не учитывает те же сэмплы дважды
+	if err := mc.Rollup(ctx, start, nil); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	hours, _ = mc.Rollups(ctx, Gauge, "g", nil, ResolutionHour, time.Time{}, time.Time{})
+	if hours[0].Count != 5 {
+		t.Errorf("Expected samples to be counted once, got: %v", hours[0].Count)
+	}
+}
+
+func TestRollupCounter(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mc := NewMetricCollection()
+	mc.SetHistoryLength(100)
+
+	for i := 0; i < 4; i++ {
+		ts := start.Add(time.Duration(i) * 30 * time.Second)
+		if _, err := mc.Update(ctx, Metric{ID: "c", MType: Counter, Delta: ptrInt64(6), Timestamp: &ts}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+	if err := mc.Rollup(ctx, start, nil); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	buckets, err := mc.Rollups(ctx, Counter, "c", nil, ResolutionMinute, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(buckets) != 2 {
+		t.Fatalf("Expected 2 buckets, got: %v", buckets)
+	}
+	// прирост нового ряда считается от нуля
+	if *buckets[0].Sum != 12 || *buckets[1].Sum != 12 || *buckets[1].Rate != 0.2 || buckets[0].Avg != nil {
+		t.Errorf("Unexpected buckets: %+v %+v", buckets[0], buckets[1])
+	}
+}
+
+func TestRollupRetention(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mc := NewMetricCollection()
+	mc.SetHistoryLength(100)
+
+	for i := 0; i < 3; i++ {
+		ts := start.Add(time.Duration(i) * time.Hour)
+		if _, err := mc.Update(ctx, Metric{ID: "g", MType: Gauge, Value: ptrFloat64(float64(i)), Timestamp: &ts}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+	retention := RollupRetention{ResolutionMinute: time.Hour}
+	if err := mc.Rollup(ctx, start.Add(150*time.Minute), retention); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	minutes, _ := mc.Rollups(ctx, Gauge, "g", nil, ResolutionMinute, time.Time{}, time.Time{})
+	if len(minutes) != 1 || !minutes[0].Start.Equal(start.Add(2*time.Hour)) {
+		t.Errorf("Expected only the last minute bucket, got: %v", minutes)
+	}
+	hours, _ := mc.Rollups(ctx, Gauge, "g", nil, ResolutionHour, time.Time{}, time.Time{})
+	if len(hours) != 3 {
+		t.Errorf("Expected hour buckets to be kept, got: %v", hours)
+	}
+
+	if _, err := mc.Rollups(ctx, Gauge, "g", nil, "5m", time.Time{}, time.Time{}); !errors.Is(err, ErrBadRequest) {
+		t.Errorf("Expected ErrBadRequest, got: %v", err)
+	}
+	if _, err := mc.Rollups(ctx, Gauge, "missing", nil, ResolutionHour, time.Time{}, time.Time{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got: %v", err)
+	}
+}
+
+func TestChooseResolution(t *testing.T) {
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		from, to time.Time
+		want     string
+	}{
+		{time.Time{}, time.Time{}, ResolutionRaw},
+		{now.Add(-30 * time.Minute), time.Time{}, ResolutionRaw},
+		{now.Add(-6 * time.Hour), now, ResolutionMinute},
+		{now.Add(-72 * time.Hour), time.Time{}, ResolutionHour},
+	}
+	for _, tt := range tests {
+		if got := ChooseResolution(tt.from, tt.to, now); got != tt.want {
+			t.Errorf("ChooseResolution(%v, %v) = %q, want %q", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestRollupBeyondHistory(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mc := NewMetricCollection()
+	mc.SetHistoryLength(2)
+
+	// буфер вмещает два сэмпла, корзины получают все пять
+	for i := 0; i < 5; i++ {
+		ts := start.Add(time.Duration(i) * 10 * time.Second)
+		if _, err := mc.Update(ctx, Metric{ID: "g", MType: Gauge, Value: ptrFloat64(float64(i)), Timestamp: &ts}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+	if err := mc.Rollup(ctx, start, nil); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	buckets, err := mc.Rollups(ctx, Gauge, "g", nil, ResolutionMinute, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(buckets) != 1 || buckets[0].Count != 5 || *buckets[0].Min != 0 || *buckets[0].Avg != 2 {
+		t.Errorf("Expected evicted samples to be counted, got: %+v", buckets)
+	}
+}
+
+func TestRollupWithoutHistory(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	stored := start.Add(-time.Hour)
+	// прирост восстановленного ряда считается от сохранённого значения
+	mc := NewMetricCollection(Metric{ID: "c", MType: Counter, Delta: ptrInt64(100), Timestamp: &stored})
+
+	for i := 0; i < 3; i++ {
+		ts := start.Add(time.Duration(i) * 10 * time.Second)
+		if _, err := mc.Update(ctx, Metric{ID: "c", MType: Counter, Delta: ptrInt64(5), Timestamp: &ts}); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+
+	buckets, err := mc.Rollups(ctx, Counter, "c", nil, ResolutionMinute, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(buckets) != 1 || buckets[0].Count != 3 || *buckets[0].Sum != 15 {
+		t.Errorf("Expected rollups to be fed without history, got: %+v", buckets)
+	}
+	if samples, err := mc.History(ctx, Counter, "c", nil, time.Time{}, time.Time{}); err != nil || len(samples) != 0 {
+		t.Errorf("Expected no history, got: %v, %v", samples, err)
+	}
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// DefaultSetPrecision — точность новых скетчей set: 2^12 регистров дают
+// стандартную ошибку оценки около 1,6%.
+const DefaultSetPrecision = 12
+
+const (
+	minSetPrecision = 4
+	maxSetPrecision = 16
+)
+
+// SetValue — скетч HyperLogLog для приблизительного подсчёта уникальных элементов.
+// Скетчи с одной точностью объединяются максимумом регистров.
+type SetValue struct {
+	Precision uint8  `json:"precision"` // число регистров — 2^Precision
+	Registers []byte `json:"registers"` // в JSON кодируются в base64
+	Count     uint64 `json:"count"`     // оценка числа уникальных элементов, вычисляется сервером
+}
+
+// NewSet возвращает пустой скетч с заданной точностью.
+func NewSet(precision uint8) *SetValue {
+	return &SetValue{
+		Precision: precision,
+		Registers: make([]byte, 1<<precision),
+	}
+}
+
+// validate проверяет согласованность скетча, пришедшего от клиента.
+func (s *SetValue) validate() error {
+	if s.Precision < minSetPrecision || s.Precision > maxSetPrecision {
+		return &ValidationError{
+			Field:  "set.precision",
+			Reason: fmt.Sprintf("must be between %d and %d", minSetPrecision, maxSetPrecision),
+			Err:    ErrBadRequest,
+		}
+	}
+	if len(s.Registers) != 1<<s.Precision {
+		return &ValidationError{Field: "set.registers", Reason: "length must be 2^precision", Err: ErrBadRequest}
+	}
+	maxRank := byte(64 - s.Precision + 1)
+	for _, r := range s.Registers {
+		if r > maxRank {
+			return &ValidationError{Field: "set.registers", Reason: "register value is out of range", Err: ErrBadRequest}
+		}
+	}
+	return nil
+}
+
+func (s *SetValue) clone() *SetValue {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	c.Registers = append([]byte(nil), s.Registers...)
+	return &c
+}
+
+// hashMember — FNV-1a с перемешиванием из splitmix64.
+func hashMember(member string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(member))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Add учитывает элементы и обновляет оценку.
+func (s *SetValue) Add(members ...string) {
+	for _, member := range members {
+		x := hashMember(member)
+		i := x >> (64 - s.Precision)
+		rank := byte(bits.LeadingZeros64(x<<s.Precision|1<<(s.Precision-1)) + 1)
+		if rank > s.Registers[i] {
+			s.Registers[i] = rank
+		}
+	}
+	s.Count = s.estimate()
+}
+
+// merge объединяет скетч с другим той же точности.
+func (s *SetValue) merge(other *SetValue) error {
+	if s.Precision != other.Precision {
+		return &ValidationError{Field: "set.precision", Reason: "differs from the stored set", Err: ErrBadRequest}
+	}
+	for i, r := range other.Registers {
+		if r > s.Registers[i] {
+			s.Registers[i] = r
+		}
+	}
+	s.Count = s.estimate()
+	return nil
+}
+
+func (s *SetValue) estimate() uint64 {
+	m := float64(len(s.Registers))
+	var alpha float64
+	switch len(s.Registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+
+	sum := 0.0
+	zeros := 0
+	for _, r := range s.Registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := alpha * m * m / sum
+	// на малых мощностях точнее линейный подсчёт по пустым регистрам
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(estimate))
+}
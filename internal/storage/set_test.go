@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestSetEstimate(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 1000, 100000} {
+		set := NewSet(DefaultSetPrecision)
+		members := make([]string, 0, 2*n)
+		for i := 0; i < n; i++ {
+			// повторы не меняют оценку
+			members = append(members, fmt.Sprintf("user-%d", i), fmt.Sprintf("user-%d", i/2))
+		}
+		set.Add(members...)
+		if n == 0 {
+			if set.Count != 0 {
+				t.Errorf("Expected 0, got %d", set.Count)
+			}
+			continue
+		}
+		// допуск — четыре стандартные ошибки 1.04/sqrt(m)
+		tolerance := 4 * 1.04 / math.Sqrt(float64(len(set.Registers)))
+		if math.Abs(float64(set.Count)-float64(n)) > tolerance*float64(n)+1 {
+			t.Errorf("Expected about %d, got %d", n, set.Count)
+		}
+	}
+}
+
+func TestSetMerge(t *testing.T) {
+	first := NewSet(10)
+	second := NewSet(10)
+	whole := NewSet(10)
+	var members []string
+	for i := 0; i < 5000; i++ {
+		members = append(members, fmt.Sprintf("host-%d", i))
+	}
+	whole.Add(members...)
+	first.Add(members[:3000]...)
+	second.Add(members[2000:]...)
+	if err := first.merge(second); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if first.Count != whole.Count {
+		t.Errorf("Expected merged estimate %d, got %d", whole.Count, first.Count)
+	}
+	if err := first.merge(NewSet(11)); !errors.Is(err, ErrBadRequest) {
+		t.Errorf("Expected ErrBadRequest for different precision, got: %v", err)
+	}
+}
+
+func TestMetricCollection_Set(t *testing.T) {
+	ctx := context.Background()
+	mc := NewMetricCollection()
+
+	result, err := mc.UpdateBatch(ctx, []Metric{
+		{ID: "users", MType: Set, Members: []string{"alice", "bob"}},
+		{ID: "users", MType: Set, Members: []string{"bob", "carol"}},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if result[1].Set.Count != 3 || result[1].Members != nil {
+		t.Errorf("Unexpected set: %+v", result[1])
+	}
+
+	if _, err := mc.Update(ctx, Metric{ID: "users", MType: Set}); !errors.Is(err, ErrBadRequest) {
+		t.Errorf("Expected ErrBadRequest without members, got: %v", err)
+	}
+	broken := NewSet(DefaultSetPrecision)
+	broken.Registers = broken.Registers[:10]
+	if _, err := mc.Update(ctx, Metric{ID: "users", MType: Set, Set: broken}); !errors.Is(err, ErrBadRequest) {
+		t.Errorf("Expected ErrBadRequest for broken registers, got: %v", err)
+	}
+}
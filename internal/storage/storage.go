@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// Storage — хранилище метрик, которое получают обработчики, агент и механизм сохранения.
+type Storage interface {
+	// Update сохраняет метрику и возвращает её итоговое состояние.
+	Update(ctx context.Context, metric Metric) (Metric, error)
+	// UpdateBatch сохраняет набор метрик и возвращает их итоговые состояния.
+	// Повторы одной метрики получают её состояние после всего набора.
+	UpdateBatch(ctx context.Context, metrics []Metric) ([]Metric, error)
+	// Get возвращает ряд с точно такими метками; nil — ряд без меток.
+	Get(ctx context.Context, metricType, metricName string, labels Labels) (Metric, error)
+	// List возвращает ряды, подходящие под все матчеры.
+	List(ctx context.Context, matchers ...*Matcher) ([]Metric, error)
+	Delete(ctx context.Context, metricType, metricName string, labels Labels) error
+	// History возвращает сохранённые сэмплы ряда из [from, to] по возрастанию
+	// времени. Нулевая граница интервал не ограничивает.
+	History(ctx context.Context, metricType, metricName string, labels Labels, from, to time.Time) ([]Sample, error)
+	// Rollups возвращает агрегированную историю ряда из [from, to] в разрешении
+	// ResolutionMinute или ResolutionHour.
+	Rollups(ctx context.Context, metricType, metricName string, labels Labels, resolution string, from, to time.Time) ([]Bucket, error)
+	// Validate проверяет метрику по правилам хранилища, не сохраняя её.
+	Validate(metric Metric) error
+}
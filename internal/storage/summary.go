@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// DefaultSummaryAccuracy — относительная погрешность квантилей по умолчанию.
+const DefaultSummaryAccuracy = 0.01
+
+// maxSummaryBins ограничивает размер присланного скетча.
+const maxSummaryBins = 4096
+
+// SummaryValue — скетч DDSketch: квантили с относительной погрешностью не больше α.
+// Скетчи с одинаковой α складываются покорзинно без потери точности.
+type SummaryValue struct {
+	Accuracy  float64          `json:"accuracy"`           // относительная погрешность α
+	Positive  map[int32]uint64 `json:"positive,omitempty"` // корзины положительных наблюдений
+	Negative  map[int32]uint64 `json:"negative,omitempty"` // корзины модулей отрицательных наблюдений
+	ZeroCount uint64           `json:"zero_count"`         // число нулевых наблюдений
+	Count     uint64           `json:"count"`              // общее число наблюдений
+	Sum       float64          `json:"sum"`                // сумма наблюдений
+	Min       float64          `json:"min"`
+	Max       float64          `json:"max"`
+}
+
+// Quantile — значение квантиля в ответе API.
+type Quantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// DefaultQuantiles возвращаются, если клиент не запросил квантили явно.
+var DefaultQuantiles = []float64{0.5, 0.9, 0.95, 0.99}
+
+// NewSummary возвращает пустой скетч с заданной относительной погрешностью.
+func NewSummary(accuracy float64) *SummaryValue {
+	return &SummaryValue{Accuracy: accuracy}
+}
+
+func validateAccuracy(accuracy float64) error {
+	if !(accuracy > 0 && accuracy < 1) {
+		return fmt.Errorf("summary accuracy %v must be in (0, 1)", accuracy)
+	}
+	return nil
+}
+
+// validate проверяет согласованность скетча, пришедшего от клиента.
+func (s *SummaryValue) validate() error {
+	if err := validateAccuracy(s.Accuracy); err != nil {
+		return &ValidationError{Field: "summary.accuracy", Reason: err.Error(), Err: ErrBadRequest}
+	}
+	if len(s.Positive)+len(s.Negative) > maxSummaryBins {
+		return &ValidationError{Field: "summary", Reason: fmt.Sprintf("must not have more than %d bins", maxSummaryBins), Err: ErrBadRequest}
+	}
+	total := s.ZeroCount
+	for _, c := range s.Positive {
+		total += c
+	}
+	for _, c := range s.Negative {
+		total += c
+	}
+	if total != s.Count {
+		return &ValidationError{Field: "summary.count", Reason: "must equal the sum of bin counts", Err: ErrBadRequest}
+	}
+	if isNonFinite(s.Sum) || isNonFinite(s.Min) || isNonFinite(s.Max) {
+		return &ValidationError{Field: "summary", Reason: "sum, min and max must be finite", Err: ErrBadRequest}
+	}
+	if s.Count > 0 && s.Min > s.Max {
+		return &ValidationError{Field: "summary.min", Reason: "must not exceed max", Err: ErrBadRequest}
+	}
+	return nil
+}
+
+func (s *SummaryValue) clone() *SummaryValue {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	c.Positive = cloneBins(s.Positive)
+	c.Negative = cloneBins(s.Negative)
+	return &c
+}
+
+func cloneBins(bins map[int32]uint64) map[int32]uint64 {
+	if bins == nil {
+		return nil
+	}
+	c := make(map[int32]uint64, len(bins))
+	for i, n := range bins {
+		c[i] = n
+	}
+	return c
+}
+
+func (s *SummaryValue) gamma() float64 {
+	return (1 + s.Accuracy) / (1 - s.Accuracy)
+}
+
+func (s *SummaryValue) index(v float64) int32 {
+	return int32(math.Ceil(math.Log(v) / math.Log(s.gamma())))
+}
+
+// value — представитель корзины, отстоящий от её границ не больше чем на α.
+func (s *SummaryValue) value(i int32) float64 {
+	g := s.gamma()
+	return 2 * math.Pow(g, float64(i)) / (g + 1)
+}
+
+// Observe добавляет одно наблюдение.
+func (s *SummaryValue) Observe(v float64) {
+	switch {
+	case v > 0:
+		if s.Positive == nil {
+			s.Positive = make(map[int32]uint64)
+		}
+		s.Positive[s.index(v)]++
+	case v < 0:
+		if s.Negative == nil {
+			s.Negative = make(map[int32]uint64)
+		}
+		s.Negative[s.index(-v)]++
+	default:
+		s.ZeroCount++
+	}
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Count++
+	s.Sum += v
+}
+
+// merge прибавляет к скетчу другой с той же погрешностью.
+func (s *SummaryValue) merge(other *SummaryValue) error {
+	if s.Accuracy != other.Accuracy {
+		return &ValidationError{Field: "summary.accuracy", Reason: "differs from the stored summary", Err: ErrBadRequest}
+	}
+	if other.Count == 0 {
+		return nil
+	}
+	for i, n := range other.Positive {
+		if s.Positive == nil {
+			s.Positive = make(map[int32]uint64)
+		}
+		s.Positive[i] += n
+	}
+	for i, n := range other.Negative {
+		if s.Negative == nil {
+			s.Negative = make(map[int32]uint64)
+		}
+		s.Negative[i] += n
+	}
+	if s.Count == 0 || other.Min < s.Min {
+		s.Min = other.Min
+	}
+	if s.Count == 0 || other.Max > s.Max {
+		s.Max = other.Max
+	}
+	s.ZeroCount += other.ZeroCount
+	s.Count += other.Count
+	s.Sum += other.Sum
+	return nil
+}
+
+// Quantile оценивает квантиль q из [0, 1]. Для пустого скетча возвращает false.
+func (s *SummaryValue) Quantile(q float64) (float64, bool) {
+	if s.Count == 0 {
+		return 0, false
+	}
+	rank := uint64(q * float64(s.Count-1))
+
+	// отрицательные наблюдения по возрастанию — корзины модулей по убыванию
+	var seen uint64
+	negative := sortedBins(s.Negative)
+	for i := len(negative) - 1; i >= 0; i-- {
+		seen += s.Negative[negative[i]]
+		if seen > rank {
+			return s.clamp(-s.value(negative[i])), true
+		}
+	}
+	seen += s.ZeroCount
+	if seen > rank {
+		return 0, true
+	}
+	for _, i := range sortedBins(s.Positive) {
+		seen += s.Positive[i]
+		if seen > rank {
+			return s.clamp(s.value(i)), true
+		}
+	}
+	return s.Max, true
+}
+
+// Quantiles оценивает несколько квантилей сразу.
+func (s *SummaryValue) Quantiles(qs []float64) []Quantile {
+	result := make([]Quantile, 0, len(qs))
+	for _, q := range qs {
+		if v, ok := s.Quantile(q); ok {
+			result = append(result, Quantile{Quantile: q, Value: v})
+		}
+	}
+	return result
+}
+
+// clamp не даёт оценке выйти за наблюдавшийся диапазон.
+func (s *SummaryValue) clamp(v float64) float64 {
+	return math.Max(s.Min, math.Min(s.Max, v))
+}
+
+func sortedBins(bins map[int32]uint64) []int32 {
+	keys := make([]int32, 0, len(bins))
+	for i := range bins {
+		keys = append(keys, i)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestSummaryQuantileAccuracy(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	values := make([]float64, 10000)
+	sketch := NewSummary(0.01)
+	for i := range values {
+		values[i] = rnd.ExpFloat64()*100 - 20
+		sketch.Observe(values[i])
+	}
+	sort.Float64s(values)
+
+	for _, q := range []float64{0, 0.1, 0.5, 0.9, 0.95, 0.99, 1} {
+		expected := values[int(q*float64(len(values)-1))]
+		actual, ok := sketch.Quantile(q)
+		if !ok {
+			t.Fatalf("Expected quantile %g", q)
+		}
+		if math.Abs(actual-expected) > 0.01*math.Abs(expected)+1e-9 {
+			t.Errorf("Quantile %g: expected %g within 1%%, got %g", q, expected, actual)
+		}
+	}
+}
+
+func TestSummaryMerge(t *testing.T) {
+	whole := NewSummary(0.02)
+	first := NewSummary(0.02)
+	second := NewSummary(0.02)
+	for i := -50; i < 150; i++ {
+		v := float64(i) / 3
+		whole.Observe(v)
+		if i%2 == 0 {
+			first.Observe(v)
+		} else {
+			second.Observe(v)
+		}
+	}
+	if err := first.merge(second); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	for _, q := range DefaultQuantiles {
+		expected, _ := whole.Quantile(q)
+		actual, _ := first.Quantile(q)
+		if expected != actual {
+			t.Errorf("Quantile %g: expected %g, got %g", q, expected, actual)
+		}
+	}
+	if first.Count != whole.Count || first.Min != whole.Min || first.Max != whole.Max {
+		t.Errorf("Unexpected merged summary: %+v", first)
+	}
+
+	if err := first.merge(NewSummary(0.01)); !errors.Is(err, ErrBadRequest) {
+		t.Errorf("Expected ErrBadRequest for different accuracy, got: %v", err)
+	}
+}
+
+func TestMetricCollection_Summary(t *testing.T) {
+	ctx := context.Background()
+	mc := NewMetricCollection()
+
+	agent := NewSummary(DefaultSummaryAccuracy)
+	agent.Observe(10)
+	agent.Observe(20)
+	if _, err := mc.Update(ctx, Metric{ID: "latency", MType: Summary, Summary: agent}); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	result, err := mc.Update(ctx, Metric{ID: "latency", MType: Summary, Value: ptrFloat64(30)})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if result.Summary.Count != 3 || result.Summary.Sum != 60 || result.Summary.Max != 30 {
+		t.Errorf("Unexpected summary: %+v", result.Summary)
+	}
+	if agent.Count != 2 {
+		t.Errorf("Expected sent sketch to be unchanged, got count: %d", agent.Count)
+	}
+
+	_, err = mc.Update(ctx, Metric{ID: "latency", MType: Summary, Summary: &SummaryValue{Accuracy: 0.01, ZeroCount: 1, Count: 2}})
+	if !errors.Is(err, ErrBadRequest) {
+		t.Errorf("Expected ErrBadRequest for inconsistent count, got: %v", err)
+	}
+}
@@ -3,12 +3,18 @@ package storager
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/avast/retry-go"
 	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/lib/pq"
 
 	"github.com/sersus/go-yandex-metrics/internal/config"
@@ -16,150 +22,860 @@ import (
 	"github.com/sersus/go-yandex-metrics/internal/storage"
 )
 
+const (
+	metricColumns      = `id, mtype, labels, delta, mvalue, histogram, summary, hll, ts`
+	selectMetricsQuery = `select ` + metricColumns + ` from metrics`
+	// в updateGaugeQuery и updateCounterQuery подставляется lateCondition или пустая строка
+	updateGaugeQuery = `insert into metrics (id, mtype, labels, labels_key, mvalue, ts) values ($1, $2, $3, $4, $5, $6)
+		on conflict (id, mtype, labels_key) do update set mvalue = excluded.mvalue, ts = excluded.ts%s
+		returning ` + metricColumns
+	// счётчик увеличивается в самой базе, поэтому реплики сервера не теряют инкременты друг друга
+	updateCounterQuery = `insert into metrics (id, mtype, labels, labels_key, delta, ts) values ($1, $2, $3, $4, $5, $6)
+		on conflict (id, mtype, labels_key) do update set delta = metrics.delta + excluded.delta, ts = greatest(metrics.ts, excluded.ts)%s
+		returning ` + metricColumns
+	// гистограмма, summary и set лежат в jsonb-колонках из mergedColumns
+	updateMergedQuery = `insert into metrics (id, mtype, labels, labels_key, %[1]s, ts) values ($1, $2, $3, $4, $5, $6)
+		on conflict (id, mtype, labels_key) do update set %[1]s = excluded.%[1]s, ts = excluded.ts
+		returning ` + metricColumns
+	// lateCondition не даёт обновить строку сэмплом старше сохранённого;
+	// такой сэмпл не попадает в returning
+	lateCondition = ` where metrics.ts is null or metrics.ts <= excluded.ts`
+	// ряд однозначно определяется именем, типом и канонической записью меток
+	seriesCondition = ` where mtype = $1 and id = $2 and labels_key = $3`
+)
+
+// mergedColumns — колонки метрик, которые складываются с сохранёнными в Go, а не в SQL.
+var mergedColumns = map[string]string{
+	storage.Histogram: "histogram",
+	storage.Summary:   "summary",
+	storage.Set:       "hll",
+}
+
+func mergedType(metricType string) bool {
+	_, ok := mergedColumns[metricType]
+	return ok
+}
+
+// dbsaver хранит метрики непосредственно в Postgres: и запись, и чтение идут в базу.
 type dbsaver struct {
-	db *sql.DB
+	db     *sql.DB
+	policy storage.Policy
+	// historyLength ограничивает число сэмплов в ответе History
+	historyLength int
 }
 
+var _ storage.Storage = (*dbsaver)(nil)
+
 func isRetriableError(err error) bool {
-	pqErr, ok := err.(*pq.Error)
-	if !ok {
-		return false
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgerrcode.IsConnectionException(pgErr.Code)
 	}
-	return pgerrcode.IsConnectionException(string(pqErr.Code))
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pgerrcode.IsConnectionException(string(pqErr.Code))
+	}
+	return false
 }
 
-func (m *dbsaver) Restore(ctx context.Context) ([]storage.Metric, error) {
+// withRetry повторяет операцию, если база недоступна из-за проблем с соединением.
+func withRetry(ctx context.Context, operation func() error) error {
+	return retry.Do(
+		operation,
+		retry.Context(ctx),
+		retry.DelayType(retry.BackOffDelay),
+		retry.Delay(1*time.Second),
+		retry.MaxDelay(5*time.Second),
+		retry.Attempts(3),
+		retry.LastErrorOnly(true),
+		retry.OnRetry(func(n uint, err error) {
+			log.Printf("Retry #%d, error: %s\n", n, err)
+		}),
+		retry.RetryIf(isRetriableError),
+	)
+}
 
-	var metrics []storage.Metric
-	restoreOperation := func() error {
-		const query = `select id, mtype, delta, mvalue from metrics`
-		rows, err := m.db.QueryContext(ctx, query)
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMetric(row rowScanner) (storage.Metric, error) {
+	var (
+		metric          storage.Metric
+		deltaFromDB     sql.NullInt64
+		valueFromDB     sql.NullFloat64
+		labelsFromDB    []byte
+		histogramFromDB []byte
+		summaryFromDB   []byte
+		setFromDB       []byte
+		tsFromDB        sql.NullTime
+	)
+	if err := row.Scan(&metric.ID, &metric.MType, &labelsFromDB, &deltaFromDB, &valueFromDB, &histogramFromDB, &summaryFromDB, &setFromDB, &tsFromDB); err != nil {
+		return storage.Metric{}, err
+	}
+	if tsFromDB.Valid {
+		ts := tsFromDB.Time.UTC()
+		metric.Timestamp = &ts
+	}
+	if err := json.Unmarshal(labelsFromDB, &metric.Labels); err != nil {
+		return storage.Metric{}, fmt.Errorf("error while decoding labels of %q: %w", metric.ID, err)
+	}
+	if len(metric.Labels) == 0 {
+		metric.Labels = nil
+	}
+	if histogramFromDB != nil {
+		if err := json.Unmarshal(histogramFromDB, &metric.Histogram); err != nil {
+			return storage.Metric{}, fmt.Errorf("error while decoding histogram %q: %w", metric.ID, err)
+		}
+	}
+	if summaryFromDB != nil {
+		if err := json.Unmarshal(summaryFromDB, &metric.Summary); err != nil {
+			return storage.Metric{}, fmt.Errorf("error while decoding summary %q: %w", metric.ID, err)
+		}
+	}
+	if setFromDB != nil {
+		if err := json.Unmarshal(setFromDB, &metric.Set); err != nil {
+			return storage.Metric{}, fmt.Errorf("error while decoding set %q: %w", metric.ID, err)
+		}
+	}
+	if deltaFromDB.Valid {
+		metric.Delta = &deltaFromDB.Int64
+	}
+	if valueFromDB.Valid {
+		metric.Value = &valueFromDB.Float64
+	}
+	return metric, nil
+}
+
+// querier реализуют как *sql.DB, так и *sql.Tx.
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// labelsJSON кодирует метки для колонки labels; у ряда без меток там пустой объект.
+func labelsJSON(labels storage.Labels) []byte {
+	if len(labels) == 0 {
+		return []byte("{}")
+	}
+	data, _ := json.Marshal(labels)
+	return data
+}
+
+// lateFilter возвращает условие для upsert, если поздние сэмплы этого типа
+// нельзя применять как обычные.
+func (m *dbsaver) lateFilter(metricType string) string {
+	if m.policy.LateAction(metricType) == storage.OutOfOrderAccept {
+		return ""
+	}
+	return lateCondition
+}
+
+// lateSample обрабатывает сэмпл, который база не применила как более старый.
+func (m *dbsaver) lateSample(ctx context.Context, q querier, metric storage.Metric) (storage.Metric, error) {
+	stored, err := scanMetric(q.QueryRowContext(ctx, selectMetricsQuery+seriesCondition, metric.MType, metric.ID, metric.Labels.Key()))
+	if err != nil {
+		return storage.Metric{}, fmt.Errorf("error while trying to read %s metric %q: %w", metric.MType, metric.ID, err)
+	}
+	return m.policy.Apply(&stored, metric)
+}
+
+func (m *dbsaver) updateMetric(ctx context.Context, q querier, metric storage.Metric) (storage.Metric, error) {
+	var row *sql.Row
+	labels, labelsKey := labelsJSON(metric.Labels), metric.Labels.Key()
+	switch metric.MType {
+	case storage.Gauge:
+		query := fmt.Sprintf(updateGaugeQuery, m.lateFilter(metric.MType))
+		row = q.QueryRowContext(ctx, query, metric.ID, metric.MType, labels, labelsKey, *metric.Value, metric.Timestamp)
+	case storage.Counter:
+		query := fmt.Sprintf(updateCounterQuery, m.lateFilter(metric.MType))
+		row = q.QueryRowContext(ctx, query, metric.ID, metric.MType, labels, labelsKey, *metric.Delta, metric.Timestamp)
+	default:
+		return storage.Metric{}, storage.ErrNotImplemented
+	}
+	result, err := scanMetric(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return m.lateSample(ctx, q, metric)
+	}
+	if err != nil {
+		return storage.Metric{}, fmt.Errorf("error while trying to update %s metric %q: %w", metric.MType, metric.ID, err)
+	}
+	return result, nil
+}
+
+func (m *dbsaver) Validate(metric storage.Metric) error {
+	return m.policy.Validate(metric)
+}
+
+func (m *dbsaver) Update(ctx context.Context, metric storage.Metric) (storage.Metric, error) {
+	if err := m.Validate(metric); err != nil {
+		return storage.Metric{}, err
+	}
+	metric = m.policy.Stamp(metric)
+	if mergedType(metric.MType) {
+		states, err := m.updateInTx(ctx, []storage.Metric{metric})
+		if err != nil {
+			return storage.Metric{}, err
+		}
+		return states[batchKey(metric)], nil
+	}
+	var result storage.Metric
+	err := withRetry(ctx, func() error {
+		var err error
+		result, err = m.updateMetric(ctx, m.db, metric)
+		return err
+	})
+	return result, err
+}
+
+// updateInTx применяет набор метрик в одной транзакции с повторами при сбоях соединения.
+func (m *dbsaver) updateInTx(ctx context.Context, metrics []storage.Metric) (map[string]storage.Metric, error) {
+	merged, err := mergeBatch(metrics, m.policy)
+	if err != nil {
+		return nil, err
+	}
+	var states map[string]storage.Metric
+	err = withRetry(ctx, func() error {
+		var err error
+		states, err = m.upsertInTx(ctx, merged, true)
+		return err
+	})
+	return states, err
+}
+
+// UpdateBatch применяет весь набор в одной транзакции: либо все метрики, либо ни одной.
+// Повторы одной метрики получают её состояние после всего набора.
+func (m *dbsaver) UpdateBatch(ctx context.Context, metrics []storage.Metric) ([]storage.Metric, error) {
+	stamped := make([]storage.Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		if err := m.Validate(metric); err != nil {
+			return nil, err
+		}
+		stamped = append(stamped, m.policy.Stamp(metric))
+	}
+
+	states, err := m.updateInTx(ctx, stamped)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]storage.Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		results = append(results, states[batchKey(metric)])
+	}
+	return results, nil
+}
+
+func (m *dbsaver) Get(ctx context.Context, metricType, metricName string, labels storage.Labels) (storage.Metric, error) {
+	var result storage.Metric
+	err := withRetry(ctx, func() error {
+		var err error
+		row := m.db.QueryRowContext(ctx, selectMetricsQuery+seriesCondition, metricType, metricName, labels.Key())
+		result, err = scanMetric(row)
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.Metric{}, storage.ErrNotFound
+	}
+	if err != nil {
+		return storage.Metric{}, fmt.Errorf("error while trying to get metric %q: %w", metricName, err)
+	}
+	return result, nil
+}
+
+// List отбирает ряды в базе по матчерам на равенство, остальные проверяет в Go.
+func (m *dbsaver) List(ctx context.Context, matchers ...*storage.Matcher) ([]storage.Metric, error) {
+	if len(matchers) == 0 {
+		return m.Restore(ctx)
+	}
+
+	var (
+		conditions []string
+		args       []any
+	)
+	equal := make(storage.Labels)
+	for _, matcher := range matchers {
+		if matcher.Type != storage.MatchEqual {
+			continue
+		}
+		if matcher.Name == storage.NameLabel {
+			args = append(args, matcher.Value)
+			conditions = append(conditions, fmt.Sprintf("id = $%d", len(args)))
+			continue
+		}
+		equal[matcher.Name] = matcher.Value
+	}
+	if len(equal) > 0 {
+		args = append(args, labelsJSON(equal))
+		conditions = append(conditions, fmt.Sprintf("labels @> $%d", len(args)))
+	}
+	query := selectMetricsQuery
+	if len(conditions) > 0 {
+		query += ` where ` + strings.Join(conditions, " and ")
+	}
+
+	metrics, err := m.query(ctx, query+` order by mtype, id, labels_key`, args...)
+	if err != nil {
+		return nil, err
+	}
+	filtered := metrics[:0]
+	for _, metric := range metrics {
+		if storage.MatchAll(metric, matchers) {
+			filtered = append(filtered, metric)
+		}
+	}
+	return filtered, nil
+}
+
+// History читает не больше historyLength последних сэмплов из metric_history.
+func (m *dbsaver) History(ctx context.Context, metricType, metricName string, labels storage.Labels, from, to time.Time) ([]storage.Sample, error) {
+	if _, err := m.Get(ctx, metricType, metricName, labels); err != nil {
+		return nil, err
+	}
+	if m.historyLength <= 0 {
+		return []storage.Sample{}, nil
+	}
+
+	// nil в параметрах снимает соответствующее ограничение
+	var (
+		samples        []storage.Sample
+		fromArg, toArg any
+	)
+	if !from.IsZero() {
+		fromArg = from
+	}
+	if !to.IsZero() {
+		toArg = to
+	}
+	err := withRetry(ctx, func() error {
+		samples = samples[:0]
+		rows, err := m.db.QueryContext(ctx, `select ts, delta, mvalue from metric_history
+			where mtype = $1 and id = $2 and labels_key = $3
+				and ($4::timestamptz is null or ts >= $4) and ($5::timestamptz is null or ts <= $5)
+			order by ts desc limit $6`,
+			metricType, metricName, labels.Key(), fromArg, toArg, m.historyLength)
 		if err != nil {
 			return err
 		}
 		defer rows.Close()
 
-		//var metrics []storage.Metric
 		for rows.Next() {
 			var (
-				id          string
-				mtype       string
-				deltaFromDB sql.NullInt64
-				valueFromDB sql.NullFloat64
+				sample storage.Sample
+				delta  sql.NullInt64
+				value  sql.NullFloat64
 			)
-			if err := rows.Scan(&id, &mtype, &deltaFromDB, &valueFromDB); err != nil {
+			if err := rows.Scan(&sample.Timestamp, &delta, &value); err != nil {
+				return err
+			}
+			sample.Timestamp = sample.Timestamp.UTC()
+			if delta.Valid {
+				sample.Delta = &delta.Int64
+			}
+			if value.Valid {
+				sample.Value = &value.Float64
+			}
+			samples = append(samples, sample)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to read history of metric %q: %w", metricName, err)
+	}
+	// строки читались от новых к старым, чтобы limit оставил последние
+	for i, j := 0, len(samples)-1; i < j; i, j = i+1, j-1 {
+		samples[i], samples[j] = samples[j], samples[i]
+	}
+	return samples, nil
+}
+
+// Prune удаляет ряды, которые сервер не записывал с before, и более старые сэмплы,
+// а историю каждого ряда обрезает до historyLength сэмплов. Без истории
+// удаляются сэмплы, уже учтённые в корзинах.
+func (m *dbsaver) Prune(ctx context.Context, before time.Time) ([]storage.Metric, error) {
+	var removed []storage.Metric
+	err := withRetry(ctx, func() error {
+		removed = removed[:0]
+		if !before.IsZero() {
+			rows, err := m.db.QueryContext(ctx, `delete from metrics where updated_at < $1 returning `+metricColumns, before)
+			if err != nil {
 				return err
 			}
-			var delta *int64
-			if deltaFromDB.Valid {
-				delta = &deltaFromDB.Int64
+			defer rows.Close()
+			for rows.Next() {
+				metric, err := scanMetric(rows)
+				if err != nil {
+					return err
+				}
+				removed = append(removed, metric)
 			}
-			var mvalue *float64
-			if valueFromDB.Valid {
-				mvalue = &valueFromDB.Float64
+			if err := rows.Err(); err != nil {
+				return err
 			}
-			metric := storage.Metric{
-				ID:    id,
-				MType: mtype,
-				Delta: delta,
-				Value: mvalue,
+			if _, err := m.db.ExecContext(ctx, `delete from metric_history where ts < $1`, before); err != nil {
+				return err
 			}
-			metrics = append(metrics, metric)
 		}
-		if err := rows.Err(); err != nil {
+		if m.historyLength <= 0 {
+			// без истории сэмплы нужны только агрегации, пока она их не учла
+			_, err := m.db.ExecContext(ctx, `delete from metric_history where seq <= least(
+				coalesce((select seq from rollup_state where resolution = $1), 0),
+				coalesce((select seq from rollup_state where resolution = $2), 0))`,
+				storage.ResolutionMinute, storage.ResolutionHour)
 			return err
 		}
-		return nil
+		// граница каждого ряда находится по индексу ряда, без сортировки всей истории
+		_, err := m.db.ExecContext(ctx, `delete from metric_history h
+			using metrics m, lateral (
+				select ts from metric_history
+				where mtype = m.mtype and id = m.id and labels_key = m.labels_key
+				order by ts desc offset $1 - 1 limit 1
+			) cutoff
+			where h.mtype = m.mtype and h.id = m.id and h.labels_key = m.labels_key and h.ts < cutoff.ts`,
+			m.historyLength)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to prune metrics: %w", err)
 	}
-	opts := []retry.Option{
-		retry.DelayType(retry.BackOffDelay),
-		retry.Delay(1 * time.Second),
-		retry.MaxDelay(5 * time.Second),
-		retry.Attempts(3),
-		retry.OnRetry(func(n uint, err error) {
-			log.Printf("Retry #%d, error: %s\n", n, err)
-		}),
+	return removed, nil
+}
+
+// Rollup переносит в metric_rollups новые сэмплы истории и удаляет старые корзины.
+// Докуда история учтена, хранится в rollup_state.
+func (m *dbsaver) Rollup(ctx context.Context, now time.Time, retention storage.RollupRetention) error {
+	for _, resolution := range storage.RollupResolutions {
+		step, err := storage.ResolutionStep(resolution)
+		if err != nil {
+			return err
+		}
+		err = withRetry(ctx, func() error {
+			return m.rollupInTx(ctx, resolution, step, now, retention[resolution])
+		})
+		if err != nil {
+			return fmt.Errorf("error while trying to roll up history to %s: %w", resolution, err)
+		}
+	}
+	return nil
+}
+
+func (m *dbsaver) rollupInTx(ctx context.Context, resolution string, step time.Duration, now time.Time, keep time.Duration) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// учитываются сэмплы до номера, прочитанного в начале транзакции, поэтому
+	// вставки во время агрегации её не блокируют и дождутся следующего запуска
+	var seen, upper int64
+	if err := tx.QueryRowContext(ctx, `select coalesce(max(seq), 0) from metric_history`).Scan(&upper); err != nil {
+		return err
+	}
+	err = tx.QueryRowContext(ctx, `select seq from rollup_state where resolution = $1`, resolution).Scan(&seen)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if upper > seen {
+		// нечисловые значения gauge в агрегаты не попадают
+		_, err := tx.ExecContext(ctx, `insert into metric_rollups
+				(id, mtype, labels_key, resolution, bucket_start, count, min, max, total, last, last_ts, increase)
+			select id, mtype, labels_key, $1, bucket_start, count(*), min(mvalue), max(mvalue), sum(mvalue),
+				(array_agg(mvalue order by ts desc))[1], max(ts), coalesce(sum(increase), 0)
+			from (
+				select *, to_timestamp(floor(extract(epoch from ts) / $2) * $2) as bucket_start
+				from metric_history
+				where seq > $3 and seq <= $4
+					and (mtype <> 'gauge' or mvalue not in ('NaN', 'Infinity', '-Infinity'))
+			) h
+			group by id, mtype, labels_key, bucket_start
+			on conflict (mtype, id, labels_key, resolution, bucket_start) do update set
+				count = metric_rollups.count + excluded.count,
+				min = least(metric_rollups.min, excluded.min),
+				max = greatest(metric_rollups.max, excluded.max),
+				total = metric_rollups.total + excluded.total,
+				last = case when excluded.last_ts >= metric_rollups.last_ts then excluded.last else metric_rollups.last end,
+				last_ts = greatest(metric_rollups.last_ts, excluded.last_ts),
+				increase = metric_rollups.increase + excluded.increase`,
+			resolution, step.Seconds(), seen, upper)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `insert into rollup_state (resolution, seq) values ($1, $2)
+			on conflict (resolution) do update set seq = excluded.seq`, resolution, upper)
+		if err != nil {
+			return err
+		}
+	}
+
+	if keep > 0 {
+		// корзина удаляется, когда целиком закончилась раньше срока
+		cutoff := now.Add(-keep).Add(-step)
+		_, err := tx.ExecContext(ctx, `delete from metric_rollups where resolution = $1 and bucket_start <= $2`, resolution, cutoff)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Rollups читает корзины ряда из [from, to] в разрешении resolution.
+func (m *dbsaver) Rollups(ctx context.Context, metricType, metricName string, labels storage.Labels, resolution string, from, to time.Time) ([]storage.Bucket, error) {
+	step, err := storage.ResolutionStep(resolution)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := m.Get(ctx, metricType, metricName, labels); err != nil {
+		return nil, err
+	}
+
+	var (
+		buckets        []storage.Bucket
+		fromArg, toArg any
+	)
+	if !from.IsZero() {
+		fromArg = from.Truncate(step)
+	}
+	if !to.IsZero() {
+		toArg = to
 	}
+	err = withRetry(ctx, func() error {
+		buckets = make([]storage.Bucket, 0)
+		rows, err := m.db.QueryContext(ctx, `select bucket_start, count, min, max, total, last, last_ts, increase
+			from metric_rollups
+			where mtype = $1 and id = $2 and labels_key = $3 and resolution = $4
+				and ($5::timestamptz is null or bucket_start >= $5) and ($6::timestamptz is null or bucket_start <= $6)
+			order by bucket_start`,
+			metricType, metricName, labels.Key(), resolution, fromArg, toArg)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				a                       storage.Aggregate
+				minimum, maximum, total sql.NullFloat64
+				last                    sql.NullFloat64
+				lastTime                sql.NullTime
+			)
+			if err := rows.Scan(&a.Start, &a.Count, &minimum, &maximum, &total, &last, &lastTime, &a.Increase); err != nil {
+				return err
+			}
+			a.Start = a.Start.UTC()
+			a.Min, a.Max, a.Total, a.Last = minimum.Float64, maximum.Float64, total.Float64, last.Float64
+			a.LastTime = lastTime.Time
+			buckets = append(buckets, a.Bucket(metricType, step))
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to read rollups of metric %q: %w", metricName, err)
+	}
+	return buckets, nil
+}
 
-	err := retry.Do(
-		restoreOperation,
-		append(opts, retry.RetryIf(func(err error) bool {
-			return isRetriableError(err) // Проверяем, является ли ошибка retriable
-		}))...)
+func (m *dbsaver) Delete(ctx context.Context, metricType, metricName string, labels storage.Labels) error {
+	var affected int64
+	err := withRetry(ctx, func() error {
+		res, err := m.db.ExecContext(ctx, `delete from metrics`+seriesCondition, metricType, metricName, labels.Key())
+		if err != nil {
+			return err
+		}
+		affected, err = res.RowsAffected()
+		return err
+	})
 	if err != nil {
-		log.Fatal("Failed to restore metrics with retries:", err)
+		return fmt.Errorf("error while trying to delete metric %q: %w", metricName, err)
+	}
+	if affected == 0 {
+		return storage.ErrNotFound
+	}
+	return nil
+}
+
+func (m *dbsaver) Restore(ctx context.Context) ([]storage.Metric, error) {
+	return m.query(ctx, selectMetricsQuery+` order by mtype, id, labels_key`)
+}
+
+func (m *dbsaver) query(ctx context.Context, query string, args ...any) ([]storage.Metric, error) {
+	var metrics []storage.Metric
+	restoreOperation := func() error {
+		metrics = metrics[:0]
+		rows, err := m.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			metric, err := scanMetric(rows)
+			if err != nil {
+				return err
+			}
+			metrics = append(metrics, metric)
+		}
+		return rows.Err()
+	}
+
+	if err := withRetry(ctx, restoreOperation); err != nil {
+		return nil, fmt.Errorf("error while trying to read metrics: %w", err)
 	}
 	return metrics, nil
 }
 
+// Save записывает снимок метрик как есть, без увеличения счётчиков, в одной транзакции.
 func (m *dbsaver) Save(ctx context.Context, metrics []storage.Metric) error {
-	saveOperation := func() error {
-		for _, metric := range metrics {
-			switch metric.MType {
-			case storage.Gauge:
-				query := `insert into metrics (id, mtype, mvalue) values ($1, $2, $3) ON CONFLICT (id) DO UPDATE SET mvalue = EXCLUDED.mvalue;`
-				if _, err := m.db.ExecContext(ctx, query, metric.ID, metric.MType, metric.Value); err != nil {
-					return fmt.Errorf("error while trying to save gauge metric %q: %w", metric.ID, err)
-				}
-			case storage.Counter:
-				query := `insert into metrics (id, mtype, delta) values ($1, $2, $3) ON CONFLICT (id) DO UPDATE SET delta = EXCLUDED.delta;`
-				if _, err := m.db.ExecContext(ctx, query, metric.ID, metric.MType, metric.Delta); err != nil {
-					return fmt.Errorf("error while trying to save counter metric %q: %w", metric.ID, err)
-				}
+	merged, err := mergeBatch(metrics, storage.Policy{})
+	if err != nil {
+		return err
+	}
+	return withRetry(ctx, func() error {
+		_, err := m.upsertInTx(ctx, merged, false)
+		return err
+	})
+}
+
+// upsertInTx записывает метрики в одной транзакции и возвращает итоговые
+// состояния по batchKey. С increment дельты прибавляются к сохранённым.
+func (m *dbsaver) upsertInTx(ctx context.Context, metrics []storage.Metric, increment bool) (map[string]storage.Metric, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error while trying to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var gauges, counters, merged []storage.Metric
+	for _, metric := range metrics {
+		switch {
+		case metric.MType == storage.Gauge:
+			gauges = append(gauges, metric)
+		case metric.MType == storage.Counter:
+			counters = append(counters, metric)
+		case mergedType(metric.MType):
+			merged = append(merged, metric)
+		}
+	}
+
+	states := make(map[string]storage.Metric, len(metrics))
+	gaugeConflict := "mvalue = excluded.mvalue, ts = excluded.ts"
+	counterConflict := "delta = excluded.delta, ts = excluded.ts"
+	if increment {
+		gaugeConflict += m.lateFilter(storage.Gauge)
+		counterConflict = "delta = metrics.delta + excluded.delta, ts = greatest(metrics.ts, excluded.ts)" + m.lateFilter(storage.Counter)
+	}
+	if err := upsertChunks(ctx, tx, "mvalue", gaugeConflict, gauges, states); err != nil {
+		return nil, err
+	}
+	if err := upsertChunks(ctx, tx, "delta", counterConflict, counters, states); err != nil {
+		return nil, err
+	}
+	// сэмплы, не попавшие в returning, оказались старше сохранённых
+	for _, group := range [][]storage.Metric{gauges, counters} {
+		for _, metric := range group {
+			if _, ok := states[batchKey(metric)]; ok {
+				continue
 			}
+			state, err := m.lateSample(ctx, tx, metric)
+			if err != nil {
+				return nil, err
+			}
+			states[batchKey(metric)] = state
 		}
-		return nil
 	}
-	opts := []retry.Option{
-		retry.DelayType(retry.BackOffDelay),
-		retry.Delay(1 * time.Second),
-		retry.MaxDelay(5 * time.Second),
-		retry.Attempts(3),
-		retry.OnRetry(func(n uint, err error) {
-			log.Printf("Retry #%d, error: %s\n", n, err)
-		}),
+	// блокировки берутся в одном порядке, чтобы параллельные пакеты не ждали друг друга по кругу
+	sort.SliceStable(merged, func(i, j int) bool {
+		return batchKey(merged[i]) < batchKey(merged[j])
+	})
+	for _, metric := range merged {
+		if err := m.upsertMerged(ctx, tx, metric, increment, states); err != nil {
+			return nil, err
+		}
 	}
 
-	err := retry.Do(
-		saveOperation,
-		append(opts, retry.RetryIf(func(err error) bool {
-			return isRetriableError(err) // Проверяем, является ли ошибка retriable
-		}))...)
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error while trying to commit transaction: %w", err)
+	}
+	return states, nil
+}
+
+// upsertMerged складывает гистограмму, summary или set с сохранённым значением
+// под advisory-блокировкой ключа, чтобы реплики не перезаписали друг друга.
+func (m *dbsaver) upsertMerged(ctx context.Context, tx *sql.Tx, metric storage.Metric, increment bool, states map[string]storage.Metric) error {
+	key := batchKey(metric)
+	result := metric
+	if increment {
+		if _, err := tx.ExecContext(ctx, `select pg_advisory_xact_lock(hashtext($1))`, key); err != nil {
+			return fmt.Errorf("error while trying to lock %s metric %q: %w", metric.MType, metric.ID, err)
+		}
+		var stored *storage.Metric
+		if state, ok := states[key]; ok {
+			stored = &state
+		} else {
+			row := tx.QueryRowContext(ctx, selectMetricsQuery+seriesCondition, metric.MType, metric.ID, metric.Labels.Key())
+			state, err := scanMetric(row)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("error while trying to read %s metric %q: %w", metric.MType, metric.ID, err)
+			}
+			if err == nil {
+				stored = &state
+			}
+		}
+		var err error
+		if result, err = m.policy.Apply(stored, metric); err != nil {
+			return err
+		}
+	}
+
+	var value any
+	switch metric.MType {
+	case storage.Histogram:
+		value = result.Histogram
+	case storage.Summary:
+		value = result.Summary
+	case storage.Set:
+		value = result.Set
+	}
+	data, err := json.Marshal(value)
 	if err != nil {
-		log.Fatal("Failed to save metrics with retries:", err)
+		return err
+	}
+	query := fmt.Sprintf(updateMergedQuery, mergedColumns[metric.MType])
+	state, err := scanMetric(tx.QueryRowContext(ctx, query, metric.ID, metric.MType, labelsJSON(metric.Labels), metric.Labels.Key(), data, result.Timestamp))
+	if err != nil {
+		return fmt.Errorf("error while trying to save %s metric %q: %w", metric.MType, metric.ID, err)
+	}
+	states[key] = state
+	return nil
+}
+
+// batchChunkSize ограничивает число строк в запросе из-за лимита параметров Postgres.
+const batchChunkSize = 1000
+
+func upsertChunks(ctx context.Context, tx *sql.Tx, column, conflict string, metrics []storage.Metric, states map[string]storage.Metric) error {
+	for start := 0; start < len(metrics); start += batchChunkSize {
+		end := start + batchChunkSize
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+		chunk := metrics[start:end]
+
+		var query strings.Builder
+		args := make([]any, 0, 6*len(chunk))
+		fmt.Fprintf(&query, "insert into metrics (id, mtype, labels, labels_key, %s, ts) values ", column)
+		for i, metric := range chunk {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			fmt.Fprintf(&query, "($%d, $%d, $%d, $%d, $%d, $%d)", 6*i+1, 6*i+2, 6*i+3, 6*i+4, 6*i+5, 6*i+6)
+			args = append(args, metric.ID, metric.MType, labelsJSON(metric.Labels), metric.Labels.Key())
+			if metric.MType == storage.Counter {
+				args = append(args, metric.Delta)
+			} else {
+				args = append(args, metric.Value)
+			}
+			args = append(args, metric.Timestamp)
+		}
+		fmt.Fprintf(&query, " on conflict (id, mtype, labels_key) do update set %s returning %s", conflict, metricColumns)
+
+		rows, err := tx.QueryContext(ctx, query.String(), args...)
+		if err != nil {
+			return fmt.Errorf("error while trying to save %s metrics: %w", column, err)
+		}
+		for rows.Next() {
+			metric, err := scanMetric(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			states[batchKey(metric)] = metric
+		}
+		if err := rows.Close(); err != nil {
+			return err
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+func batchKey(metric storage.Metric) string {
+	return metric.MType + "/" + metric.ID + metric.Labels.Key()
+}
+
+// mergeBatch схлопывает повторы одной метрики по политике: Postgres не даёт
+// одному insert ... on conflict изменить строку дважды.
+func mergeBatch(metrics []storage.Metric, policy storage.Policy) ([]storage.Metric, error) {
+	merged := make([]storage.Metric, 0, len(metrics))
+	positions := make(map[string]int, len(metrics))
+	for _, metric := range metrics {
+		if mergedType(metric.MType) {
+			merged = append(merged, metric)
+			continue
+		}
+		key := batchKey(metric)
+		i, ok := positions[key]
+		if !ok {
+			positions[key] = len(merged)
+			merged = append(merged, metric)
+			continue
+		}
+		state, err := policy.Apply(&merged[i], metric)
+		if err != nil {
+			return nil, err
+		}
+		merged[i] = state
+	}
+	return merged, nil
+}
+
+// Flush ничего не делает: каждое обновление сразу записывается в базу.
+func (m *dbsaver) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (m *dbsaver) Close() error {
+	return m.db.Close()
+}
+
+// init приводит схему базы к актуальной версии.
 func (m *dbsaver) init(ctx context.Context) error {
-	const query = `create table if not exists metrics (id text primary key, mtype text, delta bigint, mvalue double precision)`
-	if _, err := m.db.ExecContext(ctx, query); err != nil {
-		return fmt.Errorf("error while trying to create table: %w", err)
+	migrator, err := newMigrator(m.db)
+	if err != nil {
+		return err
+	}
+	applied, err := migrator.Up(ctx)
+	if err != nil {
+		return fmt.Errorf("error while trying to migrate database: %w", err)
+	}
+	if applied > 0 {
+		middleware.SugarLogger.Infow("database migrated", "applied", applied)
 	}
 	return nil
 }
 
 func NewDBSaver(params *config.Options, ctx context.Context) (*dbsaver, error) {
-	//ctx := context.Background()
 	db, err := sql.Open("pgx", params.DatabaseAddress)
 	if err != nil {
 		return nil, err
 	}
 
+	policy, err := newPolicy(params)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 	dbs := dbsaver{
-		db: db,
+		db:            db,
+		policy:        policy,
+		historyLength: params.HistoryLength,
 	}
 	if err := dbs.init(ctx); err != nil {
+		db.Close()
 		return nil, err
 	}
-	if params.Restore {
-		metrics, err := dbs.Restore(ctx)
-		if err != nil {
-			middleware.SugarLogger.Error(err.Error(), "restore from database error")
-		}
-		storage.MetricStorage.Metrics = metrics
-		middleware.SugarLogger.Info("metrics restored from database")
-	}
+	// данные уже лежат в базе, поэтому params.Restore для неё не нужен
 
 	return &dbs, nil
 }
@@ -0,0 +1,270 @@
+package storager
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sersus/go-yandex-metrics/internal/config"
+	"github.com/sersus/go-yandex-metrics/internal/storage"
+)
+
+// testDBEnv — переменная с адресом тестовой базы Postgres; без неё тесты с базой
+// пропускаются. Схема этой базы пересоздаётся.
+const testDBEnv = "TEST_DATABASE_DSN"
+
+// newTestDBSaver откатывает все миграции тестовой базы и открывает хранилище на чистой схеме.
+func newTestDBSaver(t *testing.T, params config.Options) *dbsaver {
+	t.Helper()
+	dsn := os.Getenv(testDBEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDBEnv)
+	}
+	params.DatabaseAddress = dsn
+
+	ctx := context.Background()
+	migrator, err := NewMigrator(&params)
+	require.NoError(t, err)
+	defer migrator.Close()
+	for {
+		reverted, err := migrator.Down(ctx)
+		require.NoError(t, err)
+		if !reverted {
+			break
+		}
+	}
+
+	m, err := NewDBSaver(&params, ctx)
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func ptrInt64(i int64) *int64 {
+	return &i
+}
+
+func ptrFloat64(f float64) *float64 {
+	return &f
+}
+
+func TestMergeBatch(t *testing.T) {
+	merged, err := mergeBatch([]storage.Metric{
+		{ID: "counter1", MType: storage.Counter, Delta: ptrInt64(2)},
+		{ID: "gauge1", MType: storage.Gauge, Value: ptrFloat64(1.5)},
+		{ID: "counter1", MType: storage.Counter, Delta: ptrInt64(3)},
+		{ID: "gauge1", MType: storage.Gauge, Value: ptrFloat64(2.5)},
+		{ID: "gauge1", MType: storage.Counter, Delta: ptrInt64(1)},
+	}, storage.Policy{})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []storage.Metric{
+		{ID: "counter1", MType: storage.Counter, Delta: ptrInt64(5)},
+		{ID: "gauge1", MType: storage.Gauge, Value: ptrFloat64(2.5)},
+		{ID: "gauge1", MType: storage.Counter, Delta: ptrInt64(1)},
+	}, merged)
+}
+
+func TestMergeBatchKeepsHistograms(t *testing.T) {
+	merged, err := mergeBatch([]storage.Metric{
+		{ID: "latency", MType: storage.Histogram, Value: ptrFloat64(0.5)},
+		{ID: "latency", MType: storage.Histogram, Value: ptrFloat64(1.5)},
+	}, storage.Policy{})
+	assert.NoError(t, err)
+	assert.Len(t, merged, 2)
+}
+
+func TestMergeBatchKeepsLabelledSeries(t *testing.T) {
+	merged, err := mergeBatch([]storage.Metric{
+		{ID: "requests", MType: storage.Counter, Delta: ptrInt64(2), Labels: storage.Labels{"host": "web-1"}},
+		{ID: "requests", MType: storage.Counter, Delta: ptrInt64(3), Labels: storage.Labels{"host": "web-2"}},
+		{ID: "requests", MType: storage.Counter, Delta: ptrInt64(4), Labels: storage.Labels{"host": "web-1"}},
+	}, storage.Policy{})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []storage.Metric{
+		{ID: "requests", MType: storage.Counter, Delta: ptrInt64(6), Labels: storage.Labels{"host": "web-1"}},
+		{ID: "requests", MType: storage.Counter, Delta: ptrInt64(3), Labels: storage.Labels{"host": "web-2"}},
+	}, merged)
+}
+
+func TestMergeBatchOutOfOrder(t *testing.T) {
+	older, newer := time.Unix(10, 0), time.Unix(20, 0)
+	batch := []storage.Metric{
+		{ID: "gauge1", MType: storage.Gauge, Value: ptrFloat64(2), Timestamp: &newer},
+		{ID: "gauge1", MType: storage.Gauge, Value: ptrFloat64(1), Timestamp: &older},
+	}
+
+	merged, err := mergeBatch(batch, storage.Policy{OutOfOrder: storage.OutOfOrderNewer})
+	assert.NoError(t, err)
+	assert.Len(t, merged, 1)
+	assert.Equal(t, 2.0, *merged[0].Value)
+
+	_, err = mergeBatch(batch, storage.Policy{OutOfOrder: storage.OutOfOrderReject})
+	assert.ErrorIs(t, err, storage.ErrOutOfOrder)
+}
+
+func TestDBSaverUpdateBatchAtomic(t *testing.T) {
+	m := newTestDBSaver(t, config.Options{OutOfOrder: storage.OutOfOrderReject})
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	before := now.Add(-time.Minute)
+
+	_, err := m.Update(ctx, storage.Metric{ID: "g", MType: storage.Gauge, Value: ptrFloat64(1), Timestamp: &now})
+	require.NoError(t, err)
+
+	// некорректная метрика отклоняется до записи
+	_, err = m.UpdateBatch(ctx, []storage.Metric{
+		{ID: "c", MType: storage.Counter, Delta: ptrInt64(5), Timestamp: &now},
+		{ID: "bad", MType: storage.Counter},
+	})
+	assert.ErrorIs(t, err, storage.ErrBadRequest)
+
+	// поздний gauge обнаруживается уже в транзакции, и счётчик откатывается вместе с ним
+	_, err = m.UpdateBatch(ctx, []storage.Metric{
+		{ID: "c", MType: storage.Counter, Delta: ptrInt64(5), Timestamp: &now},
+		{ID: "g", MType: storage.Gauge, Value: ptrFloat64(2), Timestamp: &before},
+	})
+	assert.ErrorIs(t, err, storage.ErrOutOfOrder)
+
+	_, err = m.Get(ctx, storage.Counter, "c", nil)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	gauge, err := m.Get(ctx, storage.Gauge, "g", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, *gauge.Value)
+}
+
+func TestDBSaverCounterAccumulation(t *testing.T) {
+	params := config.Options{}
+	m := newTestDBSaver(t, params)
+	ctx := context.Background()
+
+	_, err := m.Update(ctx, storage.Metric{ID: "c", MType: storage.Counter, Delta: ptrInt64(2)})
+	require.NoError(t, err)
+
+	// повторы в пакете получают состояние после всего пакета
+	results, err := m.UpdateBatch(ctx, []storage.Metric{
+		{ID: "c", MType: storage.Counter, Delta: ptrInt64(3)},
+		{ID: "g", MType: storage.Gauge, Value: ptrFloat64(1)},
+		{ID: "c", MType: storage.Counter, Delta: ptrInt64(4)},
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	assert.Equal(t, int64(9), *results[0].Delta)
+	assert.Equal(t, int64(9), *results[2].Delta)
+
+	// вторая реплика продолжает счётчик, а не перезаписывает его
+	params.DatabaseAddress = os.Getenv(testDBEnv)
+	replica, err := NewDBSaver(&params, ctx)
+	require.NoError(t, err)
+	defer replica.Close()
+	_, err = replica.Update(ctx, storage.Metric{ID: "c", MType: storage.Counter, Delta: ptrInt64(1)})
+	require.NoError(t, err)
+
+	counter, err := m.Get(ctx, storage.Counter, "c", nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), *counter.Delta)
+}
+
+func TestDBSaverLateSamples(t *testing.T) {
+	m := newTestDBSaver(t, config.Options{OutOfOrder: storage.OutOfOrderNewer})
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	before := now.Add(-time.Minute)
+
+	_, err := m.Update(ctx, storage.Metric{ID: "g", MType: storage.Gauge, Value: ptrFloat64(5), Timestamp: &now})
+	require.NoError(t, err)
+	_, err = m.Update(ctx, storage.Metric{ID: "c", MType: storage.Counter, Delta: ptrInt64(5), Timestamp: &now})
+	require.NoError(t, err)
+
+	// поздний gauge отбрасывается и по одному, и в пакете, а счётчики складываются
+	gauge, err := m.Update(ctx, storage.Metric{ID: "g", MType: storage.Gauge, Value: ptrFloat64(1), Timestamp: &before})
+	require.NoError(t, err)
+	assert.Equal(t, 5.0, *gauge.Value)
+	results, err := m.UpdateBatch(ctx, []storage.Metric{
+		{ID: "g", MType: storage.Gauge, Value: ptrFloat64(2), Timestamp: &before},
+		{ID: "c", MType: storage.Counter, Delta: ptrInt64(3), Timestamp: &before},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 5.0, *results[0].Value)
+	assert.Equal(t, int64(8), *results[1].Delta)
+	assert.True(t, results[1].Timestamp.Equal(now))
+
+	gauge, err = m.Get(ctx, storage.Gauge, "g", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 5.0, *gauge.Value)
+	assert.True(t, gauge.Timestamp.Equal(now))
+}
+
+func TestDBSaverUpdateBatchChunks(t *testing.T) {
+	m := newTestDBSaver(t, config.Options{})
+	ctx := context.Background()
+
+	batch := make([]storage.Metric, 0, 2*(batchChunkSize+1))
+	for i := 0; i <= batchChunkSize; i++ {
+		id := fmt.Sprintf("m%d", i)
+		batch = append(batch,
+			storage.Metric{ID: id, MType: storage.Gauge, Value: ptrFloat64(float64(i))},
+			storage.Metric{ID: id, MType: storage.Counter, Delta: ptrInt64(int64(i))})
+	}
+	results, err := m.UpdateBatch(ctx, batch)
+	require.NoError(t, err)
+	require.Len(t, results, len(batch))
+	for i, metric := range batch {
+		assert.Equal(t, metric.ID, results[i].ID)
+	}
+
+	metrics, err := m.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, metrics, len(batch))
+	last, err := m.Get(ctx, storage.Counter, fmt.Sprintf("m%d", batchChunkSize), nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(batchChunkSize), *last.Delta)
+}
+
+func TestDBSaverMergedTypes(t *testing.T) {
+	m := newTestDBSaver(t, config.Options{})
+	ctx := context.Background()
+
+	// advisory-блокировка не даёт параллельным обновлениям потерять наблюдения
+	const writers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := m.Update(ctx, storage.Metric{ID: "latency", MType: storage.Histogram, Value: ptrFloat64(float64(i))})
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	histogram, err := m.Get(ctx, storage.Histogram, "latency", nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(writers), histogram.Histogram.Count)
+
+	// повторы summary и set в пакете складываются по очереди
+	results, err := m.UpdateBatch(ctx, []storage.Metric{
+		{ID: "rtt", MType: storage.Summary, Value: ptrFloat64(1)},
+		{ID: "users", MType: storage.Set, Members: []string{"a", "b"}},
+		{ID: "rtt", MType: storage.Summary, Value: ptrFloat64(3)},
+		{ID: "users", MType: storage.Set, Members: []string{"b", "c"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), results[0].Summary.Count)
+	assert.Equal(t, uint64(3), results[1].Set.Count)
+
+	summary, err := m.Get(ctx, storage.Summary, "rtt", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 4.0, summary.Summary.Sum)
+}
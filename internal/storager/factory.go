@@ -2,6 +2,8 @@ package storager
 
 import (
 	"context"
+	"errors"
+	"io"
 	"time"
 
 	"github.com/sersus/go-yandex-metrics/internal/config"
@@ -9,23 +11,71 @@ import (
 	"github.com/sersus/go-yandex-metrics/internal/storage"
 )
 
+// saver — хранилище, умеющее сохранять и восстанавливать снимок метрик.
 type saver interface {
+	storage.Storage
 	Restore(ctx context.Context) ([]storage.Metric, error)
 	Save(ctx context.Context, metrics []storage.Metric) error
+	// Flush сохраняет текущее состояние хранилища.
+	Flush(ctx context.Context) error
 }
 
-func InitSaver(params *config.Options, ctx context.Context) saver {
-	var saver saver
-	var err error
+// InitStorage выбирает хранилище по параметрам запуска: Postgres, файл или только память.
+func InitStorage(params *config.Options, ctx context.Context) (storage.Storage, error) {
 	if params.FileStoragePath != "" && params.DatabaseAddress == "" {
-		saver = NewFilesaver(params, ctx)
+		return NewFilesaver(params, ctx)
 	} else if params.DatabaseAddress != "" {
-		saver, err = NewDBSaver(params, ctx)
-		if err != nil {
-			middleware.SugarLogger.Errorf(err.Error())
+		return NewDBSaver(params, ctx)
+	}
+	policy, err := newPolicy(params)
+	if err != nil {
+		return nil, err
+	}
+	mc := storage.NewMetricCollection()
+	mc.SetPolicy(policy)
+	mc.SetHistoryLength(params.HistoryLength)
+	return mc, nil
+}
+
+// newPolicy собирает политику проверки значений из параметров запуска.
+func newPolicy(params *config.Options) (storage.Policy, error) {
+	allowNonFinite, err := storage.ParseNonFinite(params.GaugeNonFinite)
+	if err != nil {
+		return storage.Policy{}, err
+	}
+	bounds, err := storage.ParseHistogramBounds(params.HistogramBuckets)
+	if err != nil {
+		return storage.Policy{}, err
+	}
+	accuracy, err := storage.ParseSummaryAccuracy(params.SummaryAccuracy)
+	if err != nil {
+		return storage.Policy{}, err
+	}
+	outOfOrder, err := storage.ParseOutOfOrder(params.OutOfOrder)
+	if err != nil {
+		return storage.Policy{}, err
+	}
+	return storage.Policy{
+		AllowNonFinite:     allowNonFinite,
+		AllowNegativeDelta: params.AllowNegativeDelta,
+		HistogramBounds:    bounds,
+		SummaryAccuracy:    accuracy,
+		OutOfOrder:         outOfOrder,
+	}, nil
+}
+
+// Close сохраняет последнее состояние хранилища и освобождает его ресурсы.
+func Close(ctx context.Context, store storage.Storage) error {
+	var flushErr error
+	if s, ok := store.(saver); ok {
+		flushErr = s.Flush(ctx)
+	}
+	if c, ok := store.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			return errors.Join(flushErr, err)
 		}
 	}
-	return saver
+	return flushErr
 }
 
 type SaverHelper struct {
@@ -34,24 +84,30 @@ type SaverHelper struct {
 	interval time.Duration
 }
 
-func InitSaverHelper(opts *config.Options) *SaverHelper {
-	ctx := context.Background()
+// InitSaverHelper создаёт помощника периодического сохранения.
+func InitSaverHelper(opts *config.Options, ctx context.Context, store storage.Storage) *SaverHelper {
+	s, _ := store.(saver)
 	sh := &SaverHelper{
-		saver:    InitSaver(opts, ctx),
+		saver:    s,
 		ctx:      ctx,
-		interval: time.Duration(opts.StoreInterval),
+		interval: time.Duration(opts.StoreInterval) * time.Second,
 	}
 	return sh
 }
 
+// SaveMetrics периодически сохраняет метрики; при нулевом интервале ничего не делает.
 func (sh *SaverHelper) SaveMetrics() {
+	if sh.saver == nil || sh.interval <= 0 {
+		return
+	}
 	ticker := time.NewTicker(sh.interval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-sh.ctx.Done():
 			return
 		case <-ticker.C:
-			if err := sh.saver.Save(sh.ctx, storage.MetricStorage.Metrics); err != nil {
+			if err := sh.saver.Flush(sh.ctx); err != nil {
 				middleware.SugarLogger.Error(err.Error(), "save error")
 			}
 		}
@@ -1,79 +1,312 @@
 package storager
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
 
 	"github.com/sersus/go-yandex-metrics/internal/config"
 	"github.com/sersus/go-yandex-metrics/internal/middleware"
 	"github.com/sersus/go-yandex-metrics/internal/storage"
 )
 
+var errNoValidSnapshot = errors.New("no valid snapshot found")
+
+// filesaver держит метрики в памяти, пишет обновления в журнал и периодически
+// сохраняет снимок; <файл>.1 — самый свежий из предыдущих снимков.
 type filesaver struct {
-	fileName string
+	*storage.MetricCollection
+	fileName    string
+	backups     int
+	synchronous bool
+
+	mu      sync.Mutex // упорядочивает изменения коллекции и записи в журнал
+	flushMu sync.Mutex // не даёт двум снимкам выполняться одновременно
+	wal     *wal
+	records int // записей в журнале после последнего снимка
+}
+
+// walCompactRecords — наименьший журнал, который синхронный режим сворачивает в снимок.
+const walCompactRecords = 1000
+
+func (m *filesaver) Update(ctx context.Context, metric storage.Metric) (storage.Metric, error) {
+	m.mu.Lock()
+	result, err := m.MetricCollection.Update(ctx, metric)
+	m.mu.Unlock()
+	m.compact(ctx)
+	return result, err
+}
+
+func (m *filesaver) UpdateBatch(ctx context.Context, metrics []storage.Metric) ([]storage.Metric, error) {
+	m.mu.Lock()
+	results, err := m.MetricCollection.UpdateBatch(ctx, metrics)
+	m.mu.Unlock()
+	m.compact(ctx)
+	return results, err
+}
+
+func (m *filesaver) Delete(ctx context.Context, metricType, metricName string, labels storage.Labels) error {
+	m.mu.Lock()
+	err := m.MetricCollection.Delete(ctx, metricType, metricName, labels)
+	m.mu.Unlock()
+	m.compact(ctx)
+	return err
+}
+
+// Prune удаляет устаревшие ряды из памяти и записывает их удаление в журнал.
+func (m *filesaver) Prune(ctx context.Context, before time.Time) ([]storage.Metric, error) {
+	m.mu.Lock()
+	removed, err := m.MetricCollection.Prune(ctx, before)
+	m.mu.Unlock()
+	m.compact(ctx)
+	return removed, err
 }
 
+// journal пишет изменения в журнал до того, как их применит коллекция.
+// Вызывается под m.mu.
+func (m *filesaver) journal(metrics []storage.Metric, deleted bool) error {
+	if m.wal == nil {
+		return nil
+	}
+	entries := make([]walEntry, 0, len(metrics))
+	for _, metric := range metrics {
+		if deleted {
+			metric = storage.Metric{ID: metric.ID, MType: metric.MType, Labels: metric.Labels}
+		}
+		entries = append(entries, walEntry{Metric: metric, Deleted: deleted})
+	}
+	if err := m.wal.append(entries...); err != nil {
+		return err
+	}
+	m.records += len(entries)
+	return nil
+}
+
+// compact в синхронном режиме сворачивает журнал в снимок, когда записей в нём
+// набралось не меньше, чем метрик, поэтому снимок в среднем стоит O(1) на запись.
+func (m *filesaver) compact(ctx context.Context) {
+	if !m.synchronous {
+		return
+	}
+	m.mu.Lock()
+	due := m.records >= walCompactRecords && m.records >= m.Len()
+	m.mu.Unlock()
+	// снимок, который уже пишется, учтёт и эти записи
+	if !due || !m.flushMu.TryLock() {
+		return
+	}
+	defer m.flushMu.Unlock()
+	if err := m.flush(ctx); err != nil {
+		middleware.SugarLogger.Errorw(err.Error(), "event", "compact wal")
+	}
+}
+
+// Flush сохраняет снимок и удаляет учтённые в нём сегменты журнала.
+func (m *filesaver) Flush(ctx context.Context) error {
+	m.flushMu.Lock()
+	defer m.flushMu.Unlock()
+	return m.flush(ctx)
+}
+
+func (m *filesaver) flush(ctx context.Context) error {
+	m.mu.Lock()
+	metrics := m.Snapshot()
+	boundary := 0
+	if m.wal != nil {
+		var err error
+		if boundary, err = m.wal.rotate(); err != nil {
+			m.mu.Unlock()
+			return err
+		}
+	}
+	m.records = 0
+	m.mu.Unlock()
+
+	if err := m.Save(ctx, metrics); err != nil {
+		return err
+	}
+	if m.wal != nil {
+		return m.wal.removeBefore(boundary)
+	}
+	return nil
+}
+
+func (m *filesaver) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.wal == nil {
+		return nil
+	}
+	return m.wal.Close()
+}
+
+// snapshots возвращает пути к снимкам от самого свежего к самому старому.
+func (m *filesaver) snapshots() []string {
+	paths := []string{m.fileName}
+	for i := 1; i <= m.backups; i++ {
+		paths = append(paths, fmt.Sprintf("%s.%d", m.fileName, i))
+	}
+	return paths
+}
+
+// Restore читает самый свежий корректный снимок и применяет к нему журнал.
+// Если ни один снимок не читается, журнал применяется к пустой коллекции.
 func (m *filesaver) Restore(ctx context.Context) ([]storage.Metric, error) {
-	file, err := os.OpenFile(m.fileName, os.O_RDONLY|os.O_CREATE, 0666)
-	if err != nil {
+	metrics, err := m.restoreSnapshot()
+	if errors.Is(err, errNoValidSnapshot) {
+		middleware.SugarLogger.Warnw("no valid snapshot, restoring from wal only", "file", m.fileName)
+	} else if err != nil {
 		return nil, err
 	}
+	mc := storage.NewMetricCollection(metrics...)
+	replayed, err := replayWAL(m.fileName, mc)
+	if err != nil {
+		return nil, fmt.Errorf("error while replaying wal: %w", err)
+	}
+	if replayed > 0 {
+		middleware.SugarLogger.Infow("wal replayed", "records", replayed)
+	}
+	return mc.Snapshot(), nil
+}
 
-	scanner := bufio.NewScanner(file)
-	if !scanner.Scan() {
-		return nil, err
+// restoreSnapshot читает самый свежий корректный снимок.
+func (m *filesaver) restoreSnapshot() ([]storage.Metric, error) {
+	found := false
+	for _, path := range m.snapshots() {
+		metrics, err := readSnapshot(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		found = true
+		if err != nil {
+			middleware.SugarLogger.Warnw("skip corrupted snapshot", "file", path, "error", err)
+			continue
+		}
+		return metrics, nil
+	}
+	if found {
+		return nil, errNoValidSnapshot
 	}
+	return nil, nil
+}
 
-	data := scanner.Bytes()
-	var metricsFromFile []storage.Metric
-	if err = json.Unmarshal(data, &metricsFromFile); err != nil {
+func readSnapshot(path string) ([]storage.Metric, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
 		return nil, err
 	}
-	return metricsFromFile, nil
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, errors.New("empty snapshot")
+	}
+	var metrics []storage.Metric
+	if err := json.Unmarshal(data, &metrics); err != nil {
+		return nil, err
+	}
+	return metrics, nil
 }
 
+// Save атомарно заменяет снимок, сдвигая предыдущие.
 func (m *filesaver) Save(ctx context.Context, metrics []storage.Metric) error {
-	var saveError error
-	file, err := os.OpenFile(m.fileName, os.O_WRONLY|os.O_CREATE, 0666)
+	data, err := json.Marshal(&metrics)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			saveError = err
-		}
-	}()
+	data = append(data, '\n')
 
-	writer := bufio.NewWriter(file)
-
-	data, err := json.Marshal(&metrics)
+	dir := filepath.Dir(m.fileName)
+	tmp, err := os.CreateTemp(dir, filepath.Base(m.fileName)+".tmp-*")
 	if err != nil {
 		return err
 	}
-	if _, err := writer.Write(data); err != nil {
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
 		return err
 	}
-	if err := writer.WriteByte('\n'); err != nil {
+	if err := tmp.Close(); err != nil {
 		return err
 	}
-	if err := writer.Flush(); err != nil {
+
+	if err := m.rotate(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, m.fileName); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// rotate сдвигает снимки: <файл> -> <файл>.1 -> <файл>.2 ...
+func (m *filesaver) rotate() error {
+	paths := m.snapshots()
+	for i := len(paths) - 1; i > 0; i-- {
+		err := os.Rename(paths[i-1], paths[i])
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDir сбрасывает на диск запись каталога, чтобы переименование пережило сбой питания.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		// Windows не поддерживает fsync каталогов
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
 		return err
 	}
-	return saveError
+	defer d.Close()
+	return d.Sync()
 }
 
-func NewFilesaver(params *config.Options, ctx context.Context) *filesaver {
-	fs := &filesaver{fileName: params.FileStoragePath}
+func NewFilesaver(params *config.Options, ctx context.Context) (*filesaver, error) {
+	policy, err := newPolicy(params)
+	if err != nil {
+		return nil, err
+	}
+	fs := &filesaver{
+		MetricCollection: storage.NewMetricCollection(),
+		fileName:         params.FileStoragePath,
+		backups:          params.FileBackups,
+		synchronous:      params.StoreInterval == 0,
+	}
+	fs.SetPolicy(policy)
+	fs.SetHistoryLength(params.HistoryLength)
 	if params.Restore {
+		// без восстановления первый же снимок удалил бы ещё не учтённые сегменты журнала
 		metrics, err := fs.Restore(ctx)
 		if err != nil {
-			middleware.SugarLogger.Error(err.Error(), "restore from file error")
+			return nil, fmt.Errorf("error while restoring metrics: %w", err)
 		}
-		storage.MetricStorage.Metrics = metrics
+		fs.Replace(metrics)
 		middleware.SugarLogger.Info("metrics restored from file")
 	}
 
-	return fs
+	// новый сегмент журнала не должен участвовать в повторе
+	w, err := openWAL(fs.fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening wal: %w", err)
+	}
+	fs.wal = w
+	fs.SetJournal(fs.journal)
+
+	return fs, nil
 }
@@ -0,0 +1,160 @@
+package storager
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/sersus/go-yandex-metrics/internal/config"
+	"github.com/sersus/go-yandex-metrics/internal/middleware"
+	"github.com/sersus/go-yandex-metrics/internal/storage"
+)
+
+func TestMain(m *testing.M) {
+	middleware.SugarLogger = *zap.NewNop().Sugar()
+	os.Exit(m.Run())
+}
+
+func newTestFilesaver(t *testing.T, backups int) *filesaver {
+	return &filesaver{
+		MetricCollection: storage.NewMetricCollection(),
+		fileName:         filepath.Join(t.TempDir(), "metrics.json"),
+		backups:          backups,
+	}
+}
+
+func TestFilesaver_SaveShorterSnapshot(t *testing.T) {
+	ctx := context.Background()
+	fs := newTestFilesaver(t, 0)
+
+	long := []storage.Metric{
+		{ID: "counter1", MType: storage.Counter, Delta: ptrInt64(100500)},
+		{ID: "gauge1", MType: storage.Gauge, Value: ptrFloat64(1.5)},
+		{ID: "gauge2", MType: storage.Gauge, Value: ptrFloat64(2.5)},
+	}
+	short := []storage.Metric{
+		{ID: "counter1", MType: storage.Counter, Delta: ptrInt64(1)},
+	}
+	require.NoError(t, fs.Save(ctx, long))
+	require.NoError(t, fs.Save(ctx, short))
+
+	restored, err := fs.Restore(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, short, restored)
+
+	entries, err := os.ReadDir(filepath.Dir(fs.fileName))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "temporary files must be cleaned up")
+}
+
+func TestFilesaver_Rotation(t *testing.T) {
+	ctx := context.Background()
+	fs := newTestFilesaver(t, 2)
+
+	for i := int64(1); i <= 4; i++ {
+		require.NoError(t, fs.Save(ctx, []storage.Metric{{ID: "counter1", MType: storage.Counter, Delta: ptrInt64(i)}}))
+	}
+
+	for i, path := range fs.snapshots() {
+		metrics, err := readSnapshot(path)
+		require.NoError(t, err)
+		assert.Equal(t, int64(4-i), *metrics[0].Delta)
+	}
+	_, err := os.Stat(fs.fileName + ".3")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestFilesaver_RestoreFallback(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("no snapshots", func(t *testing.T) {
+		fs := newTestFilesaver(t, 2)
+		metrics, err := fs.Restore(ctx)
+		assert.NoError(t, err)
+		assert.Empty(t, metrics)
+	})
+
+	t.Run("corrupted latest", func(t *testing.T) {
+		fs := newTestFilesaver(t, 2)
+		require.NoError(t, fs.Save(ctx, []storage.Metric{{ID: "counter1", MType: storage.Counter, Delta: ptrInt64(1)}}))
+		require.NoError(t, fs.Save(ctx, []storage.Metric{{ID: "counter1", MType: storage.Counter, Delta: ptrInt64(2)}}))
+		require.NoError(t, os.WriteFile(fs.fileName, []byte(`[{"id":"counter1","ty`), 0666))
+
+		metrics, err := fs.Restore(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), *metrics[0].Delta)
+	})
+
+	t.Run("missing latest after interrupted rotation", func(t *testing.T) {
+		fs := newTestFilesaver(t, 1)
+		require.NoError(t, fs.Save(ctx, []storage.Metric{{ID: "counter1", MType: storage.Counter, Delta: ptrInt64(7)}}))
+		require.NoError(t, fs.rotate())
+
+		metrics, err := fs.Restore(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(7), *metrics[0].Delta)
+	})
+
+	t.Run("all corrupted", func(t *testing.T) {
+		fs := newTestFilesaver(t, 1)
+		require.NoError(t, os.WriteFile(fs.fileName, []byte("garbage"), 0666))
+		require.NoError(t, os.WriteFile(fs.fileName+".1", nil, 0666))
+
+		metrics, err := fs.Restore(ctx)
+		assert.NoError(t, err)
+		assert.Empty(t, metrics)
+	})
+}
+
+func TestFilesaver_SynchronousMode(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+	params := &config.Options{FileStoragePath: fileName, FileBackups: 1, StoreInterval: 0, Restore: true}
+
+	fs, err := NewFilesaver(params, ctx)
+	require.NoError(t, err)
+	defer fs.Close()
+
+	_, err = fs.Update(ctx, storage.Metric{ID: "counter1", MType: storage.Counter, Delta: ptrInt64(3)})
+	require.NoError(t, err)
+	_, err = fs.UpdateBatch(ctx, []storage.Metric{{ID: "gauge1", MType: storage.Gauge, Value: ptrFloat64(1.5)}})
+	require.NoError(t, err)
+
+	// обновления сразу попадают в журнал, снимок не переписывается
+	_, err = os.Stat(fileName)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	restored, err := NewFilesaver(params, ctx)
+	require.NoError(t, err)
+	defer restored.Close()
+	metrics, err := restored.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, metrics, 2)
+
+	// журнал, выросший до числа метрик, сворачивается в снимок
+	batch := make([]storage.Metric, 0, walCompactRecords)
+	for i := 0; i < walCompactRecords; i++ {
+		batch = append(batch, storage.Metric{ID: fmt.Sprintf("gauge%d", i+2), MType: storage.Gauge, Value: ptrFloat64(1)})
+	}
+	_, err = fs.UpdateBatch(ctx, batch)
+	require.NoError(t, err)
+	snapshot, err := readSnapshot(fileName)
+	require.NoError(t, err)
+	assert.Len(t, snapshot, walCompactRecords+2)
+	segments, err := walSegments(fileName)
+	require.NoError(t, err)
+	assert.Len(t, segments, 1)
+	_, err = os.Stat(fileName + ".1")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestSaverHelper_IntervalInSeconds(t *testing.T) {
+	sh := InitSaverHelper(&config.Options{StoreInterval: 30}, context.Background(), storage.NewMetricCollection())
+	assert.Equal(t, 30*time.Second, sh.interval)
+}
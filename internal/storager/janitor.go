@@ -0,0 +1,74 @@
+package storager
+
+import (
+	"context"
+	"time"
+
+	"github.com/sersus/go-yandex-metrics/internal/config"
+	"github.com/sersus/go-yandex-metrics/internal/middleware"
+	"github.com/sersus/go-yandex-metrics/internal/storage"
+)
+
+// pruner — хранилище, из которого можно удалять устаревшие ряды.
+type pruner interface {
+	// Prune удаляет ряды, которые сервер не записывал с before, вместе с их историей
+	// и возвращает удалённые ряды. Нулевое before ряды не удаляет.
+	Prune(ctx context.Context, before time.Time) ([]storage.Metric, error)
+}
+
+var (
+	_ pruner = (*storage.MetricCollection)(nil)
+	_ pruner = (*filesaver)(nil)
+	_ pruner = (*dbsaver)(nil)
+)
+
+// Janitor периодически удаляет ряды, не обновлявшиеся дольше срока хранения.
+type Janitor struct {
+	pruner    pruner
+	retention time.Duration
+	interval  time.Duration
+}
+
+func InitJanitor(opts *config.Options, store storage.Storage) *Janitor {
+	p, _ := store.(pruner)
+	return &Janitor{
+		pruner:    p,
+		retention: time.Duration(opts.RetentionHours) * time.Hour,
+		interval:  time.Duration(opts.JanitorInterval) * time.Second,
+	}
+}
+
+// Run выполняет чистку раз в интервал до отмены ctx.
+func (j *Janitor) Run(ctx context.Context) {
+	if j.pruner == nil || j.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := j.Prune(ctx); err != nil {
+				middleware.SugarLogger.Errorw(err.Error(), "event", "prune metrics")
+			}
+		}
+	}
+}
+
+// Prune выполняет одну чистку и возвращает удалённые ряды.
+func (j *Janitor) Prune(ctx context.Context) ([]storage.Metric, error) {
+	if j.pruner == nil {
+		return nil, nil
+	}
+	var before time.Time
+	if j.retention > 0 {
+		before = time.Now().Add(-j.retention)
+	}
+	removed, err := j.pruner.Prune(ctx, before)
+	if len(removed) > 0 {
+		middleware.SugarLogger.Infow("expired metrics removed", "count", len(removed))
+	}
+	return removed, err
+}
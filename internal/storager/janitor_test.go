@@ -0,0 +1,62 @@
+package storager
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sersus/go-yandex-metrics/internal/config"
+	"github.com/sersus/go-yandex-metrics/internal/storage"
+)
+
+func TestJanitor_PrunesFilesaver(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+	stale := time.Now().Add(-3 * time.Hour)
+
+	fs := openTestFilesaver(t, fileName)
+	// срок хранения отсчитывается от записи на сервере, а не от времени сэмпла
+	fs.SetPolicy(storage.Policy{Now: func() time.Time { return stale }})
+	_, err := fs.Update(ctx, storage.Metric{ID: "stale", MType: storage.Gauge, Value: ptrFloat64(1)})
+	require.NoError(t, err)
+	fs.SetPolicy(storage.Policy{})
+	_, err = fs.UpdateBatch(ctx, []storage.Metric{
+		{ID: "fresh", MType: storage.Gauge, Value: ptrFloat64(2)},
+		{ID: "backfill", MType: storage.Gauge, Value: ptrFloat64(3), Timestamp: &stale},
+	})
+	require.NoError(t, err)
+	// снимок ещё содержит устаревший ряд, удаление попадает только в журнал
+	require.NoError(t, fs.Flush(ctx))
+
+	janitor := InitJanitor(&config.Options{RetentionHours: 2, JanitorInterval: 1}, fs)
+	removed, err := janitor.Prune(ctx)
+	require.NoError(t, err)
+	require.Len(t, removed, 1)
+	assert.Equal(t, "stale", removed[0].ID)
+
+	restored := openTestFilesaver(t, fileName)
+	_, err = restored.Get(ctx, storage.Gauge, "stale", nil)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, err = restored.Get(ctx, storage.Gauge, "fresh", nil)
+	assert.NoError(t, err)
+	_, err = restored.Get(ctx, storage.Gauge, "backfill", nil)
+	assert.NoError(t, err)
+}
+
+func TestJanitor_WithoutRetention(t *testing.T) {
+	ctx := context.Background()
+	stale := time.Now().Add(-24 * time.Hour)
+	mc := storage.NewMetricCollection()
+	_, err := mc.Update(ctx, storage.Metric{ID: "old", MType: storage.Gauge, Value: ptrFloat64(1), Timestamp: &stale})
+	require.NoError(t, err)
+
+	removed, err := InitJanitor(&config.Options{}, mc).Prune(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+	_, err = mc.Get(ctx, storage.Gauge, "old", nil)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,265 @@
+package storager
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sersus/go-yandex-metrics/internal/config"
+)
+
+// migrations/<версия>_<название>.up.sql и .down.sql
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationsLockID — ключ advisory-блокировки миграций.
+const migrationsLockID = 7263541
+
+type migration struct {
+	version int64
+	name    string
+	up      string
+	down    string
+}
+
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+type Migrator struct {
+	db         *sql.DB
+	migrations []migration
+}
+
+// NewMigrator открывает соединение с базой из параметров запуска.
+func NewMigrator(params *config.Options) (*Migrator, error) {
+	db, err := sql.Open("pgx", params.DatabaseAddress)
+	if err != nil {
+		return nil, err
+	}
+	m, err := newMigrator(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func newMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading migrations: %w", err)
+	}
+
+	byVersion := make(map[int64]*migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+		base := strings.TrimSuffix(fileName, "."+direction+".sql")
+		versionPart, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %q has no name", fileName)
+		}
+		version, err := strconv.ParseInt(versionPart, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %q has invalid version: %w", fileName, err)
+		}
+		body, err := fs.ReadFile(fsys, path.Join(dir, fileName))
+		if err != nil {
+			return nil, fmt.Errorf("error while reading migration %q: %w", fileName, err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if m.name != name {
+			return nil, fmt.Errorf("migration version %d is used by %q and %q", version, m.name, name)
+		}
+		if direction == "up" {
+			m.up = string(body)
+		} else {
+			m.down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up and down files", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
+
+func (m *Migrator) ensureVersionTable(ctx context.Context) error {
+	const query = `create table if not exists schema_migrations (
+		version bigint primary key,
+		name text not null,
+		applied_at timestamptz not null default now()
+	)`
+	if _, err := m.db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("error while trying to create schema_migrations table: %w", err)
+	}
+	return nil
+}
+
+// rowsQuerier реализуют как *sql.DB, так и *sql.Tx.
+type rowsQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func appliedMigrations(ctx context.Context, q rowsQuerier) (map[int64]time.Time, error) {
+	rows, err := q.QueryContext(ctx, `select version, applied_at from schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var (
+			version   int64
+			appliedAt time.Time
+		)
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// Up применяет новые миграции, каждую в своей транзакции, и возвращает их количество.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	if err := m.ensureVersionTable(ctx); err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, mig := range m.migrations {
+		done, err := m.inLockedTx(ctx, func(tx *sql.Tx, applied map[int64]time.Time) (bool, error) {
+			if _, ok := applied[mig.version]; ok {
+				return false, nil
+			}
+			if _, err := tx.ExecContext(ctx, mig.up); err != nil {
+				return false, fmt.Errorf("error while applying migration %d_%s: %w", mig.version, mig.name, err)
+			}
+			if _, err := tx.ExecContext(ctx, `insert into schema_migrations (version, name) values ($1, $2)`, mig.version, mig.name); err != nil {
+				return false, err
+			}
+			return true, nil
+		})
+		if err != nil {
+			return count, err
+		}
+		if done {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Down откатывает последнюю применённую миграцию. Если откатывать нечего, возвращает false.
+func (m *Migrator) Down(ctx context.Context) (bool, error) {
+	if err := m.ensureVersionTable(ctx); err != nil {
+		return false, err
+	}
+	return m.inLockedTx(ctx, func(tx *sql.Tx, applied map[int64]time.Time) (bool, error) {
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.version]; !ok {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, mig.down); err != nil {
+				return false, fmt.Errorf("error while reverting migration %d_%s: %w", mig.version, mig.name, err)
+			}
+			if _, err := tx.ExecContext(ctx, `delete from schema_migrations where version = $1`, mig.version); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+		return false, nil
+	})
+}
+
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	if err := m.ensureVersionTable(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(ctx, m.db)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		appliedAt, ok := applied[mig.version]
+		statuses = append(statuses, MigrationStatus{
+			Version:   mig.version,
+			Name:      mig.name,
+			Applied:   ok,
+			AppliedAt: appliedAt,
+		})
+	}
+	return statuses, nil
+}
+
+func (m *Migrator) Close() error {
+	return m.db.Close()
+}
+
+// inLockedTx выполняет fn в транзакции под advisory-блокировкой.
+func (m *Migrator) inLockedTx(ctx context.Context, fn func(tx *sql.Tx, applied map[int64]time.Time) (bool, error)) (bool, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("error while trying to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `select pg_advisory_xact_lock($1)`, migrationsLockID); err != nil {
+		return false, fmt.Errorf("error while trying to lock migrations: %w", err)
+	}
+	applied, err := appliedMigrations(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+	done, err := fn(tx, applied)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("error while trying to commit migration: %w", err)
+	}
+	return done, nil
+}
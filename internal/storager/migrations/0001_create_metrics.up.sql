@@ -0,0 +1,6 @@
+create table if not exists metrics (
+    id text primary key,
+    mtype text,
+    delta bigint,
+    mvalue double precision
+);
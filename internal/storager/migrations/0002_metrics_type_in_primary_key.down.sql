@@ -0,0 +1,3 @@
+alter table metrics drop constraint if exists metrics_pkey;
+alter table metrics add primary key (id);
+alter table metrics alter column mtype drop not null;
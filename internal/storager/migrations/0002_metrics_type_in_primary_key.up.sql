@@ -0,0 +1,4 @@
+-- метрики разных типов могут иметь одинаковое имя
+alter table metrics alter column mtype set not null;
+alter table metrics drop constraint if exists metrics_pkey;
+alter table metrics add primary key (id, mtype);
@@ -0,0 +1,2 @@
+delete from metrics where mtype = 'histogram';
+alter table metrics drop column if exists histogram;
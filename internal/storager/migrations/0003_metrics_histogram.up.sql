@@ -0,0 +1,2 @@
+-- гистограмма хранится целиком: границы, счётчики корзин, сумма и количество
+alter table metrics add column if not exists histogram jsonb;
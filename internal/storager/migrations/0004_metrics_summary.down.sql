@@ -0,0 +1,2 @@
+delete from metrics where mtype = 'summary';
+alter table metrics drop column if exists summary;
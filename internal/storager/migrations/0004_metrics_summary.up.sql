@@ -0,0 +1,2 @@
+-- скетч квантилей summary хранится целиком
+alter table metrics add column if not exists summary jsonb;
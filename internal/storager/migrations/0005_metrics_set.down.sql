@@ -0,0 +1,2 @@
+delete from metrics where mtype = 'set';
+alter table metrics drop column if exists hll;
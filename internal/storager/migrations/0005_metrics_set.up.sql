@@ -0,0 +1,2 @@
+-- скетч HyperLogLog метрики set; имя set зарезервировано в SQL
+alter table metrics add column if not exists hll jsonb;
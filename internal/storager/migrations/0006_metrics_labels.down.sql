@@ -0,0 +1,6 @@
+delete from metrics where labels_key <> '';
+drop index if exists metrics_labels_idx;
+alter table metrics drop constraint if exists metrics_pkey;
+alter table metrics add primary key (id, mtype);
+alter table metrics drop column if exists labels_key;
+alter table metrics drop column if exists labels;
@@ -0,0 +1,7 @@
+-- метки ряда; labels_key — их каноническая запись из storage.Labels.Key(),
+-- по ней ряды различаются в первичном ключе
+alter table metrics add column if not exists labels jsonb not null default '{}';
+alter table metrics add column if not exists labels_key text not null default '';
+alter table metrics drop constraint if exists metrics_pkey;
+alter table metrics add primary key (id, mtype, labels_key);
+create index if not exists metrics_labels_idx on metrics using gin (labels);
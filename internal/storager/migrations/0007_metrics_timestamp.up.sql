@@ -0,0 +1,2 @@
+-- время последнего сэмпла; у строк, записанных до появления колонки, его нет
+alter table metrics add column if not exists ts timestamptz;
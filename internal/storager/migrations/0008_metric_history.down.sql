@@ -0,0 +1,3 @@
+drop trigger if exists metrics_history on metrics;
+drop function if exists record_metric_history();
+drop table if exists metric_history;
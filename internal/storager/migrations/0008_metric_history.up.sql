@@ -0,0 +1,30 @@
+create table if not exists metric_history (
+    id text not null,
+    mtype text not null,
+    labels_key text not null default '',
+    ts timestamptz not null,
+    delta bigint,
+    mvalue double precision
+);
+create index if not exists metric_history_series_idx on metric_history (mtype, id, labels_key, ts);
+
+-- история пишется триггером, поэтому в неё попадает любое изменение строки metrics;
+-- у histogram, summary и set в delta сохраняется число наблюдений
+create or replace function record_metric_history() returns trigger as $$
+begin
+    if tg_op = 'DELETE' then
+        delete from metric_history
+        where mtype = old.mtype and id = old.id and labels_key = old.labels_key;
+    elsif new.ts is not null then
+        insert into metric_history (id, mtype, labels_key, ts, delta, mvalue)
+        values (new.id, new.mtype, new.labels_key, new.ts,
+                coalesce(new.delta, (new.histogram->>'count')::bigint, (new.summary->>'count')::bigint, (new.hll->>'count')::bigint),
+                new.mvalue);
+    end if;
+    return null;
+end;
+$$ language plpgsql;
+
+drop trigger if exists metrics_history on metrics;
+create trigger metrics_history after insert or update or delete on metrics
+    for each row execute function record_metric_history();
@@ -0,0 +1,20 @@
+create or replace function record_metric_history() returns trigger as $$
+begin
+    if tg_op = 'DELETE' then
+        delete from metric_history
+        where mtype = old.mtype and id = old.id and labels_key = old.labels_key;
+    elsif new.ts is not null then
+        insert into metric_history (id, mtype, labels_key, ts, delta, mvalue)
+        values (new.id, new.mtype, new.labels_key, new.ts,
+                coalesce(new.delta, (new.histogram->>'count')::bigint, (new.summary->>'count')::bigint, (new.hll->>'count')::bigint),
+                new.mvalue);
+    end if;
+    return null;
+end;
+$$ language plpgsql;
+
+drop table if exists rollup_state;
+drop table if exists metric_rollups;
+drop index if exists metric_history_seq_idx;
+alter table metric_history drop column if exists increase;
+alter table metric_history drop column if exists seq;
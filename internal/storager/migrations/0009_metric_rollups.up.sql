@@ -0,0 +1,54 @@
+-- seq задаёт порядок поступления сэмплов, по нему задание агрегации помнит,
+-- докуда история уже учтена; increase — прирост накопительной метрики
+alter table metric_history add column if not exists seq bigserial;
+alter table metric_history add column if not exists increase bigint;
+create index if not exists metric_history_seq_idx on metric_history (seq);
+
+create table if not exists metric_rollups (
+    id text not null,
+    mtype text not null,
+    labels_key text not null default '',
+    resolution text not null,
+    bucket_start timestamptz not null,
+    count bigint not null,
+    min double precision,
+    max double precision,
+    total double precision,
+    last double precision,
+    last_ts timestamptz,
+    increase bigint not null default 0,
+    primary key (mtype, id, labels_key, resolution, bucket_start)
+);
+
+create table if not exists rollup_state (
+    resolution text primary key,
+    seq bigint not null
+);
+
+create or replace function record_metric_history() returns trigger as $$
+declare
+    total bigint;
+    previous bigint;
+begin
+    if tg_op = 'DELETE' then
+        delete from metric_history
+        where mtype = old.mtype and id = old.id and labels_key = old.labels_key;
+        delete from metric_rollups
+        where mtype = old.mtype and id = old.id and labels_key = old.labels_key;
+        return null;
+    end if;
+    if new.ts is null then
+        return null;
+    end if;
+
+    total := coalesce(new.delta, (new.histogram->>'count')::bigint, (new.summary->>'count')::bigint, (new.hll->>'count')::bigint);
+    if tg_op = 'UPDATE' and new.mtype <> 'gauge' then
+        previous := coalesce(old.delta, (old.histogram->>'count')::bigint, (old.summary->>'count')::bigint, (old.hll->>'count')::bigint);
+    end if;
+    -- прирост нового ряда считается от нуля
+    insert into metric_history (id, mtype, labels_key, ts, delta, mvalue, increase)
+    values (new.id, new.mtype, new.labels_key, new.ts, total, new.mvalue,
+        case when new.mtype <> 'gauge' then total - coalesce(previous, 0) end);
+    return null;
+end;
+$$ language plpgsql;
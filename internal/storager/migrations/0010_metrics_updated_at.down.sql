@@ -0,0 +1,3 @@
+drop trigger if exists metrics_updated_at on metrics;
+drop function if exists touch_metrics_updated_at();
+alter table metrics drop column if exists updated_at;
@@ -0,0 +1,13 @@
+-- время последней записи ряда сервером, по нему удаляются устаревшие ряды
+alter table metrics add column if not exists updated_at timestamptz not null default now();
+
+create or replace function touch_metrics_updated_at() returns trigger as $$
+begin
+    new.updated_at := now();
+    return new;
+end;
+$$ language plpgsql;
+
+drop trigger if exists metrics_updated_at on metrics;
+create trigger metrics_updated_at before update on metrics
+    for each row execute function touch_metrics_updated_at();
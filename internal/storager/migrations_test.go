@@ -0,0 +1,102 @@
+package storager
+
+import (
+	"context"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sersus/go-yandex-metrics/internal/config"
+	"github.com/sersus/go-yandex-metrics/internal/storage"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	t.Run("embedded", func(t *testing.T) {
+		migrations, err := loadMigrations(migrationFiles, "migrations")
+		require.NoError(t, err)
+		require.NotEmpty(t, migrations)
+		for i, m := range migrations {
+			assert.Equal(t, int64(i+1), m.version)
+			assert.NotEmpty(t, m.up)
+			assert.NotEmpty(t, m.down)
+		}
+	})
+
+	t.Run("sorted by version", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"m/0010_second.up.sql":   {Data: []byte("up 10")},
+			"m/0010_second.down.sql": {Data: []byte("down 10")},
+			"m/0002_first.up.sql":    {Data: []byte("up 2")},
+			"m/0002_first.down.sql":  {Data: []byte("down 2")},
+			"m/README.md":            {Data: []byte("ignored")},
+		}
+		migrations, err := loadMigrations(fsys, "m")
+		require.NoError(t, err)
+		assert.Equal(t, []migration{
+			{version: 2, name: "first", up: "up 2", down: "down 2"},
+			{version: 10, name: "second", up: "up 10", down: "down 10"},
+		}, migrations)
+	})
+
+	t.Run("missing down", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"m/0001_first.up.sql": {Data: []byte("up")},
+		}
+		_, err := loadMigrations(fsys, "m")
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid version", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"m/first_table.up.sql": {Data: []byte("up")},
+		}
+		_, err := loadMigrations(fsys, "m")
+		assert.Error(t, err)
+	})
+}
+
+func TestMigratorUpDown(t *testing.T) {
+	newTestDBSaver(t, config.Options{})
+	ctx := context.Background()
+	migrator, err := NewMigrator(&config.Options{DatabaseAddress: os.Getenv(testDBEnv)})
+	require.NoError(t, err)
+	defer migrator.Close()
+
+	statuses, err := migrator.Status(ctx)
+	require.NoError(t, err)
+	for _, status := range statuses {
+		assert.True(t, status.Applied, "migration %d", status.Version)
+	}
+
+	// каждая миграция откатывается своей down-частью
+	for range migrator.migrations {
+		reverted, err := migrator.Down(ctx)
+		require.NoError(t, err)
+		assert.True(t, reverted)
+	}
+	reverted, err := migrator.Down(ctx)
+	require.NoError(t, err)
+	assert.False(t, reverted)
+	statuses, err = migrator.Status(ctx)
+	require.NoError(t, err)
+	for _, status := range statuses {
+		assert.False(t, status.Applied, "migration %d", status.Version)
+	}
+
+	applied, err := migrator.Up(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, len(migrator.migrations), applied)
+	applied, err = migrator.Up(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, applied)
+
+	// схема после повторного применения рабочая
+	m, err := NewDBSaver(&config.Options{DatabaseAddress: os.Getenv(testDBEnv)}, ctx)
+	require.NoError(t, err)
+	defer m.Close()
+	_, err = m.Update(ctx, storage.Metric{ID: "c", MType: storage.Counter, Delta: ptrInt64(1)})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,69 @@
+package storager
+
+import (
+	"context"
+	"time"
+
+	"github.com/sersus/go-yandex-metrics/internal/config"
+	"github.com/sersus/go-yandex-metrics/internal/middleware"
+	"github.com/sersus/go-yandex-metrics/internal/storage"
+)
+
+// roller — хранилище, которое умеет агрегировать историю в корзины.
+type roller interface {
+	// Rollup учитывает в корзинах ещё не учтённые сэмплы истории и удаляет
+	// корзины старше срока хранения своего разрешения.
+	Rollup(ctx context.Context, now time.Time, retention storage.RollupRetention) error
+}
+
+var (
+	_ roller = (*storage.MetricCollection)(nil)
+	_ roller = (*filesaver)(nil)
+	_ roller = (*dbsaver)(nil)
+)
+
+// Roller периодически агрегирует историю в корзины по минуте и по часу.
+type Roller struct {
+	roller    roller
+	retention storage.RollupRetention
+	interval  time.Duration
+}
+
+func InitRoller(opts *config.Options, store storage.Storage) *Roller {
+	r, _ := store.(roller)
+	return &Roller{
+		roller: r,
+		retention: storage.RollupRetention{
+			storage.ResolutionMinute: time.Duration(opts.RollupMinuteRetention) * time.Hour,
+			storage.ResolutionHour:   time.Duration(opts.RollupHourRetention) * time.Hour,
+		},
+		interval: time.Duration(opts.RollupInterval) * time.Second,
+	}
+}
+
+// Run выполняет агрегацию раз в интервал до отмены ctx.
+func (r *Roller) Run(ctx context.Context) {
+	if r.roller == nil || r.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Rollup(ctx); err != nil {
+				middleware.SugarLogger.Errorw(err.Error(), "event", "rollup history")
+			}
+		}
+	}
+}
+
+// Rollup выполняет одну агрегацию.
+func (r *Roller) Rollup(ctx context.Context) error {
+	if r.roller == nil {
+		return nil
+	}
+	return r.roller.Rollup(ctx, time.Now(), r.retention)
+}
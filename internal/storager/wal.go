@@ -0,0 +1,201 @@
+package storager
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sersus/go-yandex-metrics/internal/middleware"
+	"github.com/sersus/go-yandex-metrics/internal/storage"
+)
+
+// walEntry — итоговое состояние метрики, поэтому повторное применение безопасно.
+type walEntry struct {
+	Metric  storage.Metric `json:"metric"`
+	Deleted bool           `json:"deleted,omitempty"`
+}
+
+// wal — журнал из сегментов <файл>.wal.<номер>; пишется последний сегмент.
+// Вызывающий держит блокировку.
+type wal struct {
+	base string
+	seq  int
+	file *os.File
+}
+
+type walSegment struct {
+	seq  int
+	path string
+}
+
+func walSegmentPath(base string, seq int) string {
+	return fmt.Sprintf("%s.wal.%06d", base, seq)
+}
+
+// walSegments возвращает существующие сегменты журнала по возрастанию номера.
+func walSegments(base string) ([]walSegment, error) {
+	dir := filepath.Dir(base)
+	prefix := filepath.Base(base) + ".wal."
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var segments []walSegment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimPrefix(name, prefix))
+		if err != nil {
+			continue
+		}
+		segments = append(segments, walSegment{seq: seq, path: filepath.Join(dir, name)})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].seq < segments[j].seq
+	})
+	return segments, nil
+}
+
+// openWAL начинает новый сегмент после уже существующих.
+func openWAL(base string) (*wal, error) {
+	segments, err := walSegments(base)
+	if err != nil {
+		return nil, err
+	}
+	w := &wal{base: base}
+	if len(segments) > 0 {
+		w.seq = segments[len(segments)-1].seq
+	}
+	if err := w.next(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *wal) next() error {
+	file, err := os.OpenFile(walSegmentPath(w.base, w.seq+1), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	w.seq++
+	w.file = file
+	return nil
+}
+
+// append дописывает записи и сбрасывает их на диск до возврата.
+func (w *wal) append(entries ...walEntry) error {
+	var buf []byte
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, data...)
+		buf = append(buf, '\n')
+	}
+	if _, err := w.file.Write(buf); err != nil {
+		return fmt.Errorf("error while writing to wal: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("error while syncing wal: %w", err)
+	}
+	return nil
+}
+
+// rotate закрывает текущий сегмент, открывает следующий и возвращает его номер.
+func (w *wal) rotate() (int, error) {
+	if err := w.file.Close(); err != nil {
+		return 0, err
+	}
+	if err := w.next(); err != nil {
+		return 0, err
+	}
+	return w.seq, nil
+}
+
+// removeBefore удаляет сегменты, уже учтённые в сохранённом снимке.
+func (w *wal) removeBefore(seq int) error {
+	segments, err := walSegments(w.base)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if segment.seq >= seq {
+			break
+		}
+		if err := os.Remove(segment.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *wal) Close() error {
+	return w.file.Close()
+}
+
+// replayWAL применяет к коллекции все сегменты журнала по порядку.
+// Оборванная последняя запись сегмента пропускается.
+func replayWAL(base string, mc *storage.MetricCollection) (int, error) {
+	segments, err := walSegments(base)
+	if err != nil {
+		return 0, err
+	}
+	replayed := 0
+	for _, segment := range segments {
+		n, err := replaySegment(segment.path, mc)
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+func replaySegment(path string, mc *storage.MetricCollection) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	replayed := 0
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var entry walEntry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				middleware.SugarLogger.Warnw("skip corrupted wal tail", "file", path, "error", err)
+				return replayed, nil
+			}
+			if entry.Deleted {
+				_ = mc.Delete(context.Background(), entry.Metric.MType, entry.Metric.ID, entry.Metric.Labels)
+			} else {
+				mc.UpsertMetric(entry.Metric)
+			}
+			replayed++
+		} else if len(line) > 0 {
+			middleware.SugarLogger.Warnw("skip incomplete wal record", "file", path)
+		}
+		if err == io.EOF {
+			return replayed, nil
+		}
+		if err != nil {
+			return replayed, err
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package storager
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sersus/go-yandex-metrics/internal/config"
+	"github.com/sersus/go-yandex-metrics/internal/storage"
+)
+
+func openTestFilesaver(t *testing.T, fileName string) *filesaver {
+	fs, err := NewFilesaver(&config.Options{FileStoragePath: fileName, FileBackups: 1, StoreInterval: 300, Restore: true}, context.Background())
+	require.NoError(t, err)
+	t.Cleanup(func() { fs.Close() })
+	return fs
+}
+
+func counterValue(t *testing.T, fs *filesaver, name string) int64 {
+	metric, err := fs.Get(context.Background(), storage.Counter, name, nil)
+	require.NoError(t, err)
+	return *metric.Delta
+}
+
+func TestFilesaver_WALReplay(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+
+	fs := openTestFilesaver(t, fileName)
+	_, err := fs.Update(ctx, storage.Metric{ID: "counter1", MType: storage.Counter, Delta: ptrInt64(2)})
+	require.NoError(t, err)
+	require.NoError(t, fs.Flush(ctx))
+
+	// обновления после снимка есть только в журнале
+	_, err = fs.Update(ctx, storage.Metric{ID: "counter1", MType: storage.Counter, Delta: ptrInt64(3)})
+	require.NoError(t, err)
+	_, err = fs.UpdateBatch(ctx, []storage.Metric{
+		{ID: "gauge1", MType: storage.Gauge, Value: ptrFloat64(1.5)},
+		{ID: "gauge2", MType: storage.Gauge, Value: ptrFloat64(2.5)},
+	})
+	require.NoError(t, err)
+	require.NoError(t, fs.Delete(ctx, storage.Gauge, "gauge2", nil))
+
+	restored := openTestFilesaver(t, fileName)
+	assert.Equal(t, int64(5), counterValue(t, restored, "counter1"))
+	gauge, err := restored.Get(ctx, storage.Gauge, "gauge1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, *gauge.Value)
+	_, err = restored.Get(ctx, storage.Gauge, "gauge2", nil)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestFilesaver_WALCompaction(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+
+	fs := openTestFilesaver(t, fileName)
+	for i := 0; i < 3; i++ {
+		_, err := fs.Update(ctx, storage.Metric{ID: "counter1", MType: storage.Counter, Delta: ptrInt64(1)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, fs.Flush(ctx))
+
+	segments, err := walSegments(fileName)
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	info, err := os.Stat(segments[0].path)
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+}
+
+func TestFilesaver_WALReplayIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+
+	fs := openTestFilesaver(t, fileName)
+	_, err := fs.Update(ctx, storage.Metric{ID: "counter1", MType: storage.Counter, Delta: ptrInt64(4)})
+	require.NoError(t, err)
+
+	// сбой после записи снимка, но до удаления учтённых сегментов
+	require.NoError(t, fs.Save(ctx, fs.Snapshot()))
+
+	restored := openTestFilesaver(t, fileName)
+	assert.Equal(t, int64(4), counterValue(t, restored, "counter1"))
+}
+
+func TestFilesaver_WALTornTail(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+
+	fs := openTestFilesaver(t, fileName)
+	_, err := fs.Update(ctx, storage.Metric{ID: "counter1", MType: storage.Counter, Delta: ptrInt64(4)})
+	require.NoError(t, err)
+
+	file, err := os.OpenFile(walSegmentPath(fileName, fs.wal.seq), os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"metric":{"id":"counter1","type":"coun`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	restored := openTestFilesaver(t, fileName)
+	assert.Equal(t, int64(4), counterValue(t, restored, "counter1"))
+}
+
+func TestFilesaver_WALWithoutValidSnapshot(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+
+	fs := openTestFilesaver(t, fileName)
+	_, err := fs.Update(ctx, storage.Metric{ID: "counter1", MType: storage.Counter, Delta: ptrInt64(2)})
+	require.NoError(t, err)
+	require.NoError(t, fs.Flush(ctx))
+	_, err = fs.Update(ctx, storage.Metric{ID: "counter1", MType: storage.Counter, Delta: ptrInt64(3)})
+	require.NoError(t, err)
+	require.NoError(t, fs.Close())
+
+	require.NoError(t, os.WriteFile(fileName, []byte("garbage"), 0666))
+	require.NoError(t, os.WriteFile(fileName+".1", []byte("garbage"), 0666))
+
+	// журнал повторяется и на пустой коллекции, а следующий снимок его учитывает
+	restored := openTestFilesaver(t, fileName)
+	assert.Equal(t, int64(5), counterValue(t, restored, "counter1"))
+	require.NoError(t, restored.Flush(ctx))
+	require.NoError(t, restored.Close())
+
+	again := openTestFilesaver(t, fileName)
+	assert.Equal(t, int64(5), counterValue(t, again, "counter1"))
+}
+
+func TestFilesaver_WALFailureKeepsCollection(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+
+	fs := openTestFilesaver(t, fileName)
+	_, err := fs.Update(ctx, storage.Metric{ID: "counter1", MType: storage.Counter, Delta: ptrInt64(2)})
+	require.NoError(t, err)
+
+	// запись в закрытый сегмент не удаётся, и повтор запроса не должен учесть дельту дважды
+	require.NoError(t, fs.wal.file.Close())
+	_, err = fs.Update(ctx, storage.Metric{ID: "counter1", MType: storage.Counter, Delta: ptrInt64(3)})
+	assert.Error(t, err)
+	_, err = fs.UpdateBatch(ctx, []storage.Metric{{ID: "gauge1", MType: storage.Gauge, Value: ptrFloat64(1)}})
+	assert.Error(t, err)
+	assert.Error(t, fs.Delete(ctx, storage.Counter, "counter1", nil))
+
+	assert.Equal(t, int64(2), counterValue(t, fs, "counter1"))
+	_, err = fs.Get(ctx, storage.Gauge, "gauge1", nil)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestFilesaver_NonFiniteGauges(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+	params := &config.Options{FileStoragePath: fileName, FileBackups: 1, Restore: true, GaugeNonFinite: storage.NonFiniteAllow}
+
+	fs, err := NewFilesaver(params, ctx)
+	require.NoError(t, err)
+	_, err = fs.Update(ctx, storage.Metric{ID: "gauge1", MType: storage.Gauge, Value: ptrFloat64(math.Inf(-1))})
+	require.NoError(t, err)
+	require.NoError(t, fs.Flush(ctx))
+	_, err = fs.Update(ctx, storage.Metric{ID: "gauge2", MType: storage.Gauge, Value: ptrFloat64(math.NaN())})
+	require.NoError(t, err)
+	require.NoError(t, fs.Close())
+
+	restored, err := NewFilesaver(params, ctx)
+	require.NoError(t, err)
+	t.Cleanup(func() { restored.Close() })
+	gauge, err := restored.Get(ctx, storage.Gauge, "gauge1", nil)
+	require.NoError(t, err)
+	assert.True(t, math.IsInf(*gauge.Value, -1))
+	gauge, err = restored.Get(ctx, storage.Gauge, "gauge2", nil)
+	require.NoError(t, err)
+	assert.True(t, math.IsNaN(*gauge.Value))
+
+	_, err = NewFilesaver(&config.Options{FileStoragePath: fileName, GaugeNonFinite: "clamp"}, ctx)
+	assert.Error(t, err)
+}
+
+func TestFilesaver_Histogram(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+
+	fs := openTestFilesaver(t, fileName)
+	_, err := fs.Update(ctx, storage.Metric{ID: "latency", MType: storage.Histogram, Value: ptrFloat64(0.2)})
+	require.NoError(t, err)
+	require.NoError(t, fs.Flush(ctx))
+	_, err = fs.Update(ctx, storage.Metric{ID: "latency", MType: storage.Histogram, Value: ptrFloat64(20)})
+	require.NoError(t, err)
+
+	restored := openTestFilesaver(t, fileName)
+	metric, err := restored.Get(ctx, storage.Histogram, "latency", nil)
+	require.NoError(t, err)
+	require.NotNil(t, metric.Histogram)
+	assert.Equal(t, uint64(2), metric.Histogram.Count)
+	assert.Equal(t, 20.2, metric.Histogram.Sum)
+	assert.Equal(t, storage.DefaultHistogramBounds, metric.Histogram.Bounds)
+}
+
+func TestFilesaver_SetAndSummary(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+
+	fs := openTestFilesaver(t, fileName)
+	_, err := fs.Update(ctx, storage.Metric{ID: "users", MType: storage.Set, Members: []string{"alice", "bob"}})
+	require.NoError(t, err)
+	_, err = fs.Update(ctx, storage.Metric{ID: "latency", MType: storage.Summary, Value: ptrFloat64(12)})
+	require.NoError(t, err)
+	require.NoError(t, fs.Flush(ctx))
+	_, err = fs.Update(ctx, storage.Metric{ID: "users", MType: storage.Set, Members: []string{"carol"}})
+	require.NoError(t, err)
+
+	restored := openTestFilesaver(t, fileName)
+	set, err := restored.Get(ctx, storage.Set, "users", nil)
+	require.NoError(t, err)
+	require.NotNil(t, set.Set)
+	assert.Equal(t, uint64(3), set.Set.Count)
+	summary, err := restored.Get(ctx, storage.Summary, "latency", nil)
+	require.NoError(t, err)
+	require.NotNil(t, summary.Summary)
+	assert.Equal(t, uint64(1), summary.Summary.Count)
+}
+
+func TestFilesaver_Labels(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+
+	fs := openTestFilesaver(t, fileName)
+	_, err := fs.UpdateBatch(ctx, []storage.Metric{
+		{ID: "Alloc", MType: storage.Gauge, Value: ptrFloat64(1.5), Labels: storage.Labels{"host": "web-1"}},
+		{ID: "Alloc", MType: storage.Gauge, Value: ptrFloat64(2.5), Labels: storage.Labels{"host": "web-2"}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, fs.Flush(ctx))
+	require.NoError(t, fs.Delete(ctx, storage.Gauge, "Alloc", storage.Labels{"host": "web-2"}))
+
+	restored := openTestFilesaver(t, fileName)
+	gauge, err := restored.Get(ctx, storage.Gauge, "Alloc", storage.Labels{"host": "web-1"})
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, *gauge.Value)
+	_, err = restored.Get(ctx, storage.Gauge, "Alloc", storage.Labels{"host": "web-2"})
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}